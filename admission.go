@@ -0,0 +1,271 @@
+/*
+ * Admission control: bounds the number of requests being scanned at the same
+ * time, and the memory and disk space used to hold their bodies. Requests
+ * over the limits wait in a bounded queue, and are refused with a 503 if the
+ * queue is full or they have waited too long.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The spool space reserved at a time by the bodies of unknown length and no
+// size limit, as they are read
+const admissionSpoolStep = 1024 * 1024
+
+var (
+	errSpoolFull  = errors.New("max-spool-bytes reached while receiving the body")
+	errQueueFull  = errors.New("admission queue is full")
+	errQueueWait  = errors.New("timed out waiting in the admission queue")
+	errOversized  = errors.New("request can never fit the admission limits")
+	errNotWaiting = errors.New("request cancelled while waiting for admission")
+)
+
+/*
+ * The admission controller. Zero limits mean unlimited.
+ */
+type Admission struct {
+	// Maximum number of requests being scanned
+	MaxConcurrent int
+	// Maximum bytes held in memory, and spooled to disk, by the requests
+	// being scanned
+	MaxMemory int64
+	MaxSpool  int64
+	// Maximum number of requests waiting, and how long they can wait. With
+	// no queue, requests over the limits are refused straight away.
+	QueueSize int
+	Timeout   time.Duration
+	// Seconds to advertise in the Retry-After header of refusals
+	RetryAfter int
+	// Bodies up to this size are held in memory, larger ones on disk. It
+	// must match the forwarder content memory threshold.
+	MemoryThreshold int64
+
+	mutex    sync.Mutex
+	changed  chan struct{}
+	inFlight int
+	memory   int64
+	spool    int64
+	waiting  int
+}
+
+/*
+ * A snapshot of the admission controller state
+ */
+type AdmissionStats struct {
+	InFlight int
+	Memory   int64
+	Spool    int64
+	Waiting  int
+}
+
+/*
+ * Admits the request, or writes the overloaded response. If the request is
+ * admitted, the returned function must be called once it has been handled.
+ *
+ * bodyLimit is the maximum body size of the request (zero if unlimited): it
+ * is what gets reserved for bodies whose length is unknown in advance. Without
+ * a limit, their spool space is reserved as they are read, and reading them
+ * fails with errSpoolFull once there is no space left.
+ */
+func (a *Admission) Admit(w http.ResponseWriter, req *http.Request, bodyLimit int64, responses *Responses) (func(), bool) {
+	if a == nil || req.ContentLength == 0 {
+		return func() {}, true
+	}
+	memory, spool := a.reservation(req.ContentLength, bodyLimit)
+	release, err := a.Acquire(req.Context(), memory, spool)
+	if err != nil {
+		ctx.Logger.Printf("Request %s %s refused: %s (%s)", req.Method, req.URL.Path, err.Error(), a.Stats())
+		if a.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(a.RetryAfter))
+		}
+		responses.Respond(w, req, OUTCOME_OVERLOADED, &ResponseData{RetryAfter: a.RetryAfter})
+		return nil, false
+	}
+	if req.ContentLength < 0 && bodyLimit <= 0 && a.MaxSpool > 0 && req.Body != nil {
+		body := &spoolingBody{ReadCloser: req.Body, admission: a, reserved: spool}
+		req.Body = body
+		return func() {
+			a.free(0, 0, body.grown)
+			release()
+		}, true
+	}
+	return release, true
+}
+
+/*
+ * Works out how much memory or disk space a body will take
+ */
+func (a *Admission) reservation(contentLength int64, bodyLimit int64) (int64, int64) {
+	switch {
+	case contentLength < 0 && bodyLimit > 0:
+		return 0, bodyLimit
+	case contentLength < 0:
+		return 0, a.MemoryThreshold
+	case contentLength > a.MemoryThreshold:
+		return 0, contentLength
+	}
+	return contentLength, 0
+}
+
+/*
+ * Reserves a scan slot, and the given amount of memory and spool space,
+ * waiting in the queue if needed. Returns the function to release them.
+ */
+func (a *Admission) Acquire(reqCtx context.Context, memory int64, spool int64) (func(), error) {
+	if (a.MaxMemory > 0 && memory > a.MaxMemory) || (a.MaxSpool > 0 && spool > a.MaxSpool) {
+		return nil, errOversized
+	}
+
+	a.mutex.Lock()
+	if a.changed == nil {
+		a.changed = make(chan struct{})
+	}
+	if !a.fits(memory, spool) {
+		if a.waiting >= a.QueueSize {
+			a.mutex.Unlock()
+			return nil, errQueueFull
+		}
+		a.waiting++
+		var timeout <-chan time.Time
+		if a.Timeout > 0 {
+			timer := time.NewTimer(a.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		for !a.fits(memory, spool) {
+			changed := a.changed
+			a.mutex.Unlock()
+			var err error
+			select {
+			case <-changed:
+			case <-timeout:
+				err = errQueueWait
+			case <-reqCtx.Done():
+				err = errNotWaiting
+			}
+			a.mutex.Lock()
+			if err != nil {
+				a.waiting--
+				a.mutex.Unlock()
+				return nil, err
+			}
+		}
+		a.waiting--
+	}
+	a.inFlight++
+	a.memory += memory
+	a.spool += spool
+	a.mutex.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.free(1, memory, spool) })
+	}, nil
+}
+
+/*
+ * Reserves more memory or spool space for a request already admitted,
+ * without waiting. Returns the function to release it, or false if it does
+ * not fit. Nil-safe: without admission control, everything fits.
+ */
+func (a *Admission) Reserve(memory int64, spool int64) (func(), bool) {
+	if a == nil {
+		return func() {}, true
+	}
+	if !a.take(memory, spool) {
+		return nil, false
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.free(0, memory, spool) })
+	}, true
+}
+
+/*
+ * Takes memory or spool space if it fits, without waiting
+ */
+func (a *Admission) take(memory int64, spool int64) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if (a.MaxMemory > 0 && a.memory+memory > a.MaxMemory) || (a.MaxSpool > 0 && a.spool+spool > a.MaxSpool) {
+		return false
+	}
+	a.memory += memory
+	a.spool += spool
+	return true
+}
+
+/*
+ * Releases a request slot, memory or spool space, and wakes up the requests
+ * waiting for them
+ */
+func (a *Admission) free(inFlight int, memory int64, spool int64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.inFlight -= inFlight
+	a.memory -= memory
+	a.spool -= spool
+	if a.changed != nil {
+		close(a.changed)
+	}
+	a.changed = make(chan struct{})
+}
+
+/*
+ * Returns true if a request with the given reservation can be admitted now.
+ * Must be called with the mutex held.
+ */
+func (a *Admission) fits(memory int64, spool int64) bool {
+	return (a.MaxConcurrent <= 0 || a.inFlight < a.MaxConcurrent) &&
+		(a.MaxMemory <= 0 || a.memory+memory <= a.MaxMemory) &&
+		(a.MaxSpool <= 0 || a.spool+spool <= a.MaxSpool)
+}
+
+/*
+ * Returns the current state
+ */
+func (a *Admission) Stats() AdmissionStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return AdmissionStats{InFlight: a.inFlight, Memory: a.memory, Spool: a.spool, Waiting: a.waiting}
+}
+
+func (s AdmissionStats) String() string {
+	return fmt.Sprintf("%d in flight, %d waiting, %d bytes in memory, %d bytes spooled", s.InFlight, s.Waiting, s.Memory, s.Spool)
+}
+
+/*
+ * A body of unknown length, reserving spool space as it is read
+ */
+type spoolingBody struct {
+	io.ReadCloser
+	admission *Admission
+	// Bytes read so far, and reserved for them
+	read     int64
+	reserved int64
+	// The part of the reservation made while reading, released along with
+	// the request
+	grown int64
+}
+
+func (b *spoolingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	for b.read > b.reserved {
+		if !b.admission.take(0, admissionSpoolStep) {
+			return n, errSpoolFull
+		}
+		b.reserved += admissionSpoolStep
+		b.grown += admissionSpoolStep
+	}
+	return n, err
+}
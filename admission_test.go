@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmission_Concurrency(t *testing.T) {
+	admission := &Admission{MaxConcurrent: 2}
+
+	release1, err := admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+	release2, err := admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+
+	// No queue: refused straight away
+	_, err = admission.Acquire(context.Background(), 0, 0)
+	assert.Equal(t, errQueueFull, err)
+
+	release1()
+	release1() // releasing twice has no effect
+	assert.Equal(t, 1, admission.Stats().InFlight)
+
+	release3, err := admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+	release2()
+	release3()
+	assert.Equal(t, AdmissionStats{}, admission.Stats())
+}
+
+func TestAdmission_Queue(t *testing.T) {
+	admission := &Admission{MaxConcurrent: 1, QueueSize: 1, Timeout: time.Second}
+
+	release, err := admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+
+	admitted := make(chan error)
+	go func() {
+		release, err := admission.Acquire(context.Background(), 0, 0)
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+
+	// Wait for the goroutine to be queued
+	for admission.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full
+	_, err = admission.Acquire(context.Background(), 0, 0)
+	assert.Equal(t, errQueueFull, err)
+
+	release()
+	assert.NoError(t, <-admitted)
+}
+
+func TestAdmission_Timeout(t *testing.T) {
+	admission := &Admission{MaxConcurrent: 1, QueueSize: 5, Timeout: 20 * time.Millisecond}
+
+	release, err := admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+	defer release()
+
+	_, err = admission.Acquire(context.Background(), 0, 0)
+	assert.Equal(t, errQueueWait, err)
+	assert.Equal(t, 0, admission.Stats().Waiting)
+}
+
+func TestAdmission_Bytes(t *testing.T) {
+	admission := &Admission{MaxMemory: 100, MaxSpool: 1000, MemoryThreshold: 50}
+
+	memory, spool := admission.reservation(40, 0)
+	assert.Equal(t, []int64{40, 0}, []int64{memory, spool})
+	memory, spool = admission.reservation(400, 0)
+	assert.Equal(t, []int64{0, 400}, []int64{memory, spool})
+	memory, spool = admission.reservation(-1, 700)
+	assert.Equal(t, []int64{0, 700}, []int64{memory, spool})
+	memory, spool = admission.reservation(-1, 0)
+	assert.Equal(t, []int64{0, 50}, []int64{memory, spool})
+
+	release, err := admission.Acquire(context.Background(), 0, 800)
+	require.NoError(t, err)
+	_, err = admission.Acquire(context.Background(), 0, 300)
+	assert.Equal(t, errQueueFull, err)
+	_, err = admission.Acquire(context.Background(), 0, 3000)
+	assert.Equal(t, errOversized, err)
+
+	memoryRelease, err := admission.Acquire(context.Background(), 50, 0)
+	require.NoError(t, err)
+	assert.Equal(t, AdmissionStats{InFlight: 2, Memory: 50, Spool: 800}, admission.Stats())
+	memoryRelease()
+	release()
+}
+
+func TestAdmission_UnknownLength(t *testing.T) {
+	setup()
+	admission := &Admission{MaxSpool: 3 * admissionSpoolStep, MemoryThreshold: 10}
+
+	// Without a body limit, spool space is reserved as the body is read
+	req := newHTTPRequest("POST", "application/octet-stream", strings.NewReader(strings.Repeat("x", 2*admissionSpoolStep)))
+	req.ContentLength = -1
+	release, admitted := admission.Admit(httptest.NewRecorder(), req, 0, nil)
+	require.True(t, admitted)
+	data, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Len(t, data, 2*admissionSpoolStep)
+	assert.Equal(t, int64(2*admissionSpoolStep+10), admission.Stats().Spool)
+
+	// until there is none left
+	other := newHTTPRequest("POST", "application/octet-stream", strings.NewReader(strings.Repeat("x", 2*admissionSpoolStep)))
+	other.ContentLength = -1
+	releaseOther, admitted := admission.Admit(httptest.NewRecorder(), other, 0, nil)
+	require.True(t, admitted)
+	_, err = io.ReadAll(other.Body)
+	assert.Equal(t, errSpoolFull, err)
+	assert.Equal(t, OUTCOME_OVERLOADED, outcomeOf(err, OUTCOME_INTERNAL_ERROR))
+
+	release()
+	releaseOther()
+	assert.Equal(t, AdmissionStats{}, admission.Stats())
+}
+
+func TestAdmission_Admit(t *testing.T) {
+	setup()
+	admission := &Admission{MaxConcurrent: 1, RetryAfter: 7}
+
+	req := newHTTPRequest("POST", "application/octet-stream", strings.NewReader("body"))
+	release, admitted := admission.Admit(httptest.NewRecorder(), req, 0, nil)
+	require.True(t, admitted)
+	defer release()
+
+	rr := httptest.NewRecorder()
+	_, admitted = admission.Admit(rr, req, 0, nil)
+	assert.False(t, admitted)
+	assert.Equal(t, 503, rr.Code)
+	assert.Equal(t, "7", rr.Header().Get("Retry-After"))
+
+	// Requests without body, and without admission control, always pass
+	_, admitted = admission.Admit(rr, newHTTPRequest("GET", "", nil), 0, nil)
+	assert.True(t, admitted)
+	_, admitted = (*Admission)(nil).Admit(rr, req, 0, nil)
+	assert.True(t, admitted)
+}
@@ -0,0 +1,182 @@
+/*
+ * Authentication of the /clammit endpoints: bearer tokens, HTTP basic auth
+ * against an htpasswd file of bcrypt hashes, and client certificate
+ * subjects. Scan and admin credentials are separate: scan credentials only
+ * give access to /clammit/scan, admin credentials to everything.
+ */
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	ROLE_SCAN  = "scan"
+	ROLE_ADMIN = "admin"
+)
+
+/*
+ * The credentials giving a role. A role without credentials is open, unless
+ * it is the admin role and there are scan credentials.
+ */
+type Credentials struct {
+	// Bearer tokens
+	Tokens []string
+	// Basic auth users, with their bcrypt password hashes
+	Users map[string][]byte
+	// Client certificate subjects, either the common name or the whole
+	// distinguished name (e.g. CN=uploader,O=Example)
+	Subjects []string
+}
+
+/*
+ * Returns true if there are no credentials
+ */
+func (c *Credentials) IsZero() bool {
+	return c == nil || (len(c.Tokens) == 0 && len(c.Users) == 0 && len(c.Subjects) == 0)
+}
+
+/*
+ * Loads the users of an htpasswd file. Only bcrypt hashes are supported, as
+ * generated by "htpasswd -B".
+ */
+func LoadHtpasswd(filename string) (map[string][]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("%s:%d: invalid entry", filename, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s does not have a bcrypt hash", filename, lineNumber, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+/*
+ * Checks the credentials of requests to the /clammit endpoints
+ */
+type Authenticator struct {
+	Scan  Credentials
+	Admin Credentials
+	// Realm advertised to basic auth clients
+	Realm string
+}
+
+/*
+ * Wraps the handler, so that it is only called for requests authorized for
+ * the given role. Unauthenticated requests get a 401, requests with the
+ * credentials of another role a 403. Once scan credentials are configured,
+ * the admin endpoints are never open: without admin credentials, they are
+ * closed.
+ */
+func (a *Authenticator) Protect(role string, handler http.Handler) http.Handler {
+	if a == nil || (a.credentials(role).IsZero() && (role != ROLE_ADMIN || a.Scan.IsZero())) {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		roles := a.Authenticate(req)
+		for _, r := range roles {
+			if r == role || r == ROLE_ADMIN {
+				handler.ServeHTTP(w, req)
+				return
+			}
+		}
+		if len(roles) > 0 {
+			ctx.Logger.Printf("Request %s %s forbidden: %s credentials required", req.Method, req.URL.Path, role)
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		ctx.Logger.Printf("Request %s %s unauthorized", req.Method, req.URL.Path)
+		if len(a.Scan.Users) > 0 || len(a.Admin.Users) > 0 {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm()))
+		}
+		if len(a.Scan.Tokens) > 0 || len(a.Admin.Tokens) > 0 {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm()))
+		}
+		http.Error(w, "Unauthorized", 401)
+	})
+}
+
+/*
+ * Returns the roles given by the credentials of the request
+ */
+func (a *Authenticator) Authenticate(req *http.Request) []string {
+	var roles []string
+	for _, role := range []string{ROLE_SCAN, ROLE_ADMIN} {
+		if credentials := a.credentials(role); !credentials.IsZero() && credentials.Accept(req) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func (a *Authenticator) credentials(role string) *Credentials {
+	if role == ROLE_ADMIN {
+		return &a.Admin
+	}
+	return &a.Scan
+}
+
+func (a *Authenticator) realm() string {
+	if a.Realm != "" {
+		return a.Realm
+	}
+	return "clammit"
+}
+
+/*
+ * Returns true if the request carries one of the credentials
+ */
+func (c *Credentials) Accept(req *http.Request) bool {
+	authorization := req.Header.Get("Authorization")
+	if scheme, token, found := strings.Cut(authorization, " "); found && strings.EqualFold(scheme, "Bearer") {
+		token = strings.TrimSpace(token)
+		for _, t := range c.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		if hash, found := c.Users[user]; found && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return true
+		}
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.PeerCertificates) > 0 {
+		if c.acceptSubject(req.TLS.PeerCertificates[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credentials) acceptSubject(cert *x509.Certificate) bool {
+	for _, subject := range c.Subjects {
+		if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, user, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(filename, []byte("# users\n"+user+":"+string(hash)+"\n"), 0600))
+	return filename
+}
+
+func authenticatedStatus(auth *Authenticator, role string, req *http.Request) *httptest.ResponseRecorder {
+	handler := auth.Protect(role, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthenticator_Tokens(t *testing.T) {
+	setup()
+	auth := &Authenticator{
+		Scan:  Credentials{Tokens: []string{"scan-secret"}},
+		Admin: Credentials{Tokens: []string{"admin-secret"}},
+	}
+
+	req := httptest.NewRequest("POST", "/clammit/scan", nil)
+	rr := authenticatedStatus(auth, ROLE_SCAN, req)
+	assert.Equal(t, 401, rr.Code)
+	assert.Equal(t, `Bearer realm="clammit"`, rr.Header().Get("WWW-Authenticate"))
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, 401, authenticatedStatus(auth, ROLE_SCAN, req).Code)
+
+	req.Header.Set("Authorization", "Bearer scan-secret")
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_SCAN, req).Code)
+	assert.Equal(t, 403, authenticatedStatus(auth, ROLE_ADMIN, req).Code, "scan credentials are not admin credentials")
+
+	req.Header.Set("Authorization", "bearer admin-secret")
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_ADMIN, req).Code)
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_SCAN, req).Code, "admin credentials can scan")
+}
+
+func TestAuthenticator_Htpasswd(t *testing.T) {
+	setup()
+	users, err := LoadHtpasswd(writeHtpasswd(t, "uploader", "s3cret"))
+	require.NoError(t, err)
+	auth := &Authenticator{Scan: Credentials{Users: users}, Realm: "uploads"}
+
+	req := httptest.NewRequest("POST", "/clammit/scan", nil)
+	rr := authenticatedStatus(auth, ROLE_SCAN, req)
+	assert.Equal(t, 401, rr.Code)
+	assert.Equal(t, `Basic realm="uploads"`, rr.Header().Get("WWW-Authenticate"))
+
+	req.SetBasicAuth("uploader", "wrong")
+	assert.Equal(t, 401, authenticatedStatus(auth, ROLE_SCAN, req).Code)
+	req.SetBasicAuth("uploader", "s3cret")
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_SCAN, req).Code)
+
+	// Admin endpoints are closed without admin credentials
+	req = httptest.NewRequest("GET", "/clammit", nil)
+	assert.Equal(t, 401, authenticatedStatus(auth, ROLE_ADMIN, req).Code)
+	req.SetBasicAuth("uploader", "s3cret")
+	assert.Equal(t, 403, authenticatedStatus(auth, ROLE_ADMIN, req).Code)
+
+	// Scan endpoints stay open with only admin credentials
+	auth = &Authenticator{Admin: Credentials{Users: users}}
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_SCAN, httptest.NewRequest("POST", "/clammit/scan", nil)).Code)
+	assert.Equal(t, 401, authenticatedStatus(auth, ROLE_ADMIN, httptest.NewRequest("GET", "/clammit", nil)).Code)
+}
+
+func TestAuthenticator_TLSSubject(t *testing.T) {
+	setup()
+	auth := &Authenticator{Admin: Credentials{Subjects: []string{"CN=ops,O=Example"}}}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops", Organization: []string{"Example"}}}
+
+	req := httptest.NewRequest("GET", "/clammit", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.Equal(t, 401, authenticatedStatus(auth, ROLE_ADMIN, req).Code, "unverified certificates are ignored")
+
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_ADMIN, req).Code)
+
+	auth.Admin.Subjects = []string{"ops"}
+	assert.Equal(t, 200, authenticatedStatus(auth, ROLE_ADMIN, req).Code, "common names match too")
+}
+
+func TestLoadHtpasswd_Invalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(filename, []byte("user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600))
+	_, err := LoadHtpasswd(filename)
+	assert.ErrorContains(t, err, "bcrypt")
+
+	_, err = LoadHtpasswd(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestBuildAuthenticator(t *testing.T) {
+	config := DefaultApplicationConfig
+	config.ScanTokens = []string{"a, b"}
+	config.AdminHtpasswdFile = writeHtpasswd(t, "admin", "pw")
+	config.AdminTLSSubjects = []string{"CN=ops,O=Example"}
+
+	auth, err := buildAuthenticator(&config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, auth.Scan.Tokens)
+	assert.Contains(t, auth.Admin.Users, "admin")
+	assert.Equal(t, []string{"CN=ops,O=Example"}, auth.Admin.Subjects)
+
+	config.ScanHtpasswdFile = "/nonexistent/htpasswd"
+	_, err = buildAuthenticator(&config)
+	assert.Error(t, err)
+}
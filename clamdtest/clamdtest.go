@@ -0,0 +1,313 @@
+/*
+ * An in-process fake clamd, speaking the clamd protocol over TCP or a unix
+ * socket, for tests:
+ *
+ *	clamd := clamdtest.NewServer()
+ *	defer clamd.Close()
+ *	clamd.AddRule(clamdtest.Found("virus", "Test.Virus"))
+ *	scanner.SetAddress(clamd.URL)
+ *
+ * Streams are matched against the rules, in the order they were added: the
+ * first match decides the reply. Streams containing the EICAR test string are
+ * infected, others are clean, unless a rule says otherwise.
+ */
+package clamdtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The EICAR test string, and the signature clamd reports for it
+var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+const EICAR_SIGNATURE = "Win.Test.EICAR_HDB-1"
+
+// The reply to VERSION
+const VERSION = "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024"
+
+/*
+ * How the server replies to the streams containing Pattern
+ */
+type Rule struct {
+	// Streams containing Pattern match the rule, an empty pattern matches
+	// every stream
+	Pattern string
+	// The reply line, without its newline, e.g. "stream: OK"
+	Reply string
+	// If true, the connection is closed without replying
+	Drop bool
+	// Wait before replying
+	Latency time.Duration
+}
+
+/*
+ * Streams containing the pattern are infected by the virus
+ */
+func Found(pattern string, signature string) Rule {
+	return Rule{Pattern: pattern, Reply: "stream: " + signature + " FOUND"}
+}
+
+/*
+ * Streams containing the pattern are clean
+ */
+func Clean(pattern string) Rule {
+	return Rule{Pattern: pattern, Reply: "stream: OK"}
+}
+
+/*
+ * The scan of streams containing the pattern fails with the message
+ */
+func Failure(pattern string, message string) Rule {
+	return Rule{Pattern: pattern, Reply: "stream: " + message + " ERROR"}
+}
+
+/*
+ * The reply to streams containing the pattern is not a valid clamd reply
+ */
+func Malformed(pattern string, reply string) Rule {
+	return Rule{Pattern: pattern, Reply: reply}
+}
+
+/*
+ * The connection is closed without a reply to streams containing the pattern
+ */
+func Drop(pattern string) Rule {
+	return Rule{Pattern: pattern, Drop: true}
+}
+
+/*
+ * Replies to all the streams after the latency
+ */
+func Slow(latency time.Duration) Rule {
+	return Rule{Reply: "stream: OK", Latency: latency}
+}
+
+/*
+ * A fake clamd server
+ */
+type Server struct {
+	// The address to configure clammit with, e.g. tcp://127.0.0.1:3310 or
+	// unix:/tmp/clamd.sock
+	URL      string
+	listener net.Listener
+	closed   chan struct{}
+	wg       sync.WaitGroup
+
+	mutex           sync.Mutex
+	rules           []Rule
+	streamMaxLength int64
+	scans           int
+	conns           map[net.Conn]bool
+}
+
+/*
+ * Starts a server listening on a local TCP port
+ */
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to listen: %v", err))
+	}
+	return start(listener, "tcp://"+listener.Addr().String())
+}
+
+/*
+ * Starts a server listening on a unix socket, in a new temporary directory
+ * removed by Close
+ */
+func NewUnixServer() *Server {
+	dir, err := os.MkdirTemp("", "clamdtest")
+	if err != nil {
+		panic(fmt.Sprintf("clamdtest: failed to create the socket directory: %v", err))
+	}
+	path := filepath.Join(dir, "clamd.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic(fmt.Sprintf("clamdtest: failed to listen: %v", err))
+	}
+	return start(listener, "unix:"+path)
+}
+
+func start(listener net.Listener, url string) *Server {
+	s := &Server{
+		URL:      url,
+		listener: listener,
+		closed:   make(chan struct{}),
+		conns:    map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+/*
+ * Adds rules, checked after the ones already added
+ */
+func (s *Server) AddRule(rules ...Rule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rules = append(s.rules, rules...)
+}
+
+/*
+ * Sets the largest stream accepted, like StreamMaxLength in clamd.conf.
+ * Zero means unlimited.
+ */
+func (s *Server) SetStreamMaxLength(length int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streamMaxLength = length
+}
+
+/*
+ * Returns the number of streams received
+ */
+func (s *Server) Scans() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.scans
+}
+
+/*
+ * Stops the server, closing the open connections
+ */
+func (s *Server) Close() {
+	close(s.closed)
+	s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	if path, found := strings.CutPrefix(s.URL, "unix:"); found {
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+/*
+ * Handles a single command: clammit opens a connection for each
+ */
+func (s *Server) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	command, err := readCommand(reader)
+	if err != nil {
+		return
+	}
+	switch command {
+	case "PING":
+		io.WriteString(conn, "PONG\n")
+	case "VERSION":
+		io.WriteString(conn, VERSION+"\n")
+	case "INSTREAM":
+		s.handleStream(conn, reader)
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\n")
+	}
+}
+
+/*
+ * Reads a command: "n" commands end with a newline, "z" commands with a
+ * null character
+ */
+func readCommand(reader *bufio.Reader) (string, error) {
+	prefix, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	delimiter := byte('\n')
+	if prefix == 'z' {
+		delimiter = 0
+	} else if prefix != 'n' {
+		reader.UnreadByte()
+	}
+	command, err := reader.ReadString(delimiter)
+	return strings.TrimSuffix(command, string(delimiter)), err
+}
+
+/*
+ * Reads the chunks of the stream, then replies according to the rules
+ */
+func (s *Server) handleStream(conn net.Conn, reader *bufio.Reader) {
+	s.mutex.Lock()
+	s.scans++
+	maxLength := s.streamMaxLength
+	s.mutex.Unlock()
+
+	var data bytes.Buffer
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length == 0 {
+			break
+		}
+		if maxLength > 0 && int64(data.Len())+int64(length) > maxLength {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\n")
+			return
+		}
+		if _, err := io.CopyN(&data, reader, int64(length)); err != nil {
+			return
+		}
+	}
+
+	rule := s.match(data.Bytes())
+	if rule.Latency > 0 {
+		select {
+		case <-time.After(rule.Latency):
+		case <-s.closed:
+			return
+		}
+	}
+	if !rule.Drop {
+		io.WriteString(conn, rule.Reply+"\n")
+	}
+}
+
+func (s *Server) match(data []byte) Rule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, rule := range s.rules {
+		if bytes.Contains(data, []byte(rule.Pattern)) {
+			return rule
+		}
+	}
+	if bytes.Contains(data, EICAR) {
+		return Found(string(EICAR), EICAR_SIGNATURE)
+	}
+	return Clean("")
+}
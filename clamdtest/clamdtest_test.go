@@ -0,0 +1,49 @@
+package clamdtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * Sends a raw command, and returns the reply
+ */
+func send(t *testing.T, s *Server, command string, chunks ...string) string {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(command))
+	require.NoError(t, err)
+	for _, chunk := range append(chunks, "") {
+		binary.Write(conn, binary.BigEndian, uint32(len(chunk)))
+		conn.Write([]byte(chunk))
+	}
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	return reply
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddRule(Found("virus", "Test.Virus"), Failure("vir", "Oops"))
+
+	assert.Equal(t, "PONG\n", send(t, s, "nPING\n"))
+	assert.Equal(t, "PONG\n", send(t, s, "zPING\x00"))
+	assert.Equal(t, VERSION+"\n", send(t, s, "nVERSION\n"))
+	assert.Equal(t, "UNKNOWN COMMAND\n", send(t, s, "nSHUTDOWN\n"))
+
+	assert.Equal(t, "stream: OK\n", send(t, s, "nINSTREAM\n", "hello"))
+	assert.Equal(t, "stream: Test.Virus FOUND\n", send(t, s, "zINSTREAM\x00", "a vir", "us"), "patterns can span chunks")
+	assert.Equal(t, "stream: Oops ERROR\n", send(t, s, "nINSTREAM\n", "a vir"))
+	assert.Equal(t, "stream: "+EICAR_SIGNATURE+" FOUND\n", send(t, s, "nINSTREAM\n", string(EICAR)))
+	assert.Equal(t, 4, s.Scans())
+
+	s.SetStreamMaxLength(4)
+	assert.Equal(t, "INSTREAM size limit exceeded. ERROR\n", send(t, s, "nINSTREAM\n", "hello"))
+}
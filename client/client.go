@@ -0,0 +1,425 @@
+/*
+ * A client for the clammit scan service: sends files to /clammit/scan and
+ * interprets the answer, e.g.
+ *
+ *	c, err := client.New("http://localhost:8438")
+ *	result, err := c.ScanFile(ctx, "/tmp/upload.pdf")
+ *	if err == nil && result.Status == client.RES_FOUND {
+ *		...
+ *	}
+ */
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Scan verdicts
+ */
+const (
+	RES_CLEAN   = "CLEAN"
+	RES_FOUND   = "FOUND"
+	RES_BLOCKED = "BLOCKED"
+)
+
+// Longest response body read, the scan and info answers are much shorter
+const maxResponseSize = 64 * 1024
+
+var errNotReplayable = errors.New("the request body cannot be sent again")
+
+// The outcomes of the JSON responses giving a verdict
+const (
+	outcomeClean  = "clean"
+	outcomeVirus  = "virus"
+	outcomePolicy = "policy"
+)
+
+/*
+ * The verdict of clammit on a scan request
+ */
+type Result struct {
+	// One of the RES_* constants
+	Status string
+	// The HTTP status code and message returned by clammit, e.g. 418 and
+	// "File eicar.com has a virus!"
+	StatusCode int
+	Message    string
+	// The outcome, e.g. "virus" (see the Responses section of the README),
+	// the file at fault and the virus found or the reason the file type is
+	// not allowed. They are empty if clammit's response templates do not
+	// render them as its built-in JSON responses do.
+	Outcome   string
+	FileName  string
+	Signature string
+	// The ID of the request in clammit's logs
+	RequestID string
+}
+
+/*
+ * Returned when clammit does not give a verdict: the request is refused
+ * (401, 403, 413, 429...) or failed (5xx) after all the retries
+ */
+type StatusError struct {
+	StatusCode int
+	Message    string
+	// The outcome, e.g. "too-large", and the ID of the request in clammit's
+	// logs, if clammit answered in JSON
+	Outcome   string
+	RequestID string
+}
+
+/*
+ * The JSON responses of clammit to scan requests
+ */
+type scanResponse struct {
+	Outcome   string `json:"outcome"`
+	Message   string `json:"message"`
+	File      string `json:"file"`
+	Signature string `json:"signature"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("clammit answered %d: %s", e.StatusCode, strings.TrimSpace(e.Message))
+}
+
+/*
+ * The clammit and clamd information, as returned by the /clammit endpoint
+ */
+type Info struct {
+	Version             string `json:"clammit_version"`
+	Address             string `json:"scan_server_url"`
+	PingResult          string `json:"ping_result"`
+	ScannerVersion      string `json:"scan_server_version"`
+	TestScanVirusResult string `json:"test_scan_virus"`
+	TestScanCleanResult string `json:"test_scan_clean"`
+}
+
+/*
+ * A file sent in a multipart request
+ */
+type Part struct {
+	// The form field name, "file" if empty
+	FieldName string
+	FileName  string
+	// "application/octet-stream" if empty
+	ContentType string
+	Reader      io.Reader
+}
+
+/*
+ * The client. Its fields must not be changed once it is in use.
+ */
+type Client struct {
+	// The clammit base URL, e.g. http://localhost:8438
+	URL *url.URL
+	// The HTTP client to use, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// The status codes clammit is configured to return on viruses and on
+	// files refused by the scan policy: 418 and 415 if zero. Only needed
+	// when clammit's response templates do not answer in JSON.
+	VirusStatusCode  int
+	PolicyStatusCode int
+	// Credentials, if the scan endpoint is protected: a bearer token, or a
+	// user name and password
+	Token    string
+	Username string
+	Password string
+	// Number of times 5xx answers are retried, and the wait before the first
+	// retry, doubled each time. Retry-After is honoured when longer. Bodies
+	// read from a reader which is not an io.Seeker are never retried.
+	MaxRetries int
+	RetryWait  time.Duration
+}
+
+/*
+ * Constructs a client for the given clammit base URL, retrying twice
+ */
+func New(baseURL string) (*Client, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid clammit URL: %s", baseURL)
+	}
+	return &Client{URL: parsed, MaxRetries: 2, RetryWait: 500 * time.Millisecond}, nil
+}
+
+/*
+ * Scans the content read from the reader. The file name, if any, is only
+ * used in clammit's messages and logs.
+ */
+func (c *Client) ScanReader(ctx context.Context, filename string, reader io.Reader) (*Result, error) {
+	open, replayable, err := rewinder(reader)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	return c.scan(ctx, header, open, replayable)
+}
+
+/*
+ * Scans the file at the given path
+ */
+func (c *Client) ScanFile(ctx context.Context, path string) (*Result, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return c.ScanReader(ctx, filepath.Base(path), file)
+}
+
+/*
+ * Scans several files at once, sent as a multipart/form-data request. The
+ * result is the verdict on the first infected or blocked file, if any.
+ */
+func (c *Client) ScanMultipart(ctx context.Context, parts ...Part) (*Result, error) {
+	opens := make([]func() (io.Reader, error), len(parts))
+	replayable := true
+	for i, part := range parts {
+		open, partReplayable, err := rewinder(part.Reader)
+		if err != nil {
+			return nil, err
+		}
+		opens[i] = open
+		replayable = replayable && partReplayable
+	}
+
+	header := http.Header{}
+	var pipeReader *io.PipeReader
+	var done chan struct{}
+	// Stops the previous attempt's writer, which may still be copying a
+	// part when the server answered early, before the parts are rewound
+	finish := func() {
+		if pipeReader != nil {
+			pipeReader.Close()
+			<-done
+		}
+	}
+	defer finish()
+	open := func() (io.Reader, error) {
+		finish()
+		// The body is streamed: the parts are not held in memory
+		var pipeWriter *io.PipeWriter
+		pipeReader, pipeWriter = io.Pipe()
+		done = make(chan struct{})
+		writer := multipart.NewWriter(pipeWriter)
+		header.Set("Content-Type", writer.FormDataContentType())
+		go func(done chan struct{}) {
+			defer close(done)
+			pipeWriter.CloseWithError(writeParts(writer, parts, opens))
+		}(done)
+		return pipeReader, nil
+	}
+	return c.scan(ctx, header, open, replayable)
+}
+
+func writeParts(writer *multipart.Writer, parts []Part, opens []func() (io.Reader, error)) error {
+	for i, part := range parts {
+		fieldName, contentType := part.FieldName, part.ContentType
+		if fieldName == "" {
+			fieldName = "file"
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		params := map[string]string{"name": fieldName}
+		if part.FileName != "" {
+			params["filename"] = part.FileName
+		}
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Disposition", mime.FormatMediaType("form-data", params))
+		partHeader.Set("Content-Type", contentType)
+		w, err := writer.CreatePart(partHeader)
+		if err != nil {
+			return err
+		}
+		reader, err := opens[i]()
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, reader); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+/*
+ * Returns the clammit and clamd information
+ */
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	resp, data, err := c.do(ctx, "GET", "/clammit", http.Header{}, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: string(data)}
+	}
+	info := &Info{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("Invalid info response: %w", err)
+	}
+	return info, nil
+}
+
+/*
+ * Sends the scan request, and interprets the answer: by its outcome if
+ * clammit answered in JSON, otherwise by its status code
+ */
+func (c *Client) scan(ctx context.Context, header http.Header, open func() (io.Reader, error), replayable bool) (*Result, error) {
+	header.Set("Accept", "application/json")
+	resp, data, err := c.do(ctx, "POST", "/clammit/scan", header, open, replayable)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{StatusCode: resp.StatusCode, Message: string(data)}
+	response := &scanResponse{}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "application/json" && json.Unmarshal(data, response) == nil && response.Outcome != "" {
+		result.Message = response.Message
+		result.Outcome = response.Outcome
+		result.FileName = response.File
+		result.Signature = response.Signature
+		result.RequestID = response.RequestID
+	}
+	switch {
+	case result.Outcome == outcomeClean || result.Outcome == "" && resp.StatusCode == http.StatusOK:
+		result.Status = RES_CLEAN
+	case result.Outcome == outcomeVirus || result.Outcome == "" && resp.StatusCode == c.virusStatusCode():
+		result.Status = RES_FOUND
+	case result.Outcome == outcomePolicy || result.Outcome == "" && resp.StatusCode == c.policyStatusCode():
+		result.Status = RES_BLOCKED
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: result.Message, Outcome: result.Outcome, RequestID: result.RequestID}
+	}
+	return result, nil
+}
+
+/*
+ * Sends the request, retrying on 5xx answers. Returns the last response,
+ * whose body has been read and closed, and its body.
+ */
+func (c *Client) do(ctx context.Context, method string, path string, header http.Header, open func() (io.Reader, error), replayable bool) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		if open != nil {
+			var err error
+			if body, err = open(); err != nil {
+				return nil, nil, err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.URL.JoinPath(path).String(), body)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else if c.Username != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode < 500 || attempt >= c.MaxRetries || !replayable {
+			return resp, data, nil
+		}
+
+		wait := c.RetryWait << attempt
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) virusStatusCode() int {
+	if c.VirusStatusCode != 0 {
+		return c.VirusStatusCode
+	}
+	return http.StatusTeapot
+}
+
+func (c *Client) policyStatusCode() int {
+	if c.PolicyStatusCode != 0 {
+		return c.PolicyStatusCode
+	}
+	return http.StatusUnsupportedMediaType
+}
+
+/*
+ * Returns a function giving the reader from its current position, once per
+ * attempt, and whether it can be called more than once: only if the reader
+ * is an io.Seeker
+ */
+func rewinder(reader io.Reader) (func() (io.Reader, error), bool, error) {
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		opened := false
+		return func() (io.Reader, error) {
+			if opened {
+				return nil, errNotReplayable
+			}
+			opened = true
+			return reader, nil
+		}, false, nil
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false, err
+	}
+	return func() (io.Reader, error) {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, ok := reader.(io.Closer); ok {
+			// The HTTP client closes request bodies, files must stay open
+			// for the retries
+			return struct{ io.Reader }{reader}, nil
+		}
+		return reader, nil
+	}, true, nil
+}
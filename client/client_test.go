@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL)
+	require.NoError(t, err)
+	c.RetryWait = time.Millisecond
+	return c
+}
+
+func TestScanReader(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/clammit/scan", req.URL.Path)
+		assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+		assert.Equal(t, "attachment; filename=eicar.com", req.Header.Get("Content-Disposition"))
+		body, _ := io.ReadAll(req.Body)
+		switch string(body) {
+		case "virus":
+			w.WriteHeader(451)
+			w.Write([]byte("File eicar.com has a virus!"))
+		case "script":
+			w.WriteHeader(415)
+			w.Write([]byte("File eicar.com is not allowed: type shell is blocked"))
+		case "huge":
+			http.Error(w, "Request Entity Too Large", 413)
+		default:
+			w.Write([]byte("No virus found"))
+		}
+	})
+	c.Token = "secret"
+	c.VirusStatusCode = 451
+
+	result, err := c.ScanReader(context.Background(), "eicar.com", strings.NewReader("clean"))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Status: RES_CLEAN, StatusCode: 200, Message: "No virus found"}, result)
+
+	result, err = c.ScanReader(context.Background(), "eicar.com", strings.NewReader("virus"))
+	require.NoError(t, err)
+	assert.Equal(t, RES_FOUND, result.Status)
+	assert.Equal(t, "File eicar.com has a virus!", result.Message)
+
+	result, err = c.ScanReader(context.Background(), "eicar.com", strings.NewReader("script"))
+	require.NoError(t, err)
+	assert.Equal(t, RES_BLOCKED, result.Status)
+
+	_, err = c.ScanReader(context.Background(), "eicar.com", strings.NewReader("huge"))
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 413, statusErr.StatusCode)
+}
+
+func TestScanReader_JSON(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Accept"))
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		switch string(body) {
+		case "virus":
+			// Not the status code the client expects: the outcome wins
+			w.WriteHeader(403)
+			w.Write([]byte(`{"outcome":"virus","status":403,"message":"File eicar.com has a virus!","file":"eicar.com","signature":"Eicar-Signature","request_id":"abc"}`))
+		case "busy":
+			w.WriteHeader(429)
+			w.Write([]byte(`{"outcome":"rate-limited","status":429,"message":"Too Many Requests","request_id":"def","retry_after":1}`))
+		default:
+			w.Write([]byte(`{"outcome":"clean","status":200,"message":"No virus found","request_id":"ghi"}`))
+		}
+	})
+
+	result, err := c.ScanReader(context.Background(), "eicar.com", strings.NewReader("virus"))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{
+		Status:     RES_FOUND,
+		StatusCode: 403,
+		Message:    "File eicar.com has a virus!",
+		Outcome:    "virus",
+		FileName:   "eicar.com",
+		Signature:  "Eicar-Signature",
+		RequestID:  "abc",
+	}, result)
+
+	result, err = c.ScanReader(context.Background(), "", strings.NewReader("clean"))
+	require.NoError(t, err)
+	assert.Equal(t, RES_CLEAN, result.Status)
+	assert.Equal(t, "ghi", result.RequestID)
+
+	_, err = c.ScanReader(context.Background(), "", strings.NewReader("busy"))
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, &StatusError{StatusCode: 429, Message: "Too Many Requests", Outcome: "rate-limited", RequestID: "def"}, statusErr)
+}
+
+func TestScanFile_Retries(t *testing.T) {
+	var attempts int32
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		assert.Equal(t, "file contents", string(body), "the whole file is sent on each attempt")
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		w.Write([]byte("No virus found"))
+	})
+	path := filepath.Join(t.TempDir(), "upload.txt")
+	require.NoError(t, os.WriteFile(path, []byte("file contents"), 0600))
+
+	result, err := c.ScanFile(context.Background(), path)
+	require.NoError(t, err)
+	assert.Equal(t, RES_CLEAN, result.Status)
+	assert.Equal(t, int32(3), attempts)
+
+	// Out of retries
+	atomic.StoreInt32(&attempts, -10)
+	_, err = c.ScanFile(context.Background(), path)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 500, statusErr.StatusCode)
+	assert.Equal(t, int32(-7), attempts)
+}
+
+func TestScanReader_NotReplayable(t *testing.T) {
+	var attempts int32
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "Service Unavailable", 503)
+	})
+	_, err := c.ScanReader(context.Background(), "", io.MultiReader(strings.NewReader("data")))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), attempts)
+}
+
+func TestScan_Context(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Service Unavailable", 503)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.ScanReader(ctx, "", strings.NewReader("data"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestScanMultipart(t *testing.T) {
+	var attempts int32
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseMultipartForm(1024))
+		assert.Equal(t, "invoice.pdf", req.MultipartForm.File["file"][0].Filename)
+		assert.Equal(t, "application/pdf", req.MultipartForm.File["file"][0].Header.Get("Content-Type"))
+		assert.Equal(t, "photo.jpg", req.MultipartForm.File["photo"][0].Filename)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			http.Error(w, "Bad Gateway", 502)
+			return
+		}
+		w.Write([]byte("No virus found"))
+	})
+	result, err := c.ScanMultipart(context.Background(),
+		Part{FileName: "invoice.pdf", ContentType: "application/pdf", Reader: strings.NewReader("%PDF-1.4")},
+		Part{FieldName: "photo", FileName: "photo.jpg", Reader: strings.NewReader("\xff\xd8\xff")},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, RES_CLEAN, result.Status)
+	assert.Equal(t, int32(2), attempts)
+}
+
+func TestScanMultipart_EarlyAnswer(t *testing.T) {
+	// Larger than the socket buffers, so the writer is still copying a part
+	// when the server answers
+	contents := strings.Repeat("x", 16<<20)
+	var attempts int32
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			// Answers without reading the body, leaving the upload in flight
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			buf.WriteString("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+			buf.Flush()
+			return
+		}
+		require.NoError(t, req.ParseMultipartForm(1024))
+		file, err := req.MultipartForm.File["file"][0].Open()
+		require.NoError(t, err)
+		defer file.Close()
+		data, _ := io.ReadAll(file)
+		assert.Equal(t, len(contents), len(data), "the whole part is sent again once rewound")
+		w.Write([]byte("No virus found"))
+	})
+	c.RetryWait = 0
+	result, err := c.ScanMultipart(context.Background(),
+		Part{FileName: "large.bin", Reader: strings.NewReader(contents)},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, RES_CLEAN, result.Status)
+	assert.Equal(t, int32(3), attempts)
+}
+
+func TestInfo(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/clammit", req.URL.Path)
+		user, password, _ := req.BasicAuth()
+		assert.Equal(t, "ops:pass", user+":"+password)
+		w.Write([]byte(`{"clammit_version":"1.2.3","scan_server_url":"tcp://clamd:3310","ping_result":"Connected to server OK"}`))
+	})
+	c.Username, c.Password = "ops", "pass"
+	info, err := c.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &Info{Version: "1.2.3", Address: "tcp://clamd:3310", PingResult: "Connected to server OK"}, info)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("localhost:8438")
+	assert.Error(t, err)
+	c, err := New("https://clammit.internal/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://clammit.internal/clammit/scan", c.URL.JoinPath("/clammit/scan").String())
+}
@@ -0,0 +1,160 @@
+/*
+ * Verification of the scan verdict clammit adds to the requests it forwards
+ * when verdict-hmac-key is set, e.g. in the application's upload handler:
+ *
+ *	verdict, err := client.VerifyVerdict(req, key, time.Minute)
+ *	if err != nil || verdict.Result != client.RES_CLEAN {
+ *		...
+ *	}
+ */
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The verdict headers
+ */
+const (
+	// RES_CLEAN, RES_FOUND, RES_BLOCKED, RES_TOO_LARGE, RES_ERROR or
+	// RES_SKIPPED
+	ResultHeader = "X-Clammit-Result"
+	// The name of each virus found, in monitor mode
+	SignatureHeader = "X-Clammit-Signature"
+	// The scanner and signature database versions
+	ScannerHeader = "X-Clammit-Scanner"
+	// The SHA-256 of each file scanned: sha256=<hex>; name="<path>"
+	PartHashHeader = "X-Clammit-Part-Hash"
+	// When the request was scanned, in seconds since the epoch
+	TimestampHeader = "X-Clammit-Timestamp"
+	// The HMAC-SHA256 of the request method, URI and the headers above:
+	// sha256=<hex>
+	HMACHeader = "X-Clammit-HMAC"
+)
+
+// The verdict of the requests clammit forwarded without scanning them, e.g.
+// skipped by the scan policy
+const RES_SKIPPED = "SKIPPED"
+
+// The verdicts of the requests forwarded in monitor mode although they were
+// not scanned in full: over a size limit, or a file could not be scanned
+const (
+	RES_TOO_LARGE = "TOO_LARGE"
+	RES_ERROR     = "ERROR"
+)
+
+// The signed headers, in the order they are signed
+var verdictHeaders = []string{ResultHeader, SignatureHeader, ScannerHeader, PartHashHeader, TimestampHeader}
+
+var (
+	ErrNoVerdict      = errors.New("the request has no scan verdict")
+	ErrBadVerdict     = errors.New("the scan verdict signature does not match")
+	ErrExpiredVerdict = errors.New("the scan verdict is too old")
+)
+
+/*
+ * The scan verdict of a forwarded request
+ */
+type Verdict struct {
+	// One of the RES_* constants
+	Result string
+	// The viruses found, in monitor mode
+	Signatures []string
+	// The scanner and signature database versions, e.g.
+	// "ClamAV 1.0.1/26789/Mon Feb 13 08:20:07 2023"
+	Scanner string
+	Parts   []PartHash
+	Time    time.Time
+}
+
+/*
+ * The hash of a file scanned, as it was scanned: decoded, e.g. from base64
+ */
+type PartHash struct {
+	// The path of the file in the request, e.g. "mail.eml/invoice.pdf"
+	Name   string
+	SHA256 string
+}
+
+/*
+ * Formats the value of a part hash header
+ */
+func (p PartHash) String() string {
+	return fmt.Sprintf("sha256=%s; name=%s", p.SHA256, strconv.QuoteToASCII(p.Name))
+}
+
+/*
+ * Returns the HMAC header value signing the verdict headers of a request
+ */
+func SignVerdict(key []byte, method string, requestURI string, header http.Header) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n", method, requestURI)
+	for _, name := range verdictHeaders {
+		for _, value := range header.Values(name) {
+			fmt.Fprintf(mac, "%s: %s\n", name, value)
+		}
+	}
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Checks the signature of the verdict of a request received from clammit,
+ * and returns it. Verdicts older than maxAge are refused, unless it is zero.
+ *
+ * The request URI is the one clammit received: applications behind a path
+ * prefix (e.g. application-url = http://app/prefix) see another one.
+ */
+func VerifyVerdict(req *http.Request, key []byte, maxAge time.Duration) (*Verdict, error) {
+	signature := req.Header.Get(HMACHeader)
+	if signature == "" {
+		return nil, ErrNoVerdict
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignVerdict(key, req.Method, req.URL.RequestURI(), req.Header))) {
+		return nil, ErrBadVerdict
+	}
+	seconds, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid scan verdict timestamp: %w", err)
+	}
+	verdict := &Verdict{
+		Result:     req.Header.Get(ResultHeader),
+		Signatures: req.Header.Values(SignatureHeader),
+		Scanner:    req.Header.Get(ScannerHeader),
+		Time:       time.Unix(seconds, 0),
+	}
+	if age := time.Since(verdict.Time); maxAge > 0 && (age > maxAge || age < -maxAge) {
+		return nil, ErrExpiredVerdict
+	}
+	for _, value := range req.Header.Values(PartHashHeader) {
+		part, err := parsePartHash(value)
+		if err != nil {
+			return nil, err
+		}
+		verdict.Parts = append(verdict.Parts, part)
+	}
+	return verdict, nil
+}
+
+/*
+ * Parses the value of a part hash header
+ */
+func parsePartHash(value string) (PartHash, error) {
+	hash, name, found := strings.Cut(value, "; name=")
+	if !found || !strings.HasPrefix(hash, "sha256=") {
+		return PartHash{}, fmt.Errorf("Invalid part hash: %s", value)
+	}
+	unquoted, err := strconv.Unquote(name)
+	if err != nil {
+		return PartHash{}, fmt.Errorf("Invalid part hash: %s", value)
+	}
+	return PartHash{Name: unquoted, SHA256: strings.TrimPrefix(hash, "sha256=")}, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedRequest(key []byte, timestamp time.Time) *http.Request {
+	req := httptest.NewRequest("POST", "/upload?id=1", nil)
+	req.Header.Set(ResultHeader, RES_CLEAN)
+	req.Header.Set(ScannerHeader, "ClamAV 1.0.0/27000")
+	req.Header.Add(PartHashHeader, PartHash{Name: `a "quoted" naïve name`, SHA256: "abcd"}.String())
+	req.Header.Add(PartHashHeader, PartHash{Name: "b.pdf", SHA256: "ef01"}.String())
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	req.Header.Set(HMACHeader, SignVerdict(key, req.Method, req.URL.RequestURI(), req.Header))
+	return req
+}
+
+func TestVerifyVerdict(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	now := time.Now()
+
+	verdict, err := VerifyVerdict(signedRequest(key, now), key, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, &Verdict{
+		Result:  RES_CLEAN,
+		Scanner: "ClamAV 1.0.0/27000",
+		Parts:   []PartHash{{Name: `a "quoted" naïve name`, SHA256: "abcd"}, {Name: "b.pdf", SHA256: "ef01"}},
+		Time:    time.Unix(now.Unix(), 0),
+	}, verdict)
+
+	_, err = VerifyVerdict(signedRequest(key, now), []byte("another key of 16"), time.Minute)
+	assert.Equal(t, ErrBadVerdict, err)
+
+	for _, tamper := range []func(req *http.Request){
+		func(req *http.Request) { req.Header.Set(ResultHeader, RES_SKIPPED) },
+		func(req *http.Request) { req.Header.Add(SignatureHeader, "Eicar-Test-Signature") },
+		func(req *http.Request) { req.Header.Del(PartHashHeader) },
+		func(req *http.Request) { req.Method = "PUT" },
+		func(req *http.Request) { req.URL.RawQuery = "id=2" },
+	} {
+		req := signedRequest(key, now)
+		tamper(req)
+		_, err = VerifyVerdict(req, key, time.Minute)
+		assert.Equal(t, ErrBadVerdict, err)
+	}
+
+	req := signedRequest(key, now)
+	req.Header.Del(HMACHeader)
+	_, err = VerifyVerdict(req, key, time.Minute)
+	assert.Equal(t, ErrNoVerdict, err)
+
+	_, err = VerifyVerdict(signedRequest(key, now.Add(-2*time.Minute)), key, time.Minute)
+	assert.Equal(t, ErrExpiredVerdict, err)
+	_, err = VerifyVerdict(signedRequest(key, now.Add(-2*time.Minute)), key, 0)
+	assert.NoError(t, err)
+}
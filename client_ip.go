@@ -0,0 +1,92 @@
+/*
+ * Resolution of the client address of requests coming through reverse
+ * proxies.
+ */
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+ * The networks of the proxies whose X-Forwarded-For header is trusted
+ */
+type TrustedProxies []*net.IPNet
+
+/*
+ * Parses a list of IP addresses and CIDR networks
+ */
+func ParseTrustedProxies(values []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy: %s", value)
+			} else if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %s", value)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+/*
+ * Returns true if the address is a trusted proxy
+ */
+func (proxies TrustedProxies) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the address of the client that sent the request. If the peer is
+ * a trusted proxy, X-Forwarded-For is walked from the right, skipping the
+ * trusted proxies, to find the first untrusted address. Peers connected
+ * over a unix socket are always considered trusted proxies.
+ */
+func (proxies TrustedProxies) ClientIP(req *http.Request) string {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	local := net.ParseIP(peer) == nil
+	if !local && !proxies.Contains(peer) {
+		return peer
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(header, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				forwarded = append(forwarded, address)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if !proxies.Contains(forwarded[i]) {
+			return forwarded[i]
+		}
+	}
+	if len(forwarded) > 0 {
+		return forwarded[0]
+	}
+	return peer
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"clammit/clamdtest"
+	"clammit/client"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * Runs the client against clammit's scan endpoints
+ */
+func TestClient(t *testing.T) {
+	setupReload(t, `
+[application]
+virus-status-code = 451
+scan-token        = secret
+admin-token       = admin-secret
+
+[policy "default"]
+block-type = executable
+`)
+	ctx.ActivityChan = make(chan int)
+	go func() {
+		for range ctx.ActivityChan {
+		}
+	}()
+	rt := ctx.Runtime()
+	rt.Scanner = newTestClamav(t)
+	rt.ScanInterceptor.Scanner = rt.Scanner
+	router, _ := buildRouters()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	c, err := client.New(server.URL)
+	require.NoError(t, err)
+	c.Token = "secret"
+
+	result, err := c.ScanReader(context.Background(), "hello.txt", strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, client.RES_CLEAN, result.Status)
+
+	result, err = c.ScanReader(context.Background(), "eicar.txt", strings.NewReader("X5O!P%@AP EICAR"))
+	require.NoError(t, err)
+	assert.Equal(t, client.RES_FOUND, result.Status)
+	assert.Equal(t, 451, result.StatusCode)
+	assert.Equal(t, "File eicar.txt has a virus!", result.Message)
+	assert.Equal(t, "eicar.txt", result.FileName)
+	assert.Equal(t, "Test.Virus", result.Signature)
+	assert.NotEmpty(t, result.RequestID)
+
+	result, err = c.ScanMultipart(context.Background(),
+		client.Part{FileName: "notes.txt", Reader: strings.NewReader("hello")},
+		client.Part{FileName: "setup.exe", Reader: strings.NewReader("MZ\x90\x00")},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, client.RES_BLOCKED, result.Status)
+	assert.Equal(t, "File setup.exe is not allowed: type exe is blocked", result.Message)
+	assert.Equal(t, "policy", result.Outcome)
+	assert.Equal(t, "setup.exe", result.FileName)
+	assert.Equal(t, "type exe is blocked", result.Signature)
+
+	var statusErr *client.StatusError
+	_, err = c.Info(context.Background())
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 403, statusErr.StatusCode, "the info page needs admin credentials")
+
+	c.Token = "admin-secret"
+	info, err := c.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, clamdtest.VERSION, info.ScannerVersion)
+
+	c.Token = "wrong"
+	_, err = c.ScanReader(context.Background(), "", strings.NewReader("hello"))
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, 401, statusErr.StatusCode)
+}
@@ -0,0 +1,375 @@
+/*
+ * The config subcommand:
+ *
+ *	clammit config check -config=clammit.cfg [-connect]
+ *	clammit config dump -config=clammit.cfg
+ *
+ * check validates the whole configuration and reports all the errors at
+ * once, dump prints the effective configuration: defaults, merged with the
+ * configuration file and environment variables.
+ */
+package main
+
+import (
+	"clammit/forwarder"
+	"clammit/scanner"
+	"clammit/tlsconfig"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/warnings.v0"
+)
+
+// Settings whose values are not printed by config dump
+var secretSettings = map[string]bool{
+	"scan-token":       true,
+	"admin-token":      true,
+	"verdict-hmac-key": true,
+}
+
+const configUsage = `Usage:
+  clammit config check -config=<file> [-connect] [-timeout=5s]
+  clammit config dump -config=<file>
+`
+
+/*
+ * Runs the config subcommand, and returns the exit status: 0 if the
+ * configuration is valid, 1 if it is not, 2 on usage errors
+ */
+func configCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, configUsage)
+		return 2
+	}
+	flags := flag.NewFlagSet("config "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	filename := flags.String("config", "", "Configuration file")
+	connect := flags.Bool("connect", false, "Test the connection to clamd and the backends")
+	timeout := flags.Duration("timeout", 5*time.Second, "Connection test timeout")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	ctx = &Ctx{Logger: log.New(stderr, "", log.LstdFlags)}
+	switch args[0] {
+	case "check":
+		errs := checkConfig(*filename, *connect, *timeout, stdout)
+		if len(errs) > 0 {
+			fmt.Fprintf(stdout, "%d error(s) found:\n", len(errs))
+			for _, err := range errs {
+				fmt.Fprintf(stdout, "  %s\n", err.Error())
+			}
+			return 1
+		}
+		fmt.Fprintln(stdout, "Configuration OK")
+		return 0
+	case "dump":
+		config, err := readConfig(*filename)
+		if config == nil {
+			fmt.Fprintln(stderr, "Configuration read failure:", err.Error())
+			return 1
+		} else if err != nil {
+			fmt.Fprintln(stderr, "Warning:", err.Error())
+		}
+		dumpConfig(config, stdout)
+		return 0
+	}
+	fmt.Fprint(stderr, configUsage)
+	return 2
+}
+
+/*
+ * Reads and validates the configuration, optionally testing the connection
+ * to clamd and the backends. Returns all the errors found.
+ */
+func checkConfig(filename string, connect bool, timeout time.Duration, w io.Writer) []error {
+	config, err := readConfig(filename)
+	if err != nil {
+		var list warnings.List
+		if !errors.As(err, &list) {
+			return []error{err}
+		}
+		// Unknown sections and settings are warnings for gcfg: report them
+		// along with the validation errors
+		errs := append([]error(nil), list.Warnings...)
+		if list.Fatal != nil {
+			return append(errs, list.Fatal)
+		}
+		return append(errs, validateConfig(config)...)
+	}
+	errs := validateConfig(config)
+	if connect && len(errs) == 0 {
+		errs = append(errs, checkConnections(config, timeout, w)...)
+	}
+	return errs
+}
+
+/*
+ * Validates every setting, returning all the errors found
+ */
+func validateConfig(config *Config) []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	app := &config.App
+
+	if app.Listen == "" {
+		add(errors.New("listen is not set"))
+	}
+	if app.AdminListen != "" && app.AdminListen == app.Listen {
+		add(errors.New("admin-listen must be different from listen"))
+	}
+	if _, err := strconv.ParseUint(app.SocketPerms, 8, 32); app.SocketPerms != "" && err != nil {
+		add(fmt.Errorf("Invalid unix-socket-perms (expected octal): %s", app.SocketPerms))
+	}
+	if app.TLSCertFile != "" || app.TLSKeyFile != "" || app.TLSClientCAFile != "" {
+		_, err := tlsconfig.NewServerConfig(&tlsconfig.ServerOptions{
+			CertFile:     app.TLSCertFile,
+			KeyFile:      app.TLSKeyFile,
+			ClientCAFile: app.TLSClientCAFile,
+			ClientAuth:   app.TLSClientAuth,
+			MinVersion:   app.TLSMinVersion,
+		}, ctx.Logger)
+		if err != nil {
+			add(fmt.Errorf("Invalid listener TLS settings: %s", err.Error()))
+		}
+	}
+	add(validateURL("application-url", app.ApplicationURL, false, "http", "https", "unix"))
+	add(validateURL("clamd-url", app.ClamdURL, true, "tcp", "unix"))
+	add(validateStatusCode("virus-status-code", app.VirusStatusCode))
+	add(validateStatusCode("policy-status-code", app.PolicyStatusCode))
+	for setting, value := range map[string]int64{
+		"content-memory-threshold": app.ContentMemoryThreshold,
+		"max-body-size":            app.MaxBodySize,
+		"max-part-size":            app.MaxPartSize,
+		"max-parts":                int64(app.MaxParts),
+		"max-extract-size":         app.MaxExtractSize,
+		"max-decoded-size":         app.MaxDecodedSize,
+		"max-decode-ratio":         int64(app.MaxDecodeRatio),
+		"scan-parallelism":         int64(app.ScanParallelism),
+		"max-concurrent-scans":     int64(app.MaxConcurrentScans),
+		"max-memory-bytes":         app.MaxMemoryBytes,
+		"max-spool-bytes":          app.MaxSpoolBytes,
+		"admission-queue-size":     int64(app.AdmissionQueueSize),
+		"retry-after":              int64(app.RetryAfter),
+	} {
+		if value < 0 {
+			add(fmt.Errorf("%s cannot be negative: %d", setting, value))
+		}
+	}
+	if app.NumThreads < 1 {
+		add(fmt.Errorf("num-threads must be at least 1: %d", app.NumThreads))
+	}
+	_, err := buildAdmission(app)
+	add(err)
+	_, err = buildRateLimiter(app, nil, nil)
+	add(err)
+	_, err = buildAuthenticator(app)
+	add(err)
+	_, err = buildVerdictSigner(app, nil)
+	add(err)
+	_, err = LoadResponses(app.ResponseTemplates, app.SupportContact)
+	add(err)
+
+	// Backends, routes and policies are built one at a time, so that all
+	// their errors are reported. Invalid backends are stood in for, so that
+	// the routes using them do not report them as unknown.
+	var backends []*forwarder.Backend
+	for _, name := range sortedKeys(config.Backends) {
+		built, err := buildBackends(map[string]*BackendConfig{name: config.Backends[name]})
+		if err != nil {
+			add(err)
+			built = []*forwarder.Backend{forwarder.NewBackend(name, &url.URL{}, nil)}
+		}
+		backends = append(backends, built...)
+	}
+	for _, name := range sortedKeys(config.Routes) {
+		_, err := buildRoutes(map[string]*RouteConfig{name: config.Routes[name]}, backends)
+		add(err)
+		if policy := config.Routes[name].Policy; policy != "" && config.Policies[policy] == nil {
+			add(fmt.Errorf("Route %s: unknown policy %s", name, policy))
+		}
+	}
+	for _, name := range sortedKeys(config.Policies) {
+		add(buildPolicies(&ScanInterceptor{}, map[string]*PolicyConfig{name: config.Policies[name]}, nil))
+	}
+	for _, name := range sortedKeys(config.Outcomes) {
+		_, err := buildOutcomes(map[string]*OutcomeConfig{name: config.Outcomes[name]})
+		add(err)
+	}
+	return errs
+}
+
+/*
+ * Checks the URL is absolute, with one of the given schemes
+ */
+func validateURL(setting string, value string, required bool, schemes ...string) error {
+	if value == "" {
+		if required {
+			return fmt.Errorf("%s is not set", setting)
+		}
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %s", setting, value)
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			if parsed.Host == "" && !(scheme == "unix" && parsed.Path+parsed.Opaque != "") {
+				return fmt.Errorf("Invalid %s (no host): %s", setting, value)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid %s (scheme must be one of %s): %s", setting, strings.Join(schemes, ", "), value)
+}
+
+func validateStatusCode(setting string, code int) error {
+	if code < 100 || code > 599 {
+		return fmt.Errorf("Invalid %s: %d", setting, code)
+	}
+	return nil
+}
+
+/*
+ * Tests the connection to clamd, the application URL and the backends,
+ * printing the outcome of each
+ */
+func checkConnections(config *Config, timeout time.Duration, w io.Writer) []error {
+	var errs []error
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Fprintf(w, "%s: %s\n", name, err.Error())
+			errs = append(errs, fmt.Errorf("Cannot connect to %s: %s", name, err.Error()))
+		} else {
+			fmt.Fprintf(w, "%s: OK\n", name)
+		}
+	}
+
+	clamav := new(scanner.Clamav)
+	clamav.SetLogger(ctx.Logger, false)
+	clamav.SetAddress(config.App.ClamdURL)
+	report("clamd "+config.App.ClamdURL, withTimeout(timeout, clamav.Ping))
+
+	backends, _ := buildBackends(config.Backends)
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+	if config.App.ApplicationURL != "" {
+		applicationURL, _ := url.Parse(config.App.ApplicationURL)
+		matched := false
+		for _, backend := range backends {
+			matched = matched || backend.Matches(applicationURL)
+		}
+		if !matched {
+			backends = append([]*forwarder.Backend{forwarder.NewBackend("application-url", applicationURL, nil)}, backends...)
+		}
+	}
+	for _, backend := range backends {
+		checkCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		report("backend "+backend.Name+" "+backend.URL.String(), backend.Check(checkCtx))
+		cancel()
+	}
+	return errs
+}
+
+/*
+ * Runs the check, giving up after the timeout
+ */
+func withTimeout(timeout time.Duration, check func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+/*
+ * Prints the configuration in the configuration file format. Settings with
+ * empty values are left out, and secrets are masked.
+ */
+func dumpConfig(config *Config, w io.Writer) {
+	configValue := reflect.ValueOf(config).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		section := configValue.Type().Field(i).Tag.Get("gcfg")
+		field := configValue.Field(i)
+		if field.Kind() == reflect.Struct {
+			fmt.Fprintf(w, "[%s]\n", section)
+			dumpSection(field, w)
+			continue
+		}
+		keys := field.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			fmt.Fprintf(w, "\n[%s %s]\n", section, quoteConfigValue(key.String(), true))
+			dumpSection(field.MapIndex(key).Elem(), w)
+		}
+	}
+}
+
+func dumpSection(section reflect.Value, w io.Writer) {
+	for i := 0; i < section.NumField(); i++ {
+		name := section.Type().Field(i).Tag.Get("gcfg")
+		value := section.Field(i)
+		var values []string
+		switch value.Kind() {
+		case reflect.Slice:
+			for j := 0; j < value.Len(); j++ {
+				values = append(values, value.Index(j).String())
+			}
+		case reflect.String:
+			if value.String() != "" {
+				values = []string{value.String()}
+			}
+		case reflect.Float64:
+			values = []string{strconv.FormatFloat(value.Float(), 'f', -1, 64)}
+		default:
+			values = []string{fmt.Sprint(value.Interface())}
+		}
+		for _, v := range values {
+			if secretSettings[name] {
+				v = "********"
+			}
+			fmt.Fprintf(w, "%s = %s\n", name, quoteConfigValue(v, false))
+		}
+	}
+}
+
+/*
+ * Quotes a value if gcfg would not read it back as is. Subsection names are
+ * always quoted.
+ */
+func quoteConfigValue(value string, always bool) string {
+	if !always && !strings.ContainsAny(value, "\";#\\\n\t") && strings.TrimSpace(value) == value {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\t", `\t`)
+	return `"` + value + `"`
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
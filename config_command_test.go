@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "clammit.cfg")
+	require.NoError(t, os.WriteFile(filename, []byte(contents), 0600))
+	return filename
+}
+
+func runConfigCommand(args ...string) (int, string, string) {
+	var stdout, stderr strings.Builder
+	status := configCommand(args, &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestConfigCheck(t *testing.T) {
+	filename := writeConfigFile(t, `
+[application]
+application-url   = http://localhost:9000/
+clamd-url         = unix:/run/clamav/clamd.ctl
+virus-status-code = 418
+`)
+	status, stdout, _ := runConfigCommand("check", "-config="+filename)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "Configuration OK\n", stdout)
+}
+
+func TestConfigCheck_AllErrors(t *testing.T) {
+	filename := writeConfigFile(t, `
+[application]
+application-url   = ftp://localhost/
+clamd-url         = tcp://clamd:3310
+virus-status-code = 1000
+max-body-size     = -1
+verdict-hmac-key  = short
+admission-timeout = 10 apples
+no-such-setting   = 1
+
+[backend "documents"]
+url = documents:8080
+
+[route "uploads"]
+backend = documents
+policy  = strict
+
+[policy "images"]
+allow-type = image/nonsense
+
+[policy "json"]
+json-field = files[*].content
+
+[outcome "infected"]
+status-code = 403
+
+[outcome "virus"]
+status-code = 99
+`)
+	status, stdout, _ := runConfigCommand("check", "-config="+filename)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stdout, "12 error(s) found:")
+	assert.Contains(t, stdout, "no-such-setting")
+	assert.Contains(t, stdout, "Invalid application-url")
+	assert.Contains(t, stdout, "Invalid virus-status-code: 1000")
+	assert.Contains(t, stdout, "max-body-size cannot be negative")
+	assert.Contains(t, stdout, "verdict-hmac-key must be at least 16 characters long")
+	assert.Contains(t, stdout, "Invalid admission-timeout: 10 apples", "checked even without admission limits")
+	assert.Contains(t, stdout, "Backend documents")
+	assert.Contains(t, stdout, "Route uploads: unknown policy strict")
+	assert.Contains(t, stdout, "Policy images: unknown file type")
+	assert.Contains(t, stdout, "Policy json: invalid JSON path files[*].content: must start with $")
+	assert.Contains(t, stdout, "Unknown outcome infected")
+	assert.Contains(t, stdout, "Outcome virus: Invalid status-code: 99")
+	assert.NotContains(t, stdout, "unknown backend", "invalid backends are only reported once")
+
+	status, stdout, _ = runConfigCommand("check", "-config="+filename+".missing")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stdout, "1 error(s) found:")
+}
+
+func TestConfigCheck_Connect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	// Nothing listens on a closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	filename := writeConfigFile(t, `
+[application]
+application-url = `+backend.URL+`
+clamd-url       = tcp://`+closed.Addr().String()+`
+
+[backend "documents"]
+url = `+backend.URL+`
+`)
+	status, stdout, _ := runConfigCommand("check", "-config="+filename, "-connect", "-timeout=2s")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stdout, "backend documents "+backend.URL+": OK")
+	assert.NotContains(t, stdout, "backend application-url", "the application URL is the documents backend")
+	assert.Contains(t, stdout, "1 error(s) found:")
+	assert.Contains(t, stdout, "Cannot connect to clamd tcp://"+closed.Addr().String())
+}
+
+func TestConfigDump(t *testing.T) {
+	filename := writeConfigFile(t, `
+[application]
+application-url     = http://localhost:9000/
+rate-limit-requests = 2.5
+scan-token          = secret1, secret2
+verdict-hmac-key    = secret-verdict-key
+
+[backend "documents"]
+url = http://documents:8080/
+
+[route "uploads"]
+path-prefix = /documents
+backend     = documents
+
+[policy "strict"]
+scan-method = POST
+scan-method = PUT
+
+[outcome "upstream-error"]
+status-code = 503
+header      = Retry-After: 30
+`)
+	t.Setenv("CLAMMIT_VIRUS_STATUS_CODE", "451")
+
+	status, stdout, _ := runConfigCommand("dump", "-config="+filename)
+	require.Equal(t, 0, status)
+	assert.Contains(t, stdout, "virus-status-code = 451\n", "environment variables are applied")
+	assert.Contains(t, stdout, "listen = :8438\n", "defaults are shown")
+	assert.Contains(t, stdout, "rate-limit-requests = 2.5\n")
+	assert.Contains(t, stdout, "[backend \"documents\"]\nurl = http://documents:8080/\n")
+	assert.Contains(t, stdout, "[outcome \"upstream-error\"]\n")
+	assert.NotContains(t, stdout, "secret")
+
+	// The dump reads back as the same configuration, secrets aside
+	config, err := readConfig(writeConfigFile(t, stdout))
+	require.NoError(t, err)
+	original, err := readConfig(filename)
+	require.NoError(t, err)
+	config.App.ScanTokens = original.App.ScanTokens
+	config.App.VerdictHMACKey = original.App.VerdictHMACKey
+	assert.Equal(t, original, config)
+}
+
+func TestConfigCommand_Usage(t *testing.T) {
+	status, _, stderr := runConfigCommand()
+	assert.Equal(t, 2, status)
+	assert.Contains(t, stderr, "Usage:")
+
+	status, _, _ = runConfigCommand("lint")
+	assert.Equal(t, 2, status)
+}
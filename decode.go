@@ -0,0 +1,184 @@
+/*
+ * Decoders for the encodings clients apply to request bodies and parts:
+ * clamd must see the files themselves, not their compressed or base64 form.
+ * Only what is scanned is decoded, the application still receives the
+ * original bytes.
+ */
+package main
+
+import (
+	"bufio"
+	"clammit/forwarder"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// The decoded size below which the ratio limit is not checked: small bodies
+// compress very well too
+const minDecodedSizeForRatio = 1024 * 1024
+
+/*
+ * The error returned for encodings we cannot decode
+ */
+type EncodingError struct {
+	Encoding string
+}
+
+func (e *EncodingError) Error() string {
+	return fmt.Sprintf("unsupported encoding: %s", e.Encoding)
+}
+
+/*
+ * Returns a reader decoding the body according to its Content-Encoding
+ * header, e.g. "gzip" or "deflate, br". Encodings are listed in the order
+ * they were applied, so they are undone in reverse.
+ */
+func decodeContentEncoding(header string, body io.Reader) (io.Reader, error) {
+	encodings := splitList([]string{header})
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encoding := strings.ToLower(encodings[i]); encoding {
+		case "identity":
+		case "gzip", "x-gzip":
+			body = &lazyReader{open: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }, reader: body}
+		case "deflate":
+			body = &lazyReader{open: newDeflateReader, reader: body}
+		case "br":
+			body = brotli.NewReader(body)
+		default:
+			return nil, &EncodingError{Encoding: encoding}
+		}
+	}
+	return body, nil
+}
+
+/*
+ * Returns a reader decoding a multipart part or a message body according to
+ * its Content-Transfer-Encoding header. Unknown encodings are scanned as they
+ * are. (The multipart reader decodes quoted-printable parts already, and
+ * removes the header.)
+ */
+func decodeTransferEncoding(header string, part io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(header)) {
+	case "base64":
+		// The decoder skips line breaks, but not other white space
+		return base64.NewDecoder(base64.StdEncoding, &spaceSkippingReader{reader: part}), nil
+	case "quoted-printable":
+		return quotedprintable.NewReader(part), nil
+	}
+	return part, nil
+}
+
+/*
+ * "deflate" is meant to be zlib-wrapped, but some clients send raw deflate
+ * data: tell them apart from the zlib header
+ */
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	head, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+/*
+ * Opens the decoder on the first read, so that header errors are read errors
+ */
+type lazyReader struct {
+	open    func(io.Reader) (io.Reader, error)
+	reader  io.Reader
+	decoder io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.decoder == nil {
+		decoder, err := l.open(l.reader)
+		if err != nil {
+			return 0, err
+		}
+		l.decoder = decoder
+	}
+	return l.decoder.Read(p)
+}
+
+/*
+ * Removes the spaces and tabs some clients put in base64 parts
+ */
+type spaceSkippingReader struct {
+	reader io.Reader
+}
+
+func (s *spaceSkippingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := s.reader.Read(p)
+		kept := 0
+		for _, b := range p[:n] {
+			if b != ' ' && b != '\t' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || n == 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+/*
+ * Returns a reader decoding the encoded reader with decode, and enforcing the
+ * decompression bomb limits: the decoded size, and its ratio to the encoded
+ * size. Zero means unlimited.
+ */
+func newBombLimitReader(encoded io.Reader, decode func(io.Reader) (io.Reader, error), maxSize int64, maxRatio int64) (io.Reader, error) {
+	counter := &countingReader{reader: encoded}
+	decoded, err := decode(counter)
+	if err != nil {
+		return nil, err
+	}
+	return &bombLimitReader{reader: decoded, encoded: counter, maxSize: maxSize, maxRatio: maxRatio}, nil
+}
+
+type bombLimitReader struct {
+	reader   io.Reader
+	encoded  *countingReader
+	decoded  int64
+	maxSize  int64
+	maxRatio int64
+}
+
+func (b *bombLimitReader) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.decoded += int64(n)
+	if b.maxSize > 0 && b.decoded > b.maxSize {
+		return 0, &forwarder.LimitError{Limit: "max-decoded-size", Value: b.maxSize}
+	}
+	if b.maxRatio > 0 && b.decoded > minDecodedSizeForRatio && b.decoded > b.maxRatio*b.encoded.count {
+		return 0, &forwarder.LimitError{Limit: "max-decode-ratio", Value: b.maxRatio}
+	}
+	return n, err
+}
+
+/*
+ * Counts the bytes read
+ */
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
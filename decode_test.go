@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"clammit/clamdtest"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "zlib":
+		w = zlib.NewWriter(buf)
+	case "flate":
+		w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(buf)
+	}
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	data := []byte(strings.Repeat("hello world ", 100))
+	for header, encoded := range map[string][]byte{
+		"gzip":           compress(t, "gzip", data),
+		"X-GZIP":         compress(t, "gzip", data),
+		"deflate":        compress(t, "zlib", data),
+		"identity":       data,
+		"br":             compress(t, "br", data),
+		"gzip, br":       compress(t, "br", compress(t, "gzip", data)),
+		"deflate,gzip":   compress(t, "gzip", compress(t, "flate", data)),
+		"identity, gzip": compress(t, "gzip", data),
+	} {
+		reader, err := decodeContentEncoding(header, bytes.NewReader(encoded))
+		require.NoError(t, err, header)
+		decoded, err := io.ReadAll(reader)
+		require.NoError(t, err, header)
+		assert.Equal(t, data, decoded, header)
+	}
+
+	_, err := decodeContentEncoding("gzip, compress", bytes.NewReader(data))
+	assert.EqualError(t, err, "unsupported encoding: compress")
+
+	reader, err := decodeContentEncoding("gzip", bytes.NewReader(data))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	reader, err := decodeTransferEncoding("BASE64", strings.NewReader("aGVs\r\nbG8g\t d29y bGQ="))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(decoded))
+
+	reader, err = decodeTransferEncoding("8bit", strings.NewReader("aGVsbG8="))
+	require.NoError(t, err)
+	decoded, _ = io.ReadAll(reader)
+	assert.Equal(t, "aGVsbG8=", string(decoded))
+}
+
+func TestBombLimitReader(t *testing.T) {
+	bomb := compress(t, "gzip", make([]byte, 10*1024*1024))
+	gunzip := func(r io.Reader) (io.Reader, error) { return decodeContentEncoding("gzip", r) }
+
+	reader, err := newBombLimitReader(bytes.NewReader(bomb), gunzip, 1024*1024, 0)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.EqualError(t, err, "max-decoded-size of 1048576 exceeded")
+
+	reader, err = newBombLimitReader(bytes.NewReader(bomb), gunzip, 0, 100)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.EqualError(t, err, "max-decode-ratio of 100 exceeded")
+
+	reader, err = newBombLimitReader(bytes.NewReader(bomb), gunzip, 0, 0)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Len(t, decoded, 10*1024*1024)
+}
+
+func TestScanInterceptor_Decode(t *testing.T) {
+	setup()
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: newTestClamav(t), MaxDecodeRatio: 100}
+
+	base64Part := func(data []byte) (string, []byte) {
+		body := &bytes.Buffer{}
+		w := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="eicar.txt"`)
+		header.Set("Content-Transfer-Encoding", "base64")
+		part, _ := w.CreatePart(header)
+		part.Write([]byte(base64.StdEncoding.EncodeToString(data)))
+		w.Close()
+		return w.FormDataContentType(), body.Bytes()
+	}
+
+	for _, test := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", "gzip", compress(t, "gzip", clamdtest.EICAR), virusCode},
+		{"brotli", "br", compress(t, "br", clamdtest.EICAR), virusCode},
+		{"clean", "deflate", compress(t, "zlib", []byte("clean")), 200},
+		{"corrupt", "gzip", []byte("not gzip"), 400},
+		{"unsupported", "compress", []byte("whatever"), 415},
+		{"bomb", "gzip", compress(t, "gzip", make([]byte, 2*1024*1024)), 413},
+	} {
+		rr := httptest.NewRecorder()
+		req := newHTTPRequest("POST", "application/octet-stream", bytes.NewReader(test.body))
+		req.Header.Set("Content-Encoding", test.encoding)
+		if !interceptor.Handle(rr, req, req.Body) {
+			rr.WriteHeader(200)
+		}
+		assert.Equal(t, test.status, rr.Code, test.name)
+	}
+
+	contentType, body := base64Part(clamdtest.EICAR)
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+
+	// Compressed multipart bodies
+	contentType, body = base64Part([]byte("clean"))
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(compress(t, "gzip", body)))
+	req.Header.Set("Content-Encoding", "gzip")
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+}
+
+func TestScanInterceptor_DecodeForwardsOriginal(t *testing.T) {
+	setup()
+	encoded := compress(t, "gzip", []byte("clean"))
+	var forwarded []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+		forwarded, _ = io.ReadAll(req.Body)
+	}))
+	defer backend.Close()
+	fw := forwarderFor(t, backend.URL, &ScanInterceptor{VirusStatusCode: virusCode, Scanner: newTestClamav(t)})
+
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	fw.HandleRequest(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, encoded, forwarded)
+}
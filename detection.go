@@ -0,0 +1,178 @@
+/*
+ * Detections are the files found infected, or not allowed by the scan
+ * policy. Each one is audited and counted. It blocks the request or, in
+ * monitor mode, is passed on to the application in the X-Clammit-Result and
+ * X-Clammit-Signature headers of the forwarded request. In monitor mode, the
+ * files that could not be scanned, or not in full, are detections too.
+ */
+package main
+
+import (
+	"clammit/client"
+	"clammit/forwarder"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// The headers telling the application what was found in monitor mode
+const (
+	ResultHeader    = client.ResultHeader
+	SignatureHeader = client.SignatureHeader
+)
+
+// Detection results
+const (
+	RESULT_FOUND     = "FOUND"
+	RESULT_BLOCKED   = "BLOCKED"
+	RESULT_TOO_LARGE = client.RES_TOO_LARGE
+	RESULT_ERROR     = client.RES_ERROR
+)
+
+// The results by severity: a request gets the most severe of its detections
+var resultSeverity = map[string]int{RESULT_FOUND: 4, RESULT_BLOCKED: 3, RESULT_TOO_LARGE: 2, RESULT_ERROR: 1}
+
+/*
+ * A file found infected or not allowed
+ */
+type Detection struct {
+	// The path of the file in the request
+	File string
+	// RESULT_FOUND for a virus, RESULT_BLOCKED for a file type not allowed,
+	// and in monitor mode RESULT_TOO_LARGE for a size limit exceeded,
+	// RESULT_ERROR for a scan error
+	Result string
+	// The virus signature, the reason the file type is not allowed, or the
+	// error
+	Signature string
+	// The position of the file in the request: the number of parts before it
+	Index int
+}
+
+/*
+ * The state of the scan of a request
+ */
+type requestScan struct {
+	req *http.Request
+	// If true, detections are recorded instead of blocking the request
+	monitor bool
+	// The number of parts seen so far, at any depth
+	count int
+	// The scans in progress, if the parts are scanned in parallel
+	parallel *parallelScans
+	// If false, the request was not scanned, e.g. skipped by the policy
+	scanned bool
+	// In monitor mode, set when the scan stopped at a size limit: the rest of
+	// the request is forwarded without being scanned
+	truncated bool
+
+	mutex      sync.Mutex
+	detections []*Detection
+	// The hashes of the files scanned, for the verdict headers
+	hashes []partHash
+}
+
+/*
+ * The hash of a file scanned, and its position in the request
+ */
+type partHash struct {
+	client.PartHash
+	index int
+}
+
+/*
+ * Returns true if the request is scanned in monitor mode: globally, or for
+ * the route it matched
+ */
+func (c *ScanInterceptor) monitors(req *http.Request) bool {
+	if c.Monitor {
+		return true
+	}
+	route := forwarder.RouteFromRequest(req)
+	return route != nil && c.MonitorRoutes[route.Name]
+}
+
+/*
+ * Audits and counts a detection. In monitor mode, it is recorded for the
+ * forwarded request, otherwise the response is written, with the status code
+ * if it is set.
+ *
+ * returns True if a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnDetection(w http.ResponseWriter, scan *requestScan, detection *Detection, statusCode int) bool {
+	mode := "block"
+	if scan.monitor {
+		mode = "monitor"
+	}
+	c.audit(scan.req, detection, mode)
+	c.Detections.Inc(detection.Result, mode)
+	if scan.monitor {
+		scan.mutex.Lock()
+		scan.detections = append(scan.detections, detection)
+		scan.mutex.Unlock()
+		return false
+	}
+	outcome := OUTCOME_VIRUS
+	if detection.Result == RESULT_BLOCKED {
+		outcome = OUTCOME_POLICY
+	}
+	c.Responses.Respond(w, scan.req, outcome, &ResponseData{StatusCode: statusCode, Filename: detection.File, Signature: detection.Signature})
+	return true
+}
+
+/*
+ * Writes the audit record of a detection: a single log line of key=value
+ * pairs, starting with AUDIT so that it is easy to filter
+ */
+func (c *ScanInterceptor) audit(req *http.Request, detection *Detection, mode string) {
+	route := "-"
+	if r := forwarder.RouteFromRequest(req); r != nil {
+		route = r.Name
+	}
+	ctx.Logger.Printf("AUDIT result=%s mode=%s file=%q signature=%q method=%s path=%q route=%s remote=%s forwarded-for=%q",
+		detection.Result, mode, detection.File, detection.Signature, req.Method, req.URL.Path, route, req.RemoteAddr, req.Header.Get("X-Forwarded-For"))
+}
+
+/*
+ * Sets the result headers of a request scanned in monitor mode, for the
+ * application: X-Clammit-Result is FOUND if a virus was found, otherwise
+ * BLOCKED if a file type is not allowed, TOO_LARGE if a size limit was
+ * exceeded, ERROR if a file could not be scanned. X-Clammit-Signature lists
+ * the viruses found.
+ */
+func (scan *requestScan) setResultHeaders() {
+	if len(scan.detections) == 0 {
+		return
+	}
+	// In request order, whatever the order the scans ended in
+	sort.SliceStable(scan.detections, func(i, j int) bool {
+		a, b := scan.detections[i], scan.detections[j]
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Signature < b.Signature
+	})
+	result := RESULT_ERROR
+	for _, detection := range scan.detections {
+		if resultSeverity[detection.Result] > resultSeverity[result] {
+			result = detection.Result
+		}
+		if detection.Result == RESULT_FOUND {
+			scan.req.Header.Add(SignatureHeader, detection.Signature)
+		}
+	}
+	scan.req.Header.Set(ResultHeader, result)
+	ctx.Logger.Printf("Monitor mode: forwarding %s %s despite %d detection(s)", scan.req.Method, scan.req.URL.Path, len(scan.detections))
+}
+
+/*
+ * Records the hash of a file scanned
+ */
+func (scan *requestScan) addHash(index int, name string, sha256 string) {
+	scan.mutex.Lock()
+	scan.hashes = append(scan.hashes, partHash{PartHash: client.PartHash{Name: name, SHA256: sha256}, index: index})
+	scan.mutex.Unlock()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"clammit/clamdtest"
+	"clammit/metrics"
+	"clammit/scanner"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanInterceptor_Monitor(t *testing.T) {
+	setup()
+	logs := &bytes.Buffer{}
+	ctx.Logger = log.New(logs, "", 0)
+	scanner := &recordingScanner{}
+	detections := metrics.NewRegistry().NewCounter("detections", "", "result", "mode")
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         scanner,
+		Monitor:         true,
+		Detections:      detections,
+		DefaultPolicy:   &ScanPolicy{Name: "default", BlockTypes: []string{"executable"}},
+	}
+
+	// Every part is scanned, and the request goes through with the results
+	contentType, body := makeFilesBody(t, "VIRUS", "clean", "MZ VIRUS")
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	req.Header.Set(ResultHeader, "CLEAN")
+	rr := httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 200, rr.Code)
+	assert.Empty(t, rr.Body.String())
+	assert.Len(t, scanner.scanned, 3)
+	assert.Equal(t, "FOUND", req.Header.Get(ResultHeader))
+	assert.Equal(t, []string{"Test-Signature", "Test-Signature"}, req.Header.Values(SignatureHeader))
+	assert.Equal(t, float64(2), detections.Value("FOUND", "monitor"))
+	assert.Equal(t, float64(1), detections.Value("BLOCKED", "monitor"))
+	assert.Contains(t, logs.String(), `AUDIT result=FOUND mode=monitor file="file1.txt" signature="Test-Signature" method=POST`)
+	assert.Contains(t, logs.String(), `AUDIT result=BLOCKED mode=monitor file="file3.txt" signature="type exe is blocked"`)
+
+	// File types alone are blocked, without signature
+	contentType, body = makeFilesBody(t, "MZ")
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	assert.Equal(t, "BLOCKED", req.Header.Get(ResultHeader))
+	assert.Empty(t, req.Header.Values(SignatureHeader))
+
+	// Clean requests have no result, whatever the client says
+	req = newHTTPRequest("POST", "text/plain", strings.NewReader("clean"))
+	req.Header.Set(ResultHeader, "CLEAN")
+	req.Header.Set(SignatureHeader, "None")
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	assert.Empty(t, req.Header.Get(ResultHeader))
+	assert.Empty(t, req.Header.Get(SignatureHeader))
+
+	// Scanned in parallel, all parts are scanned too
+	slow := &slowScanner{}
+	parallel := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: slow, Monitor: true, ScanParallelism: 2}
+	contentType, body = makeFilesBody(t, "VIRUS", "VIRUS", "clean")
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, parallel.Handle(httptest.NewRecorder(), req, req.Body))
+	assert.Equal(t, int32(3), slow.scans.Load())
+	assert.Len(t, req.Header.Values(SignatureHeader), 2)
+
+	// Size limits stop the scan, but the request goes through
+	interceptor.MaxParts = 1
+	contentType, body = makeFilesBody(t, "clean", "VIRUS")
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	rr = httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "TOO_LARGE", req.Header.Get(ResultHeader))
+	assert.Equal(t, float64(1), detections.Value("TOO_LARGE", "monitor"))
+	assert.Contains(t, logs.String(), `AUDIT result=TOO_LARGE mode=monitor file="multipart form" signature="max-parts of 1 exceeded"`)
+
+	// Detections are counted when blocking too
+	interceptor.Monitor, interceptor.MaxParts = false, 0
+	req = newHTTPRequest("POST", "text/plain", strings.NewReader("VIRUS"))
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+	assert.Equal(t, float64(1), detections.Value("FOUND", "block"))
+	assert.Contains(t, logs.String(), `AUDIT result=FOUND mode=block file="untitled"`)
+}
+
+func TestScanInterceptor_MonitorErrors(t *testing.T) {
+	setup()
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(clamdtest.Failure("broken", "Can't allocate memory"), clamdtest.Found("VIRUS", "Test.Virus"))
+	clamav := new(scanner.Clamav)
+	clamav.SetLogger(ctx.Logger, false)
+	clamav.SetAddress(clamd.URL)
+	detections := metrics.NewRegistry().NewCounter("detections", "", "result", "mode")
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: clamav, Monitor: true, Detections: detections}
+
+	// Scan errors do not stop the request either
+	contentType, body := makeFilesBody(t, "broken", "clean")
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	assert.Equal(t, "ERROR", req.Header.Get(ResultHeader))
+	assert.Equal(t, float64(1), detections.Value("ERROR", "monitor"))
+
+	// Viruses win over errors
+	contentType, body = makeFilesBody(t, "broken", "VIRUS")
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	assert.Equal(t, "FOUND", req.Header.Get(ResultHeader))
+	assert.Equal(t, []string{"Test.Virus"}, req.Header.Values(SignatureHeader))
+
+	// Part limits are left to the scan, in monitor mode
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "TOO_LARGE", r.Header.Get(ResultHeader))
+		w.WriteHeader(202)
+	}))
+	defer backend.Close()
+	interceptor.MaxPartSize = 3
+	contentType, body = makeFilesBody(t, "clean")
+	rr := httptest.NewRecorder()
+	forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, newHTTPRequest("POST", contentType, bytes.NewReader(body)))
+	assert.Equal(t, 202, rr.Code)
+}
+
+func TestScanInterceptor_MonitorRoute(t *testing.T) {
+	setup()
+	var result, signature string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, signature = r.Header.Get(ResultHeader), r.Header.Get(SignatureHeader)
+		w.WriteHeader(202)
+	}))
+	defer backend.Close()
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         &recordingScanner{},
+		MonitorRoutes:   map[string]bool{"api": true},
+	}
+
+	for path, expected := range map[string]int{"/api/v1": 202, "/upload": virusCode} {
+		result, signature = "", ""
+		fw := forwarderFor(t, backend.URL, interceptor)
+		req := newHTTPRequest("POST", "text/plain", strings.NewReader("VIRUS"))
+		req.URL.Path = path
+		rr := httptest.NewRecorder()
+		fw.HandleRequest(rr, req)
+		assert.Equal(t, expected, rr.Code, path)
+		if expected == 202 {
+			assert.Equal(t, "FOUND", result)
+			assert.Equal(t, "Test-Signature", signature)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Content extractors find the files hidden in request bodies that are not
+ * multipart forms: the values of urlencoded forms, and the base64 strings and
+ * data: URIs of JSON documents. Scanned as a whole, such bodies only show
+ * clamd encoded data.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The length of the strings decoded as base64 when looking for them,
+// if the policy does not say otherwise
+const defaultBase64MinLength = 128
+
+// The number of decoded files scanned separately in a body, if there is no
+// max-parts: each one is a round trip to clamd
+const defaultMaxDecoded = 100
+
+/*
+ * A payload found in a request body
+ */
+type Extracted struct {
+	// Where it was found: a form field name or a JSON path
+	Name string
+	// The content type declared by a data: URI
+	ContentType string
+	// The payload, decoded
+	Data []byte
+	// If true, the payload was base64 or a data: URI, so it is a file
+	Decoded bool
+}
+
+/*
+ * Holds a copy of the body to extract its contents from, up to a maximum
+ * size. Past it, the copy is dropped and the body is only scanned as a whole.
+ */
+type extractBuffer struct {
+	content bytes.Buffer
+	// Zero means unlimited
+	max int64
+	// True if the body was larger than max
+	overflow bool
+}
+
+func (b *extractBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.max > 0 && int64(b.content.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.content = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.content.Write(p)
+}
+
+/*
+ * Returns the extractor for the content type, or nil if there is none
+ */
+func extractorFor(contentType string, policy *ScanPolicy) func(body []byte) ([]*Extracted, error) {
+	switch {
+	case contentType == "application/x-www-form-urlencoded":
+		return func(body []byte) ([]*Extracted, error) {
+			return extractForm(body, policy.base64MinLength())
+		}
+	case contentType == "application/json" || strings.HasSuffix(contentType, "+json"):
+		return func(body []byte) ([]*Extracted, error) {
+			if policy != nil && len(policy.JSONFields) > 0 {
+				return extractJSONFields(body, policy.JSONFields)
+			}
+			return extractJSON(body, policy.base64MinLength())
+		}
+	}
+	return nil
+}
+
+/*
+ * Extracts the values of an urlencoded form, decoding the base64 ones and the
+ * data: URIs. Malformed pairs are skipped, as they are left to the scan of the
+ * whole body: the pairs parsed alongside them are still extracted, so that a
+ * bad pair cannot hide an encoded file.
+ */
+func extractForm(body []byte, minLength int) ([]*Extracted, error) {
+	values, _ := url.ParseQuery(string(body))
+	var extracted []*Extracted
+	for _, name := range sortedKeys(values) {
+		for _, value := range values[name] {
+			if value == "" {
+				continue
+			}
+			if item := decodeString(name, value, minLength); item != nil {
+				extracted = append(extracted, item)
+			} else {
+				extracted = append(extracted, &Extracted{Name: name, Data: []byte(value)})
+			}
+		}
+	}
+	return extracted, nil
+}
+
+/*
+ * Extracts the long base64 strings and the data: URIs of a JSON document
+ */
+func extractJSON(body []byte, minLength int) ([]*Extracted, error) {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
+	var extracted []*Extracted
+	walkJSON("$", document, func(path string, value interface{}) {
+		if s, ok := value.(string); ok {
+			if item := decodeString(path, s, minLength); item != nil {
+				extracted = append(extracted, item)
+			}
+		}
+	})
+	return extracted, nil
+}
+
+/*
+ * Extracts the strings at the given paths of a JSON document, decoded if they
+ * are base64 or data: URIs
+ */
+func extractJSONFields(body []byte, paths []*JSONPath) ([]*Extracted, error) {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
+	var extracted []*Extracted
+	for _, path := range paths {
+		path.Find(document, func(name string, value interface{}) {
+			if s, ok := value.(string); ok && s != "" {
+				if item := decodeString(name, s, 0); item != nil {
+					extracted = append(extracted, item)
+				} else {
+					extracted = append(extracted, &Extracted{Name: name, Data: []byte(s)})
+				}
+			}
+		})
+	}
+	return extracted, nil
+}
+
+/*
+ * Decodes a data: URI, or a base64 string of at least minLength characters.
+ * Returns nil if the string is neither.
+ */
+func decodeString(name string, s string, minLength int) *Extracted {
+	if contentType, data, ok := decodeDataURI(s); ok {
+		return &Extracted{Name: name, ContentType: contentType, Data: data, Decoded: true}
+	}
+	if len(s) >= minLength {
+		if data, ok := decodeBase64(s); ok {
+			return &Extracted{Name: name, Data: data, Decoded: true}
+		}
+	}
+	return nil
+}
+
+/*
+ * Decodes a data: URI, i.e. data:[<media type>][;base64],<data>
+ */
+func decodeDataURI(s string) (string, []byte, bool) {
+	if len(s) < 5 || !strings.EqualFold(s[:5], "data:") {
+		return "", nil, false
+	}
+	meta, data, found := strings.Cut(s[5:], ",")
+	if !found {
+		return "", nil, false
+	}
+	isBase64 := false
+	if len(meta) >= 7 && strings.EqualFold(meta[len(meta)-7:], ";base64") {
+		meta, isBase64 = meta[:len(meta)-7], true
+	}
+	contentType, _, err := mime.ParseMediaType(meta)
+	if err != nil {
+		contentType = ""
+	}
+	if isBase64 {
+		decoded, ok := decodeBase64(data)
+		return contentType, decoded, ok
+	}
+	decoded, err := url.PathUnescape(data)
+	return contentType, []byte(decoded), err == nil
+}
+
+/*
+ * Decodes standard or URL-safe base64, padded or not, ignoring whitespace
+ */
+func decodeBase64(s string) ([]byte, bool) {
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return nil, false
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(s); err == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * Calls visit on the value and all its descendants, with their paths
+ */
+func walkJSON(path string, value interface{}, visit func(path string, value interface{})) {
+	visit(path, value)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			walkJSON(memberPath(path, key), v[key], visit)
+		}
+	case []interface{}:
+		for i, element := range v {
+			walkJSON(path+"["+strconv.Itoa(i)+"]", element, visit)
+		}
+	}
+}
+
+/*
+ * Returns the path of an object member
+ */
+func memberPath(path string, key string) string {
+	for _, r := range key {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return path + "[" + strconv.Quote(key) + "]"
+		}
+	}
+	return path + "." + key
+}
+
+/*
+ * A JSONPath expression, limited to member names, array indices, wildcards
+ * and recursive descent, e.g. $.files[*].content or $..data
+ */
+type JSONPath struct {
+	Expression string
+	segments   []pathSegment
+}
+
+/*
+ * A step in a JSONPath: a member name, an array index or a wildcard ("*"),
+ * applied to the current values or, if recursive, to all their descendants
+ */
+type pathSegment struct {
+	key       string
+	index     int
+	isIndex   bool
+	recursive bool
+}
+
+/*
+ * Parses a JSONPath expression
+ */
+func ParseJSONPath(expression string) (*JSONPath, error) {
+	if !strings.HasPrefix(expression, "$") {
+		return nil, fmt.Errorf("must start with $")
+	}
+	path := &JSONPath{Expression: expression}
+	s := expression[1:]
+	for s != "" {
+		segment := pathSegment{}
+		switch {
+		case strings.HasPrefix(s, ".."):
+			segment.recursive = true
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				break
+			}
+			fallthrough
+		case strings.HasPrefix(s, "."):
+			s = strings.TrimPrefix(s, ".")
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty member name")
+			}
+			segment.key, s = s[:end], s[end:]
+			path.segments = append(path.segments, segment)
+			continue
+		case !strings.HasPrefix(s, "["):
+			return nil, fmt.Errorf("unexpected %q", s)
+		}
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("missing ]")
+		}
+		inside := s[1:end]
+		s = s[end+1:]
+		switch {
+		case inside == "*":
+			segment.key = "*"
+		case len(inside) >= 2 && (inside[0] == '\'' || inside[0] == '"') && inside[len(inside)-1] == inside[0]:
+			segment.key = inside[1 : len(inside)-1]
+		default:
+			index, err := strconv.Atoi(inside)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q", inside)
+			}
+			segment.index, segment.isIndex = index, true
+		}
+		path.segments = append(path.segments, segment)
+	}
+	return path, nil
+}
+
+/*
+ * Calls found on the values of the document matching the path, with their
+ * concrete paths
+ */
+func (p *JSONPath) Find(document interface{}, found func(path string, value interface{})) {
+	find(p.segments, "$", document, found)
+}
+
+func find(segments []pathSegment, path string, value interface{}, found func(path string, value interface{})) {
+	if len(segments) == 0 {
+		found(path, value)
+		return
+	}
+	segment := segments[0]
+	if segment.recursive {
+		// Apply the segment to the value and to all its descendants
+		applied := segment
+		applied.recursive = false
+		walkJSON(path, value, func(path string, value interface{}) {
+			find(append([]pathSegment{applied}, segments[1:]...), path, value, found)
+		})
+		return
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if segment.isIndex {
+			return
+		}
+		if segment.key == "*" {
+			for _, key := range sortedKeys(v) {
+				find(segments[1:], memberPath(path, key), v[key], found)
+			}
+		} else if member, ok := v[segment.key]; ok {
+			find(segments[1:], memberPath(path, segment.key), member, found)
+		}
+	case []interface{}:
+		for i, element := range v {
+			if segment.key == "*" || segment.isIndex && segment.index == i {
+				find(segments[1:], path+"["+strconv.Itoa(i)+"]", element, found)
+			}
+		}
+	}
+}
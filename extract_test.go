@@ -0,0 +1,212 @@
+package main
+
+import (
+	"clammit/clamdtest"
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractForm(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("binary", 30)))
+	form := url.Values{
+		"name":  {"kermit"},
+		"empty": {""},
+		"file":  {encoded},
+		"short": {"aGVsbG8="},
+		"image": {"data:image/png;base64,iVBORw0KGgo="},
+	}
+	extracted, err := extractForm([]byte(form.Encode()), defaultBase64MinLength)
+	require.NoError(t, err)
+	assert.Equal(t, []*Extracted{
+		{Name: "file", Data: []byte(strings.Repeat("binary", 30)), Decoded: true},
+		{Name: "image", ContentType: "image/png", Data: []byte("\x89PNG\r\n\x1a\n"), Decoded: true},
+		{Name: "name", Data: []byte("kermit")},
+		{Name: "short", Data: []byte("aGVsbG8=")},
+	}, extracted)
+
+	// The pairs parsed alongside a malformed one are kept
+	extracted, err = extractForm([]byte("a=%zz&name=kermit"), defaultBase64MinLength)
+	require.NoError(t, err)
+	assert.Equal(t, []*Extracted{{Name: "name", Data: []byte("kermit")}}, extracted)
+}
+
+func TestExtractJSON(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("binary", 30)))
+	body := `{"user": "kermit", "files": [{"name": "a.bin", "content": "` + encoded + `"}],
+		"avatar": "data:text/plain,hello%20world", "a key": {"nested": "data:;base64,aGk="}}`
+	extracted, err := extractJSON([]byte(body), defaultBase64MinLength)
+	require.NoError(t, err)
+	assert.Equal(t, []*Extracted{
+		{Name: `$["a key"].nested`, Data: []byte("hi"), Decoded: true},
+		{Name: "$.avatar", ContentType: "text/plain", Data: []byte("hello world"), Decoded: true},
+		{Name: "$.files[0].content", Data: []byte(strings.Repeat("binary", 30)), Decoded: true},
+	}, extracted)
+
+	_, err = extractJSON([]byte("{"), defaultBase64MinLength)
+	assert.Error(t, err)
+}
+
+func TestExtractJSONFields(t *testing.T) {
+	body := `{"files": [{"content": "aGVsbG8="}, {"content": "not base64!"}], "other": "aGk=", "deep": {"x": {"content": ""}}}`
+	var paths []*JSONPath
+	for _, expression := range []string{"$.files[*].content", "$['other']"} {
+		path, err := ParseJSONPath(expression)
+		require.NoError(t, err)
+		paths = append(paths, path)
+	}
+	extracted, err := extractJSONFields([]byte(body), paths)
+	require.NoError(t, err)
+	assert.Equal(t, []*Extracted{
+		{Name: "$.files[0].content", Data: []byte("hello"), Decoded: true},
+		{Name: "$.files[1].content", Data: []byte("not base64!")},
+		{Name: "$.other", Data: []byte("hi"), Decoded: true},
+	}, extracted)
+}
+
+func TestParseJSONPath(t *testing.T) {
+	document := map[string]interface{}{
+		"a": []interface{}{
+			map[string]interface{}{"data": "one"},
+			map[string]interface{}{"data": "two", "b": map[string]interface{}{"data": "three"}},
+		},
+		"data": "four",
+	}
+	for expression, expected := range map[string][]string{
+		"$.a[1].data":    {"$.a[1].data"},
+		"$.a[*].data":    {"$.a[0].data", "$.a[1].data"},
+		"$..data":        {"$.data", "$.a[0].data", "$.a[1].data", "$.a[1].b.data"},
+		"$.a[1].*":       {"$.a[1].b", "$.a[1].data"},
+		`$["data"]`:      {"$.data"},
+		"$..[0]":         {"$.a[0]"},
+		"$.missing[0].x": nil,
+		"$.data[0]":      nil,
+	} {
+		path, err := ParseJSONPath(expression)
+		require.NoError(t, err, expression)
+		var found []string
+		path.Find(document, func(path string, value interface{}) {
+			found = append(found, path)
+		})
+		assert.Equal(t, expected, found, expression)
+	}
+
+	for _, expression := range []string{"a.b", "$.", "$.a[", "$.a[-1]", "$.a[x]", "$a"} {
+		_, err := ParseJSONPath(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	for _, encoded := range []string{"aGk/Pz8+", "aGk_Pz8-", "aGk/\r\nPz8+"} {
+		data, ok := decodeBase64(encoded)
+		assert.True(t, ok, encoded)
+		assert.Equal(t, []byte("hi???>"), data, encoded)
+	}
+	data, ok := decodeBase64("aGk")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hi"), data)
+	_, ok = decodeBase64("not base64")
+	assert.False(t, ok)
+}
+
+func TestScanInterceptor_Extract(t *testing.T) {
+	setup()
+	// Trailing whitespace is allowed after the EICAR string
+	eicar := base64.StdEncoding.EncodeToString(append(clamdtest.EICAR, strings.Repeat(" ", 60)...))
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: newTestClamav(t), MaxExtractSize: 1000}
+
+	for _, test := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/json", `{"file": "` + eicar + `"}`, virusCode},
+		{"application/vnd.api+json", `{"file": "data:application/octet-stream;base64,` + eicar + `"}`, virusCode},
+		{"application/json", `{"file": "` + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("clean", 100))) + `"}`, 200},
+		{"application/json", `{"broken": `, 200},
+		{"application/x-www-form-urlencoded", url.Values{"file": {string(clamdtest.EICAR)}}.Encode(), virusCode},
+		{"application/x-www-form-urlencoded", "file=" + url.QueryEscape(eicar), virusCode},
+		{"application/x-www-form-urlencoded", "name=kermit", 200},
+		{"application/x-www-form-urlencoded", "file=" + url.QueryEscape(eicar) + "&x=%zz", virusCode},
+		// Larger bodies are only scanned as a whole
+		{"application/x-www-form-urlencoded", "name=" + strings.Repeat("x", 1000), 200},
+		{"application/x-www-form-urlencoded", "name=" + strings.Repeat("x", 1000) + "&file=" + string(clamdtest.EICAR), virusCode},
+		{"text/plain", eicar, 200},
+	} {
+		rr := httptest.NewRecorder()
+		req := newHTTPRequest("POST", test.contentType, strings.NewReader(test.body))
+		if !interceptor.Handle(rr, req, req.Body) {
+			rr.WriteHeader(200)
+		}
+		assert.Equal(t, test.status, rr.Code, test.body)
+	}
+}
+
+func TestScanInterceptor_ExtractPolicy(t *testing.T) {
+	setup()
+	path, err := ParseJSONPath("$.upload")
+	require.NoError(t, err)
+	scanner := &recordingScanner{}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner, DefaultPolicy: &ScanPolicy{
+		Name:       "default",
+		JSONFields: []*JSONPath{path},
+		BlockTypes: []string{"pdf"},
+		MaxParts:   2,
+	}}
+
+	body := `{"upload": "` + base64.StdEncoding.EncodeToString([]byte("%PDF-1.7")) + `"}`
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", "application/json", strings.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 415, rr.Code)
+	assert.Contains(t, rr.Body.String(), "File $.upload is not allowed: type pdf is blocked")
+
+	scanner.scanned = nil
+	other := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("VIRUS", 100)))
+	req = newHTTPRequest("POST", "application/json", strings.NewReader(`{"other": "`+other+`", "upload": "clean"}`))
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	require.Len(t, scanner.scanned, 2)
+	assert.Equal(t, "clean", string(scanner.scanned[1]))
+
+	req = newHTTPRequest("POST", "application/x-www-form-urlencoded", strings.NewReader("a=1&b=2&c=3"))
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+}
+
+func TestScanInterceptor_ExtractScans(t *testing.T) {
+	setup()
+	scanner := &recordingScanner{}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner}
+
+	// The plain values of a form are scanned together, the decoded ones
+	// separately
+	encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("binary", 30)))
+	body := "a=1&b=2&c=VIRU%53&file=" + url.QueryEscape(encoded)
+	req := newHTTPRequest("POST", "application/x-www-form-urlencoded", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+	assert.Contains(t, rr.Body.String(), "File a,b,c has a virus!")
+	require.Len(t, scanner.scanned, 3)
+	assert.Equal(t, strings.Repeat("binary", 30), string(scanner.scanned[1]))
+	assert.Equal(t, "1\n2\nVIRUS", string(scanner.scanned[2]))
+
+	// Without max-parts, the number of decoded files is capped
+	scanner.scanned = nil
+	files := make([]string, defaultMaxDecoded+1)
+	for i := range files {
+		files[i] = `"` + encoded + `"`
+	}
+	req = newHTTPRequest("POST", "application/json", strings.NewReader(`{"files": [`+strings.Join(files, ",")+`]}`))
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+	assert.Len(t, scanner.scanned, defaultMaxDecoded+1, "the body and the files within the cap")
+}
@@ -0,0 +1,293 @@
+/*
+ * Detects the real type of a file from its leading bytes ("magic numbers"),
+ * and compares it with what the client declared: the Content-Type and the
+ * file name extension.
+ *
+ * Types belong to classes ("image", "document", "executable"...), so that
+ * policies can refer to whole families of file types at once.
+ */
+package filetype
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+/*
+ * Number of leading bytes needed for the detection
+ */
+const SniffLength = 64 * 1024
+
+/*
+ * Type classes
+ */
+const (
+	CLASS_DOCUMENT      = "document"
+	CLASS_IMAGE         = "image"
+	CLASS_ARCHIVE       = "archive"
+	CLASS_EXECUTABLE    = "executable"
+	CLASS_SCRIPT        = "script"
+	CLASS_OFFICE_MACRO  = "office-macro"
+	CLASS_OFFICE_LEGACY = "office-legacy"
+	CLASS_TEXT          = "text"
+	CLASS_UNKNOWN       = "unknown"
+)
+
+/*
+ * A file type. Family is the name of a more generic type the file also is,
+ * e.g. a docx file is also a zip file.
+ */
+type Type struct {
+	Name       string
+	Family     string
+	MimeTypes  []string
+	Extensions []string
+	Classes    []string
+}
+
+/*
+ * Returns true if the type has the given name, family or class
+ */
+func (t *Type) Is(nameOrClass string) bool {
+	nameOrClass = strings.ToLower(nameOrClass)
+	if t.Name == nameOrClass || (t.Family != "" && t.Family == nameOrClass) {
+		return true
+	}
+	for _, class := range t.Classes {
+		if class == nameOrClass {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns true if both types are the same, or one is the family of the other
+ */
+func (t *Type) Compatible(other *Type) bool {
+	return t.Name == other.Name || t.Family == other.Name || t.Name == other.Family
+}
+
+/*
+ * Returns the main MIME type
+ */
+func (t *Type) MimeType() string {
+	return t.MimeTypes[0]
+}
+
+func (t *Type) String() string {
+	return t.Name
+}
+
+var (
+	PDF     = &Type{Name: "pdf", MimeTypes: []string{"application/pdf"}, Extensions: []string{".pdf"}, Classes: []string{CLASS_DOCUMENT}}
+	PNG     = &Type{Name: "png", MimeTypes: []string{"image/png"}, Extensions: []string{".png"}, Classes: []string{CLASS_IMAGE}}
+	JPEG    = &Type{Name: "jpeg", MimeTypes: []string{"image/jpeg", "image/pjpeg"}, Extensions: []string{".jpg", ".jpeg", ".jpe"}, Classes: []string{CLASS_IMAGE}}
+	GIF     = &Type{Name: "gif", MimeTypes: []string{"image/gif"}, Extensions: []string{".gif"}, Classes: []string{CLASS_IMAGE}}
+	WEBP    = &Type{Name: "webp", MimeTypes: []string{"image/webp"}, Extensions: []string{".webp"}, Classes: []string{CLASS_IMAGE}}
+	BMP     = &Type{Name: "bmp", MimeTypes: []string{"image/bmp"}, Extensions: []string{".bmp"}, Classes: []string{CLASS_IMAGE}}
+	TIFF    = &Type{Name: "tiff", MimeTypes: []string{"image/tiff"}, Extensions: []string{".tif", ".tiff"}, Classes: []string{CLASS_IMAGE}}
+	ZIP     = &Type{Name: "zip", MimeTypes: []string{"application/zip", "application/x-zip-compressed"}, Extensions: []string{".zip"}, Classes: []string{CLASS_ARCHIVE}}
+	GZIP    = &Type{Name: "gzip", MimeTypes: []string{"application/gzip", "application/x-gzip"}, Extensions: []string{".gz", ".tgz"}, Classes: []string{CLASS_ARCHIVE}}
+	SEVENZ  = &Type{Name: "7z", MimeTypes: []string{"application/x-7z-compressed"}, Extensions: []string{".7z"}, Classes: []string{CLASS_ARCHIVE}}
+	RAR     = &Type{Name: "rar", MimeTypes: []string{"application/vnd.rar", "application/x-rar-compressed"}, Extensions: []string{".rar"}, Classes: []string{CLASS_ARCHIVE}}
+	DOCX    = &Type{Name: "docx", Family: "zip", MimeTypes: []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"}, Extensions: []string{".docx"}, Classes: []string{CLASS_DOCUMENT}}
+	XLSX    = &Type{Name: "xlsx", Family: "zip", MimeTypes: []string{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}, Extensions: []string{".xlsx"}, Classes: []string{CLASS_DOCUMENT}}
+	PPTX    = &Type{Name: "pptx", Family: "zip", MimeTypes: []string{"application/vnd.openxmlformats-officedocument.presentationml.presentation"}, Extensions: []string{".pptx"}, Classes: []string{CLASS_DOCUMENT}}
+	DOCM    = &Type{Name: "docm", Family: "zip", MimeTypes: []string{"application/vnd.ms-word.document.macroenabled.12"}, Extensions: []string{".docm"}, Classes: []string{CLASS_DOCUMENT, CLASS_OFFICE_MACRO}}
+	XLSM    = &Type{Name: "xlsm", Family: "zip", MimeTypes: []string{"application/vnd.ms-excel.sheet.macroenabled.12"}, Extensions: []string{".xlsm"}, Classes: []string{CLASS_DOCUMENT, CLASS_OFFICE_MACRO}}
+	PPTM    = &Type{Name: "pptm", Family: "zip", MimeTypes: []string{"application/vnd.ms-powerpoint.presentation.macroenabled.12"}, Extensions: []string{".pptm"}, Classes: []string{CLASS_DOCUMENT, CLASS_OFFICE_MACRO}}
+	OLE     = &Type{Name: "ole", MimeTypes: []string{"application/x-ole-storage", "application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint"}, Extensions: []string{".doc", ".xls", ".ppt", ".msg"}, Classes: []string{CLASS_DOCUMENT, CLASS_OFFICE_LEGACY}}
+	EXE     = &Type{Name: "exe", MimeTypes: []string{"application/vnd.microsoft.portable-executable", "application/x-msdownload", "application/x-dosexec"}, Extensions: []string{".exe", ".dll", ".scr", ".sys", ".com"}, Classes: []string{CLASS_EXECUTABLE}}
+	ELF     = &Type{Name: "elf", MimeTypes: []string{"application/x-executable", "application/x-elf"}, Extensions: []string{".so", ".elf"}, Classes: []string{CLASS_EXECUTABLE}}
+	MACHO   = &Type{Name: "macho", MimeTypes: []string{"application/x-mach-binary"}, Extensions: []string{".dylib"}, Classes: []string{CLASS_EXECUTABLE}}
+	SCRIPT  = &Type{Name: "script", Family: "text", MimeTypes: []string{"text/x-shellscript", "application/x-sh"}, Extensions: []string{".sh", ".bash", ".bat", ".cmd", ".ps1", ".vbs", ".js", ".py", ".pl"}, Classes: []string{CLASS_SCRIPT}}
+	HTML    = &Type{Name: "html", Family: "text", MimeTypes: []string{"text/html"}, Extensions: []string{".html", ".htm"}, Classes: []string{CLASS_TEXT}}
+	TEXT    = &Type{Name: "text", MimeTypes: []string{"text/plain"}, Extensions: []string{".txt", ".csv", ".json", ".xml", ".md", ".log"}, Classes: []string{CLASS_TEXT}}
+	UNKNOWN = &Type{Name: "unknown", MimeTypes: []string{"application/octet-stream"}, Classes: []string{CLASS_UNKNOWN}}
+)
+
+/*
+ * All the known types, except UNKNOWN
+ */
+var Types = []*Type{PDF, PNG, JPEG, GIF, WEBP, BMP, TIFF, ZIP, GZIP, SEVENZ, RAR, DOCX, XLSX, PPTX, DOCM, XLSM, PPTM, OLE, EXE, ELF, MACHO, SCRIPT, HTML, TEXT}
+
+/*
+ * Returns true if the argument is the name of a known type or class
+ */
+func Known(nameOrClass string) bool {
+	for _, t := range append(Types, UNKNOWN) {
+		if t.Is(nameOrClass) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Magic numbers, at the start of the file
+ */
+var signatures = []struct {
+	magic []byte
+	t     *Type
+}{
+	{[]byte("%PDF-"), PDF},
+	{[]byte("\x89PNG\r\n\x1a\n"), PNG},
+	{[]byte("\xff\xd8\xff"), JPEG},
+	{[]byte("GIF87a"), GIF},
+	{[]byte("GIF89a"), GIF},
+	{[]byte("BM"), BMP},
+	{[]byte("II*\x00"), TIFF},
+	{[]byte("MM\x00*"), TIFF},
+	{[]byte("\x1f\x8b"), GZIP},
+	{[]byte("7z\xbc\xaf\x27\x1c"), SEVENZ},
+	{[]byte("Rar!\x1a\x07"), RAR},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), OLE},
+	{[]byte("MZ"), EXE},
+	{[]byte("\x7fELF"), ELF},
+	{[]byte("\xfe\xed\xfa\xce"), MACHO},
+	{[]byte("\xfe\xed\xfa\xcf"), MACHO},
+	{[]byte("\xce\xfa\xed\xfe"), MACHO},
+	{[]byte("\xcf\xfa\xed\xfe"), MACHO},
+	{[]byte("\xca\xfe\xba\xbe"), MACHO},
+	{[]byte("#!"), SCRIPT},
+}
+
+/*
+ * Detects the file type from its first bytes, ideally SniffLength of them
+ */
+func Detect(head []byte) *Type {
+	if len(head) >= 12 && bytes.Equal(head[0:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")) {
+		return WEBP
+	}
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return detectZip(head)
+	}
+	for _, signature := range signatures {
+		if bytes.HasPrefix(head, signature.magic) {
+			return signature.t
+		}
+	}
+	trimmed := bytes.ToLower(bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf"))
+	if bytes.HasPrefix(trimmed, []byte("@echo off")) {
+		return SCRIPT
+	}
+	switch contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head)); contentType {
+	case "text/html":
+		return HTML
+	case "text/plain", "text/xml":
+		return TEXT
+	}
+	return UNKNOWN
+}
+
+/*
+ * Returns the type matching the file name extension, or nil
+ */
+func ByExtension(filename string) *Type {
+	ext := strings.ToLower(path.Ext(filename))
+	if ext == "" {
+		return nil
+	}
+	for _, t := range Types {
+		for _, e := range t.Extensions {
+			if e == ext {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the type matching the MIME type, or nil
+ */
+func ByMimeType(contentType string) *Type {
+	mimeType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, t := range Types {
+		for _, m := range t.MimeTypes {
+			if m == mimeType {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Compares the detected type with the declared content type and file name.
+ * Returns a description of the first disagreement, or "" if there is none.
+ * Generic or unknown declarations are not considered a disagreement.
+ */
+func Mismatch(detected *Type, declaredType string, filename string) string {
+	if t := ByExtension(filename); t != nil && !t.Compatible(detected) {
+		return "extension " + strings.ToLower(path.Ext(filename)) + " does not match the detected type " + detected.Name
+	}
+	if t := ByMimeType(declaredType); t != nil && !t.Compatible(detected) {
+		return "content type " + declaredType + " does not match the detected type " + detected.Name
+	}
+	return ""
+}
+
+/*
+ * Office Open XML documents are zip files whose first entry is normally
+ * [Content_Types].xml: inflate it to find out what kind of document it is,
+ * and whether it contains macros.
+ */
+func detectZip(head []byte) *Type {
+	const headerLength = 30
+	if len(head) < headerLength {
+		return ZIP
+	}
+	method := binary.LittleEndian.Uint16(head[8:10])
+	nameLength := int(binary.LittleEndian.Uint16(head[26:28]))
+	extraLength := int(binary.LittleEndian.Uint16(head[28:30]))
+	if len(head) < headerLength+nameLength+extraLength {
+		return ZIP
+	}
+	name := string(head[headerLength : headerLength+nameLength])
+	data := head[headerLength+nameLength+extraLength:]
+
+	var contentTypes []byte
+	switch {
+	case name != "[Content_Types].xml":
+		return ZIP
+	case method == 0:
+		contentTypes = data
+	case method == 8:
+		contentTypes, _ = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), SniffLength))
+	default:
+		return ZIP
+	}
+
+	contentTypes = bytes.ToLower(contentTypes)
+	macros := bytes.Contains(contentTypes, []byte("macroenabled")) || bytes.Contains(contentTypes, []byte("vbaproject"))
+	for _, candidate := range []struct {
+		markers []string
+		plain   *Type
+		macro   *Type
+	}{
+		{[]string{"wordprocessingml", "ms-word"}, DOCX, DOCM},
+		{[]string{"spreadsheetml", "ms-excel"}, XLSX, XLSM},
+		{[]string{"presentationml", "ms-powerpoint"}, PPTX, PPTM},
+	} {
+		for _, marker := range candidate.markers {
+			if bytes.Contains(contentTypes, []byte(marker)) {
+				if macros {
+					return candidate.macro
+				}
+				return candidate.plain
+			}
+		}
+	}
+	return ZIP
+}
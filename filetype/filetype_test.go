@@ -0,0 +1,132 @@
+package filetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * Builds an Office Open XML-like zip, with the given main content type
+ */
+func makeOfficeFile(t testing.TB, mainContentType string, macros bool) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	f, err := w.Create("[Content_Types].xml")
+	require.NoError(t, err)
+	f.Write([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`))
+	if macros {
+		f.Write([]byte(`<Default Extension="bin" ContentType="application/vnd.ms-office.vbaProject"/>`))
+	}
+	f.Write([]byte(`<Override PartName="/main.xml" ContentType="` + mainContentType + `"/></Types>`))
+	f, err = w.Create("main.xml")
+	require.NoError(t, err)
+	f.Write([]byte("<document/>"))
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDetect(t *testing.T) {
+	for expected, head := range map[*Type][]byte{
+		PDF:     []byte("%PDF-1.7\n..."),
+		PNG:     []byte("\x89PNG\r\n\x1a\n\x00\x00"),
+		JPEG:    []byte("\xff\xd8\xff\xe0\x00\x10JFIF"),
+		GIF:     []byte("GIF89a..."),
+		WEBP:    []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		EXE:     []byte("MZ\x90\x00\x03\x00"),
+		ELF:     []byte("\x7fELF\x02\x01\x01"),
+		OLE:     []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00\x00"),
+		SCRIPT:  []byte("#!/bin/sh\nrm -rf /\n"),
+		TEXT:    []byte("Just some text"),
+		HTML:    []byte("<html><body>hello</body></html>"),
+		UNKNOWN: []byte("\x00\x01\x02\x03\x04"),
+	} {
+		assert.Equal(t, expected, Detect(head), expected.Name)
+	}
+	assert.Equal(t, SCRIPT, Detect([]byte("\r\n@ECHO OFF\r\ndel C:\\")))
+}
+
+func TestDetect_Office(t *testing.T) {
+	word := "application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"
+	wordMacros := "application/vnd.ms-word.document.macroEnabled.main+xml"
+	excelMacros := "application/vnd.ms-excel.sheet.macroEnabled.main+xml"
+
+	assert.Equal(t, DOCX, Detect(makeOfficeFile(t, word, false)))
+	assert.Equal(t, DOCM, Detect(makeOfficeFile(t, wordMacros, true)))
+	assert.Equal(t, DOCM, Detect(makeOfficeFile(t, word, true)), "a vbaProject should be spotted even if not declared")
+	assert.Equal(t, XLSM, Detect(makeOfficeFile(t, excelMacros, true)))
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	f, _ := w.Create("readme.txt")
+	f.Write([]byte("not an office file"))
+	w.Close()
+	assert.Equal(t, ZIP, Detect(buf.Bytes()))
+
+	// Truncated headers
+	assert.Equal(t, ZIP, Detect([]byte("PK\x03\x04\x14\x00")))
+}
+
+func TestTypeIs(t *testing.T) {
+	assert.True(t, DOCM.Is("docm"))
+	assert.True(t, DOCM.Is("zip"))
+	assert.True(t, DOCM.Is("office-macro"))
+	assert.True(t, DOCM.Is("Document"))
+	assert.False(t, DOCX.Is("office-macro"))
+	assert.True(t, EXE.Is("executable"))
+	assert.False(t, PDF.Is("image"))
+}
+
+func TestMismatch(t *testing.T) {
+	assert.Empty(t, Mismatch(PDF, "application/pdf", "report.pdf"))
+	assert.Empty(t, Mismatch(PDF, "application/octet-stream", "report"))
+	assert.Empty(t, Mismatch(DOCX, "application/zip", "archive.zip"))
+	assert.Empty(t, Mismatch(ZIP, "", "report.docx"))
+	assert.Empty(t, Mismatch(TEXT, "text/plain", "script.js"))
+
+	assert.NotEmpty(t, Mismatch(EXE, "application/pdf", "report.pdf"))
+	assert.NotEmpty(t, Mismatch(EXE, "", "report.pdf"))
+	assert.NotEmpty(t, Mismatch(EXE, "application/pdf", "report"))
+	assert.NotEmpty(t, Mismatch(DOCM, "", "report.docx"))
+	assert.NotEmpty(t, Mismatch(TEXT, "image/png", "image.png"))
+}
+
+func TestByExtension(t *testing.T) {
+	assert.Equal(t, JPEG, ByExtension("photo.JPG"))
+	assert.Equal(t, EXE, ByExtension("setup.exe"))
+	assert.Nil(t, ByExtension("noextension"))
+	assert.Nil(t, ByExtension("file.unknownext"))
+}
+
+func TestKnown(t *testing.T) {
+	assert.True(t, Known("pdf"))
+	assert.True(t, Known("office-macro"))
+	assert.True(t, Known("unknown"))
+	assert.False(t, Known("pdx"))
+}
+
+/*
+ * Detect reads archive headers from untrusted files: whatever the bytes, it
+ * returns a type, and zip files stay zip-compatible
+ */
+func FuzzDetect(f *testing.F) {
+	f.Add(makeOfficeFile(f, "application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml", false))
+	f.Add(makeOfficeFile(f, "application/vnd.ms-excel.sheet.macroEnabled.main+xml", true))
+	f.Add([]byte("PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x13\x00\xff\xff[Content_Types].xml"))
+	f.Add([]byte("%PDF-1.7\n..."))
+	f.Add([]byte("\xef\xbb\xbf@ECHO OFF"))
+
+	f.Fuzz(func(t *testing.T, head []byte) {
+		detected := Detect(head)
+		if detected == nil {
+			t.Fatalf("No type detected for %q", head)
+		}
+		if bytes.HasPrefix(head, []byte("PK\x03\x04")) && !detected.Compatible(ZIP) {
+			t.Fatalf("Zip file detected as %s", detected)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ * A named application backend, with its own HTTP transport. Requests whose
+ * application URL (from the configuration or the X-Clammit-Backend header)
+ * has the same scheme and host as the backend URL will be sent through the
+ * backend transport, and therefore use its TLS settings.
+ *
+ * A backend URL can also point to a unix socket, e.g. unix:/tmp/app.sock.
+ */
+type Backend struct {
+	Name string
+	URL  *url.URL
+	// Time limit for the whole exchange with the backend, zero means none
+	Timeout   time.Duration
+	transport *http.Transport
+}
+
+/*
+ * Constructs a new backend. tlsConfig may be nil, in which case the Go
+ * defaults apply.
+ */
+func NewBackend(name string, backendURL *url.URL, tlsConfig *tls.Config) *Backend {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if backendURL.Scheme == "unix" {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", backendURL.Path)
+		}
+	}
+	return &Backend{
+		Name:      name,
+		URL:       backendURL,
+		transport: transport,
+	}
+}
+
+/*
+ * Returns true if the given application URL is served by this backend
+ */
+func (b *Backend) Matches(applicationURL *url.URL) bool {
+	if !strings.EqualFold(b.URL.Scheme, applicationURL.Scheme) {
+		return false
+	}
+	if b.URL.Scheme == "unix" {
+		return b.URL.Path == applicationURL.Path
+	}
+	return strings.EqualFold(b.URL.Host, applicationURL.Host)
+}
+
+/*
+ * Returns an HTTP client using the backend transport
+ */
+func (b *Backend) client() *http.Client {
+	return &http.Client{Transport: b.transport, Timeout: b.Timeout}
+}
+
+/*
+ * Checks the backend can be reached, by sending it a HEAD request. Any HTTP
+ * response will do: only connection and TLS errors are reported.
+ */
+func (b *Backend) Check(ctx context.Context) error {
+	checkURL := *b.URL
+	if checkURL.Scheme == "unix" {
+		checkURL = url.URL{Scheme: "http", Host: "x", Path: "/"}
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -48,13 +48,14 @@ type BodyHolder interface {
 
 /*
  * Constructs a local copy of the request body. Depending on contentLength, it
- * will be either in memory or on disk. If contentLength is 0 (i.e. chunked
- * transfer) the body will be saved to disk. Be aware that the input will be
- * read to construct the BodyHolder, so you will not be able to perform any
- * more operations on it afterwards and you should Close() it (if possible).
+ * will be either in memory or on disk. If contentLength is unknown (0 or -1,
+ * i.e. chunked transfer) the body will be saved to disk. Be aware that the
+ * input will be read to construct the BodyHolder, so you will not be able to
+ * perform any more operations on it afterwards and you should Close() it (if
+ * possible).
  */
 func NewBodyHolder(input io.Reader, contentLength int64, maxContentLength int64) (BodyHolder, error) {
-	if contentLength == 0 || contentLength > maxContentLength {
+	if contentLength <= 0 || contentLength > maxContentLength {
 		return newFileBodyHolder(input)
 	} else {
 		return multireader.New(input, contentLength)
@@ -3,6 +3,12 @@ package forwarder
 import (
 	"bytes"
 	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -65,3 +71,58 @@ func TestMemoryBodyHolder(t *testing.T) {
 		t.Error("ReadCloser.Close() returned unexpected error:", err)
 	}
 }
+
+/*
+ * Whatever the declared length, and whether the body is chunked, the
+ * application receives exactly the bytes the interceptor scanned, or nothing
+ */
+func FuzzForwarder_ContentLength(f *testing.F) {
+	f.Add([]byte("This is a brown fox, doggy"), int64(26), false)
+	f.Add([]byte("This is a brown fox, doggy"), int64(10), false)
+	f.Add([]byte("This is a brown fox, doggy"), int64(100), false)
+	f.Add([]byte("This is a brown fox, doggy"), int64(5000), false)
+	f.Add([]byte("This is a brown fox, doggy"), int64(26), true)
+	f.Add([]byte{}, int64(-1), true)
+
+	var forwarded []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+	tsURL, _ := url.Parse(ts.URL)
+
+	f.Fuzz(func(t *testing.T, body []byte, contentLength int64, chunked bool) {
+		var scanned []byte
+		interceptor := testInterceptor(func(w http.ResponseWriter, req *http.Request, body io.Reader) bool {
+			scanned, _ = io.ReadAll(body)
+			return false
+		})
+		var logs bytes.Buffer
+		fw := NewForwarder(tsURL, 1000, interceptor)
+		fw.SetLogger(log.New(&logs, "", 0), false)
+
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+		if chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		forwarded = nil
+		w := NewTestResponseWriter()
+		fw.HandleRequest(w, req)
+
+		if strings.Contains(logs.String(), "ERROR") {
+			t.Fatalf("Forwarder panicked: %s", logs.String())
+		}
+		if w.StatusCode != 200 {
+			if forwarded != nil {
+				t.Fatalf("Request refused with status %d, but forwarded", w.StatusCode)
+			}
+			return
+		}
+		if !bytes.Equal(scanned, body) || !bytes.Equal(forwarded, body) {
+			t.Fatalf("Body %q, scanned %q, forwarded %q", body, scanned, forwarded)
+		}
+	})
+}
@@ -10,6 +10,8 @@
 package forwarder
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -39,6 +41,32 @@ type Interceptor interface {
 	Handle(w http.ResponseWriter, req *http.Request, body io.Reader) bool
 }
 
+/*
+ * Optionally implemented by an Interceptor, to write the responses of the
+ * requests the Forwarder fails: a *LimitError for the requests over the body
+ * limit, an *UpstreamError when the application cannot be reached, and any
+ * other error for internal failures. Otherwise, the Forwarder answers with a
+ * 413, a 502 or a 500.
+ */
+type ErrorResponder interface {
+	RespondOnError(w http.ResponseWriter, req *http.Request, err error)
+}
+
+/*
+ * The error of a request that could not be forwarded to the application
+ */
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return "unable to forward the request: " + e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
 /*
  * Forwarder implementation
  */
@@ -48,6 +76,8 @@ type Forwarder struct {
 	logger                 *log.Logger
 	debug                  bool
 	contentMemoryThreshold int64
+	backends               []*Backend
+	routes                 Routes
 }
 
 /*
@@ -74,17 +104,33 @@ func (f *Forwarder) SetLogger(logger *log.Logger, debug bool) {
 	f.debug = debug
 }
 
+/*
+ * Sets the known backends. Requests to an application URL that matches one
+ * of them will use its transport (and TLS settings).
+ */
+func (f *Forwarder) SetBackends(backends []*Backend) {
+	f.backends = backends
+}
+
+/*
+ * Sets the routing table. A request matching a route with a backend will be
+ * forwarded there, regardless of the application URL or X-Clammit-Backend.
+ */
+func (f *Forwarder) SetRoutes(routes Routes) {
+	f.routes = routes
+}
+
 /*
  * Handles the given HTTP request.
  */
 func (f *Forwarder) HandleRequest(w http.ResponseWriter, req *http.Request) {
-	// Catch panics and return a 500 Internal Server Error
+	// Catch panics and return an internal error
 	defer func() {
 		if err := recover(); err != nil {
 			f.logger.Printf("ERROR %s", err)
 
-			// Return 500 response
-			http.Error(w, "Internal Server Error", 500)
+			// Return 500 response, or the interceptor's
+			f.respondOnError(w, req, fmt.Errorf("panic: %v", err))
 		}
 	}()
 
@@ -92,13 +138,42 @@ func (f *Forwarder) HandleRequest(w http.ResponseWriter, req *http.Request) {
 		f.logger.Println("Received scan request")
 	}
 
+	req = f.routes.MatchRequest(req)
+	if route := RouteFromRequest(req); route != nil && f.debug {
+		f.logger.Printf("Request matches route %s", route.Name)
+	}
+
+	//
+	// Enforce the body limits, if the interceptor has some
+	//
+	var input io.Reader = req.Body
+	if limiter, ok := f.interceptor.(BodyLimiter); ok {
+		if max := limiter.BodyLimit(req); max > 0 {
+			if req.ContentLength > max {
+				f.logger.Printf("Request refused: body of %d bytes, max-body-size of %d exceeded", req.ContentLength, max)
+				f.respondOnError(w, req, &LimitError{Limit: "max-body-size", Value: max})
+				return
+			}
+			input = NewLimitReader(req.Body, max, &LimitError{Limit: "max-body-size", Value: max})
+		}
+	}
+	if checker, ok := f.interceptor.(BodyChecker); ok {
+		input = checker.CheckBody(req, input)
+	}
+
 	//
 	// Save the request body
 	//
-	bodyHolder, err := NewBodyHolder(req.Body, req.ContentLength, f.contentMemoryThreshold)
+	bodyHolder, err := NewBodyHolder(input, req.ContentLength, f.contentMemoryThreshold)
 	if err != nil {
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			f.logger.Printf("Request refused: %s", limitErr.Error())
+			f.respondOnError(w, req, limitErr)
+			return
+		}
 		f.logger.Println("Unable to save body to local store:", err.Error())
-		http.Error(w, "Internal Server Error", 500)
+		f.respondOnError(w, req, err)
 		return
 	}
 	defer bodyHolder.Close()
@@ -130,12 +205,12 @@ func (f *Forwarder) HandleRequest(w http.ResponseWriter, req *http.Request) {
 	resp, err := f.forwardRequest(req, body, bodyHolder.ContentLength())
 	if err != nil {
 		f.logger.Printf("Failed to forward request: %s", err.Error())
-		http.Error(w, "Bad Gateway", 502)
+		f.respondOnError(w, req, &UpstreamError{Err: err})
 		return
 	}
 	if resp == nil {
 		f.logger.Printf("Failed to forward request: no response at all")
-		http.Error(w, "Bad Gateway", 502)
+		f.respondOnError(w, req, &UpstreamError{Err: errors.New("no response at all")})
 		return
 	}
 	if resp.Body != nil {
@@ -157,6 +232,27 @@ func (f *Forwarder) HandleRequest(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+/*
+ * Writes the response of a request the forwarder failed, through the
+ * interceptor if it is an ErrorResponder
+ */
+func (f *Forwarder) respondOnError(w http.ResponseWriter, req *http.Request, err error) {
+	if responder, ok := f.interceptor.(ErrorResponder); ok {
+		responder.RespondOnError(w, req, err)
+		return
+	}
+	var limitErr *LimitError
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &limitErr):
+		http.Error(w, "Request Entity Too Large", 413)
+	case errors.As(err, &upstreamErr):
+		http.Error(w, "Bad Gateway", 502)
+	default:
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
 /*
  * Forwards the request to the application. This function tries to preserve as much
  * as possible of the request - headers and body.
@@ -187,31 +283,54 @@ func (f *Forwarder) forwardRequest(req *http.Request, body io.Reader, contentLen
 	return client.Do(freq)
 }
 
-func (f *Forwarder) getApplicationURL(req *http.Request) *url.URL {
+/*
+ * Returns the URL to forward the request to and, if known, its backend.
+ *
+ * In order of precedence: the backend of the matching route, the configured
+ * application URL, or the URL in the X-Clammit-Backend header.
+ */
+func (f *Forwarder) getApplicationURL(req *http.Request) (*url.URL, *Backend) {
+	// Use the route backend if there is one
+	if route := RouteFromRequest(req); route != nil && route.Backend != nil {
+		return route.Backend.URL, route.Backend
+	}
+
 	// Return the applicationURL if it's set
 	if f.applicationURL != nil && f.applicationURL.String() != "" {
-		return f.applicationURL
+		return f.applicationURL, f.getBackend(f.applicationURL)
 	}
 
 	// Otherwise check for the X-Clammit-Backend header
 	url, err := url.Parse(req.Header.Get(applicationUrlHeader))
 	if err != nil {
 		f.logger.Panicf("Error parsing application URL in %s: %s (%s)", applicationUrlHeader, err.Error(), req.Header.Get(applicationUrlHeader))
-		return nil
+		return nil, nil
 	}
 
 	if len(url.String()) == 0 {
 		f.logger.Panicf("No application URL available - header %s is blank", applicationUrlHeader)
 	}
 
-	return url
+	return url, f.getBackend(url)
+}
+
+/*
+ * Returns the backend serving the given application URL, or nil
+ */
+func (f *Forwarder) getBackend(applicationURL *url.URL) *Backend {
+	for _, backend := range f.backends {
+		if backend.Matches(applicationURL) {
+			return backend
+		}
+	}
+	return nil
 }
 
 /*
  * Gets an appropriate net/http.Client. I'm not sure if this is necessary, but it forces the issue.
  */
 func (f *Forwarder) getClient(req *http.Request) (*http.Client, *url.URL) {
-	applicationURL := f.getApplicationURL(req)
+	applicationURL, backend := f.getApplicationURL(req)
 	url := &url.URL{
 		Scheme:   applicationURL.Scheme,
 		Opaque:   applicationURL.Opaque,
@@ -225,6 +344,9 @@ func (f *Forwarder) getClient(req *http.Request) (*http.Client, *url.URL) {
 		f.logger.Printf("Forwarding to unix socket %s", applicationURL.Path)
 		url.Scheme = "http"
 		url.Host = "x"
+		if backend != nil {
+			return backend.client(), url
+		}
 		jar, _ := cookiejar.New(nil)
 		return &http.Client{
 			Jar: jar,
@@ -236,6 +358,9 @@ func (f *Forwarder) getClient(req *http.Request) (*http.Client, *url.URL) {
 		}, url
 	} else {
 		f.logger.Printf("Forwarding to %s", applicationURL.String())
+		if backend != nil {
+			return backend.client(), url
+		}
 		return &http.Client{}, url
 	}
 }
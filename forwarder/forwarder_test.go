@@ -2,6 +2,9 @@ package forwarder
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -286,3 +289,58 @@ func TestForwardingWithRedirectGET(t *testing.T) {
 	require.Equal(t, 302, w.StatusCode)
 	assert.Equal(t, "https://localhost:12345/foobar", w.Header().Get("Location"))
 }
+
+func TestForwardingToTLSBackend(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte("secure"))
+	}))
+	defer ts.Close()
+	tsURL, _ := url.Parse(ts.URL)
+
+	// Without a backend, the test server certificate is not trusted
+	fw := NewForwarder(tsURL, 10000, nil)
+	req, _ := http.NewRequest("POST", "http://localhost:99999/bar", strings.NewReader("request"))
+	w := NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+
+	assert.Equal(t, 502, w.StatusCode)
+
+	// With a backend trusting the certificate
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	backendURL, _ := url.Parse(ts.URL)
+	fw.SetBackends([]*Backend{NewBackend("secure", backendURL, &tls.Config{RootCAs: pool})})
+
+	req, _ = http.NewRequest("POST", "http://localhost:99999/bar", strings.NewReader("request"))
+	w = NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+
+	assert.Equal(t, 202, w.StatusCode)
+	assert.Equal(t, "secure", w.Body.String())
+}
+
+func TestBackendMatches(t *testing.T) {
+	backendURL, _ := url.Parse("https://app.example.com:8443/prefix")
+	backend := NewBackend("app", backendURL, nil)
+
+	same, _ := url.Parse("https://APP.example.com:8443/other")
+	otherScheme, _ := url.Parse("http://app.example.com:8443/")
+	otherPort, _ := url.Parse("https://app.example.com/")
+
+	assert.True(t, backend.Matches(same))
+	assert.False(t, backend.Matches(otherScheme))
+	assert.False(t, backend.Matches(otherPort))
+}
+
+func TestBackendCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+	}))
+	backendURL, _ := url.Parse(server.URL)
+	backend := NewBackend("app", backendURL, nil)
+	assert.NoError(t, backend.Check(context.Background()), "any response will do")
+
+	server.Close()
+	assert.Error(t, backend.Check(context.Background()))
+}
@@ -0,0 +1,154 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+/*
+ * Optionally implemented by an Interceptor, to limit the size of the request
+ * bodies the Forwarder will store. Requests over the limit are answered with
+ * a 413 before their body is read or, if their length is unknown, as soon as
+ * the limit is crossed. Zero means unlimited.
+ */
+type BodyLimiter interface {
+	BodyLimit(req *http.Request) int64
+}
+
+/*
+ * The error returned when a size limit is exceeded. Limit is the name of the
+ * limit, as in the configuration file, and Value its value.
+ */
+type LimitError struct {
+	Limit string
+	Value int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %d exceeded", e.Limit, e.Value)
+}
+
+/*
+ * Returns a reader that fails with err once more than limit bytes have been
+ * read. The bytes beyond the limit are discarded, so that consumers never
+ * see them.
+ */
+func NewLimitReader(reader io.Reader, limit int64, err error) io.Reader {
+	return &limitReader{reader: reader, limit: limit, err: err}
+}
+
+type limitReader struct {
+	reader io.Reader
+	limit  int64
+	count  int64
+	err    error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.count > l.limit {
+		return 0, l.err
+	}
+	n, err := l.reader.Read(p)
+	l.count += int64(n)
+	if l.count > l.limit {
+		if n -= int(l.count - l.limit); n < 0 {
+			n = 0
+		}
+		return n, l.err
+	}
+	return n, err
+}
+
+/*
+ * Optionally implemented by an Interceptor, to check the request bodies while
+ * the Forwarder stores them, e.g. with NewMultipartLimitReader: the reader
+ * returned fails with a *LimitError as soon as a limit is crossed, before the
+ * rest of the body is stored.
+ */
+type BodyChecker interface {
+	CheckBody(req *http.Request, body io.Reader) io.Reader
+}
+
+/*
+ * Returns a reader that fails with a *LimitError once the multipart body it
+ * reads has more than maxParts parts, or a part larger than maxPartSize
+ * bytes. Zero means unlimited. Only the parts of the body itself are checked,
+ * not those nested in them, and malformed bodies are passed through.
+ *
+ * The body is parsed in the background, as it is read.
+ */
+func NewMultipartLimitReader(reader io.Reader, boundary string, maxParts int, maxPartSize int64) io.Reader {
+	pr, pw := io.Pipe()
+	m := &multipartLimitReader{reader: reader, parser: pw, result: make(chan error, 1)}
+	go func() {
+		m.result <- checkMultipart(pr, boundary, maxParts, maxPartSize)
+	}()
+	return m
+}
+
+type multipartLimitReader struct {
+	reader io.Reader
+	// Receives the bytes read, until the parser finds a limit crossed
+	parser *io.PipeWriter
+	// The limit crossed, if any, once the parser is done
+	result chan error
+	err    error
+}
+
+func (m *multipartLimitReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.reader.Read(p)
+	if n > 0 {
+		if _, limitErr := m.parser.Write(p[:n]); limitErr != nil {
+			m.err = limitErr
+			return 0, limitErr
+		}
+	}
+	if err != nil {
+		// The parser may still be working on the last bytes
+		m.parser.CloseWithError(err)
+		if limitErr := <-m.result; limitErr != nil {
+			err = limitErr
+		}
+		m.err = err
+	}
+	return n, err
+}
+
+/*
+ * Parses the multipart body and returns the *LimitError of the limit crossed,
+ * if any, stopping the reader as soon as it is
+ */
+func checkMultipart(body *io.PipeReader, boundary string, maxParts int, maxPartSize int64) error {
+	// Once done, the rest of the body is of no interest
+	defer io.Copy(io.Discard, body)
+	reader := multipart.NewReader(body, boundary)
+	for count := 1; ; count++ {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil
+		}
+		if maxParts > 0 && count > maxParts {
+			limitErr := &LimitError{Limit: "max-parts", Value: int64(maxParts)}
+			body.CloseWithError(limitErr)
+			return limitErr
+		}
+		var partReader io.Reader = part
+		if maxPartSize > 0 {
+			partReader = NewLimitReader(part, maxPartSize, &LimitError{Limit: "max-part-size", Value: maxPartSize})
+		}
+		if _, err := io.Copy(io.Discard, partReader); err != nil {
+			var limitErr *LimitError
+			if errors.As(err, &limitErr) {
+				body.CloseWithError(limitErr)
+				return limitErr
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type limitingInterceptor int64
+
+func (i limitingInterceptor) Handle(w http.ResponseWriter, req *http.Request, body io.Reader) bool {
+	return false
+}
+
+func (i limitingInterceptor) BodyLimit(req *http.Request) int64 {
+	return int64(i)
+}
+
+/*
+ * Fails the test if read
+ */
+type unreadableBody struct {
+	t *testing.T
+}
+
+func (b unreadableBody) Read(p []byte) (int, error) {
+	b.t.Fatal("The body should not have been read")
+	return 0, io.EOF
+}
+
+func TestLimitReader(t *testing.T) {
+	limitErr := &LimitError{Limit: "max-body-size", Value: 5}
+
+	data, err := io.ReadAll(NewLimitReader(strings.NewReader("12345"), 5, limitErr))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	data, err = io.ReadAll(NewLimitReader(strings.NewReader("123456789"), 5, limitErr))
+	assert.Equal(t, limitErr, err)
+	assert.Equal(t, "12345", string(data), "bytes beyond the limit should be discarded")
+	assert.Equal(t, "max-body-size of 5 exceeded", err.Error())
+}
+
+func TestForwardingWithBodyLimit(t *testing.T) {
+	forwarded := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(202)
+	}))
+	defer ts.Close()
+	tsURL, _ := url.Parse(ts.URL)
+
+	fw := NewForwarder(tsURL, 5, limitingInterceptor(10))
+
+	// Known length: refused before reading the body
+	req, _ := http.NewRequest("POST", "http://localhost:99999/bar", unreadableBody{t})
+	req.ContentLength = 100
+	w := NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 413, w.StatusCode)
+
+	// Unknown length: refused while storing the body
+	req, _ = http.NewRequest("POST", "http://localhost:99999/bar", io.MultiReader(strings.NewReader("more than ten bytes")))
+	req.ContentLength = -1
+	w = NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 413, w.StatusCode)
+
+	assert.Equal(t, 0, forwarded)
+
+	// Unknown length, within limits
+	req, _ = http.NewRequest("POST", "http://localhost:99999/bar", io.MultiReader(strings.NewReader("tiny")))
+	req.ContentLength = -1
+	w = NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 202, w.StatusCode)
+	assert.Equal(t, 1, forwarded)
+}
+
+func TestLimitError(t *testing.T) {
+	var err error = &LimitError{Limit: "max-parts", Value: 3}
+	var limitErr *LimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, "max-parts", limitErr.Limit)
+}
+
+/*
+ * Counts the bytes read
+ */
+type countingReader struct {
+	reader io.Reader
+	count  int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += n
+	return n, err
+}
+
+func TestMultipartLimitReader(t *testing.T) {
+	makeBody := func(parts ...string) ([]byte, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for i, content := range parts {
+			writer.WriteField(fmt.Sprintf("field%d", i), content)
+		}
+		writer.Close()
+		return body.Bytes(), writer.Boundary()
+	}
+	large := strings.Repeat("x", 1024*1024)
+
+	// Within limits, the body is read as is
+	body, boundary := makeBody("one", "two")
+	data, err := io.ReadAll(NewMultipartLimitReader(bytes.NewReader(body), boundary, 2, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, body, data)
+
+	// Too many parts: refused before the rest of the body is read
+	body, boundary = makeBody("one", "two", "three", large)
+	counter := &countingReader{reader: bytes.NewReader(body)}
+	_, err = io.ReadAll(NewMultipartLimitReader(counter, boundary, 2, 0))
+	assert.Equal(t, &LimitError{Limit: "max-parts", Value: 2}, err)
+	assert.Less(t, counter.count, len(body)/2)
+
+	// A part too large
+	body, boundary = makeBody("one", large, "three")
+	counter = &countingReader{reader: bytes.NewReader(body)}
+	_, err = io.ReadAll(NewMultipartLimitReader(counter, boundary, 0, 1000))
+	assert.Equal(t, &LimitError{Limit: "max-part-size", Value: 1000}, err)
+	assert.Less(t, counter.count, len(body)/2)
+
+	// Malformed bodies are passed through, as are the read errors
+	data, err = io.ReadAll(NewMultipartLimitReader(strings.NewReader("not multipart"), "xyz", 1, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, "not multipart", string(data))
+	limitErr := &LimitError{Limit: "max-body-size", Value: 5}
+	_, err = io.ReadAll(NewMultipartLimitReader(NewLimitReader(strings.NewReader("123456789"), 5, limitErr), "xyz", 1, 1))
+	assert.Equal(t, limitErr, err)
+}
@@ -0,0 +1,158 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+ * A route maps requests to a backend, according to their path, host name and
+ * method. Empty criteria match any request.
+ */
+type Route struct {
+	Name string
+	// Path prefix, e.g. "/documents" matches "/documents" and "/documents/1"
+	// but not "/documentsfoo". A trailing slash forces a directory match.
+	PathPrefix string
+	// Host names, without port. "*.example.com" matches any subdomain.
+	Hosts []string
+	// HTTP methods
+	Methods []string
+	// Where to forward matching requests. May be nil, in which case the
+	// forwarder falls back to the application URL or X-Clammit-Backend.
+	Backend *Backend
+}
+
+/*
+ * A routing table. Use NewRoutes() to construct it, so that the most
+ * specific routes are tried first.
+ */
+type Routes []*Route
+
+/*
+ * Constructs a routing table, ordered from the most specific route (longest
+ * path prefix, then with hosts, then with methods) to the least specific.
+ * Routes with the same specificity are ordered by name.
+ */
+func NewRoutes(routes []*Route) Routes {
+	sorted := make(Routes, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		if (len(a.Hosts) > 0) != (len(b.Hosts) > 0) {
+			return len(a.Hosts) > 0
+		}
+		if (len(a.Methods) > 0) != (len(b.Methods) > 0) {
+			return len(a.Methods) > 0
+		}
+		return a.Name < b.Name
+	})
+	return sorted
+}
+
+/*
+ * Returns the first route matching the request, or nil
+ */
+func (routes Routes) Match(req *http.Request) *Route {
+	for _, route := range routes {
+		if route.Matches(req) {
+			return route
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the request carrying the first route it matches, if any, for
+ * RouteFromRequest. A request carrying a route already is returned as is.
+ */
+func (routes Routes) MatchRequest(req *http.Request) *http.Request {
+	if RouteFromRequest(req) != nil {
+		return req
+	}
+	if route := routes.Match(req); route != nil {
+		return withRoute(req, route)
+	}
+	return req
+}
+
+type routeContextKey struct{}
+
+/*
+ * Returns the route matched by the forwarder for this request, or nil. It is
+ * available to the interceptor, to apply route-specific behaviour.
+ */
+func RouteFromRequest(req *http.Request) *Route {
+	route, _ := req.Context().Value(routeContextKey{}).(*Route)
+	return route
+}
+
+/*
+ * Returns a shallow copy of the request, carrying the given route
+ */
+func withRoute(req *http.Request, route *Route) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeContextKey{}, route))
+}
+
+/*
+ * Returns true if the route matches the request
+ */
+func (r *Route) Matches(req *http.Request) bool {
+	return r.matchesPath(req.URL.Path) && r.matchesHost(req.Host) && r.matchesMethod(req.Method)
+}
+
+func (r *Route) matchesPath(path string) bool {
+	return MatchPathPrefix(r.PathPrefix, path)
+}
+
+/*
+ * Returns true if path starts with prefix, on a path segment boundary:
+ * "/documents" matches "/documents" and "/documents/1" but not
+ * "/documentsfoo". A prefix with a trailing slash only matches below it.
+ */
+func MatchPathPrefix(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+func (r *Route) matchesHost(host string) bool {
+	if len(r.Hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, candidate := range r.Hosts {
+		if strings.HasPrefix(candidate, "*.") {
+			if len(host) > len(candidate)-1 && strings.EqualFold(host[len(host)-len(candidate)+1:], candidate[1:]) {
+				return true
+			}
+		} else if strings.EqualFold(host, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Route) matchesMethod(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, candidate := range r.Methods {
+		if strings.EqualFold(method, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRouteRequest(method, target, host string) *http.Request {
+	req, _ := http.NewRequest(method, target, nil)
+	if host != "" {
+		req.Host = host
+	}
+	return req
+}
+
+func TestRouteMatches(t *testing.T) {
+	route := &Route{
+		Name:       "docs",
+		PathPrefix: "/documents",
+		Hosts:      []string{"docs.example.com", "*.docs.example.org"},
+		Methods:    []string{"POST", "put"},
+	}
+
+	assert.True(t, route.Matches(newRouteRequest("POST", "http://docs.example.com/documents", "")))
+	assert.True(t, route.Matches(newRouteRequest("PUT", "http://docs.example.com:8080/documents/1", "")))
+	assert.True(t, route.Matches(newRouteRequest("POST", "http://eu.docs.example.org/documents", "")))
+
+	assert.False(t, route.Matches(newRouteRequest("GET", "http://docs.example.com/documents", "")))
+	assert.False(t, route.Matches(newRouteRequest("POST", "http://docs.example.com/documentsfoo", "")))
+	assert.False(t, route.Matches(newRouteRequest("POST", "http://other.example.com/documents", "")))
+	assert.False(t, route.Matches(newRouteRequest("POST", "http://docs.example.org/documents", "")))
+
+	assert.True(t, (&Route{PathPrefix: "/files/"}).Matches(newRouteRequest("GET", "http://x/files/foo", "")))
+	assert.False(t, (&Route{PathPrefix: "/files/"}).Matches(newRouteRequest("GET", "http://x/files", "")))
+	assert.True(t, (&Route{}).Matches(newRouteRequest("GET", "http://x/anything", "")))
+}
+
+func TestRoutesOrder(t *testing.T) {
+	routes := NewRoutes([]*Route{
+		{Name: "catchall"},
+		{Name: "docs", PathPrefix: "/documents"},
+		{Name: "docs-upload", PathPrefix: "/documents", Methods: []string{"POST"}},
+		{Name: "docs-host", PathPrefix: "/documents", Hosts: []string{"docs.example.com"}},
+		{Name: "avatars", PathPrefix: "/documents/avatars"},
+	})
+
+	match := func(method, target string) string {
+		if route := routes.Match(newRouteRequest(method, target, "")); route != nil {
+			return route.Name
+		}
+		return ""
+	}
+
+	assert.Equal(t, "avatars", match("POST", "http://docs.example.com/documents/avatars/1"))
+	assert.Equal(t, "docs-host", match("POST", "http://docs.example.com/documents/1"))
+	assert.Equal(t, "docs-upload", match("POST", "http://www.example.com/documents/1"))
+	assert.Equal(t, "docs", match("GET", "http://www.example.com/documents/1"))
+	assert.Equal(t, "catchall", match("GET", "http://www.example.com/"))
+
+	assert.Nil(t, Routes(nil).Match(newRouteRequest("GET", "http://x/", "")))
+}
+
+func TestRoutesMatchRequest(t *testing.T) {
+	routes := NewRoutes([]*Route{{Name: "docs", PathPrefix: "/documents"}})
+
+	req := routes.MatchRequest(newRouteRequest("POST", "http://x/documents/1", ""))
+	assert.Equal(t, "docs", RouteFromRequest(req).Name)
+	// Matched once
+	assert.Same(t, req, NewRoutes([]*Route{{Name: "other"}}).MatchRequest(req))
+
+	assert.Nil(t, RouteFromRequest(routes.MatchRequest(newRouteRequest("POST", "http://x/", ""))))
+}
+
+func TestRouteForwarding(t *testing.T) {
+	documents := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(201)
+		w.Write([]byte("documents"))
+	}))
+	defer documents.Close()
+	documentsURL, _ := url.Parse(documents.URL)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(201)
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte("fallback"))
+	}))
+	defer fallback.Close()
+	fallbackURL, _ := url.Parse(fallback.URL)
+
+	slowBackend := NewBackend("slow", slowURL, nil)
+	slowBackend.Timeout = 50 * time.Millisecond
+
+	fw := NewForwarder(fallbackURL, 10000, nil)
+	fw.SetRoutes(NewRoutes([]*Route{
+		{Name: "documents", PathPrefix: "/documents", Backend: NewBackend("documents", documentsURL, nil)},
+		{Name: "slow", PathPrefix: "/slow", Backend: slowBackend},
+	}))
+
+	req, _ := http.NewRequest("POST", "http://localhost:99999/documents/1", strings.NewReader("request"))
+	w := NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 201, w.StatusCode)
+	assert.Equal(t, "documents", w.Body.String())
+
+	req, _ = http.NewRequest("POST", "http://localhost:99999/other", strings.NewReader("request"))
+	w = NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 202, w.StatusCode)
+	assert.Equal(t, "fallback", w.Body.String())
+
+	req, _ = http.NewRequest("POST", "http://localhost:99999/slow", strings.NewReader("request"))
+	w = NewTestResponseWriter()
+	fw.HandleRequest(w, req)
+	assert.Equal(t, 502, w.StatusCode)
+}
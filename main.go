@@ -7,8 +7,11 @@ package main
 
 import (
 	"bytes"
+	"clammit/filetype"
 	"clammit/forwarder"
-	"clammit/scanner"
+	"clammit/metrics"
+	"clammit/tlsconfig"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -21,7 +24,9 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"gopkg.in/gcfg.v1"
 )
@@ -33,7 +38,11 @@ var version = "master"
 
 // Configuration structure, designed for gcfg
 type Config struct {
-	App ApplicationConfig `gcfg:"application"`
+	App      ApplicationConfig         `gcfg:"application"`
+	Backends map[string]*BackendConfig `gcfg:"backend"`
+	Routes   map[string]*RouteConfig   `gcfg:"route"`
+	Policies map[string]*PolicyConfig  `gcfg:"policy"`
+	Outcomes map[string]*OutcomeConfig `gcfg:"outcome"`
 }
 
 type ApplicationConfig struct {
@@ -54,6 +63,21 @@ type ApplicationConfig struct {
 	// For example:
 	//   SocketPerms: 0766
 	SocketPerms string `gcfg:"unix-socket-perms"`
+	// If set, the /clammit endpoints (info, scan, health, metrics and test
+	// pages) are served on this address instead, in the same format as
+	// Listen, and the listen address forwards every path to the application.
+	AdminListen string `gcfg:"admin-listen"`
+	// If set, clammit will terminate TLS on the listen address using this
+	// PEM certificate and key. Both are reloaded when they change on disk.
+	TLSCertFile string `gcfg:"tls-cert-file"`
+	TLSKeyFile  string `gcfg:"tls-key-file"`
+	// PEM bundle of the CAs used to verify client certificates (mTLS)
+	TLSClientCAFile string `gcfg:"tls-client-ca-file"`
+	// Client certificate policy: none, request, verify-if-given or require.
+	// Defaults to require when tls-client-ca-file is set.
+	TLSClientAuth string `gcfg:"tls-client-auth"`
+	// Minimum TLS version accepted on the listener (1.0, 1.1, 1.2 or 1.3)
+	TLSMinVersion string `gcfg:"tls-min-version"`
 	// The URL of the application that Clammit is proxying. Generally, this will
 	// be the base URL (http://host:port/), but you can also add a path prefix
 	// if needed (http://host:port/prefix)
@@ -66,9 +90,83 @@ type ApplicationConfig struct {
 	ClamdURL string `gcfg:"clamd-url"`
 	// The HTTP status code to return when a virus is found
 	VirusStatusCode int `gcfg:"virus-status-code"`
+	// The HTTP status code to return when a file type is not allowed by the
+	// scan policy
+	PolicyStatusCode int `gcfg:"policy-status-code"`
 	// If the body content-length exceeds this value, it will be written to
 	// disk. Below it, we'll hold the whole body in memory to improve speed.
 	ContentMemoryThreshold int64 `gcfg:"content-memory-threshold"`
+	// Maximum request body size in bytes, enforced while the body is read.
+	// Larger requests are refused with a 413. Zero means unlimited.
+	MaxBodySize int64 `gcfg:"max-body-size"`
+	// Maximum size in bytes of each multipart part. Zero means unlimited.
+	MaxPartSize int64 `gcfg:"max-part-size"`
+	// Maximum number of multipart parts. Zero means unlimited.
+	MaxParts int `gcfg:"max-parts"`
+	// Maximum size in bytes of the urlencoded and JSON bodies, which are held
+	// in memory to extract their contents. Larger ones are only scanned as a
+	// whole. Zero means unlimited.
+	MaxExtractSize int64 `gcfg:"max-extract-size"`
+	// Decompression bomb limits, for the bodies and parts decoded to be
+	// scanned (Content-Encoding gzip, deflate or br, and base64 parts): the
+	// maximum decoded size in bytes, and the maximum ratio of the decoded to
+	// the encoded size. Zero means unlimited.
+	MaxDecodedSize int64 `gcfg:"max-decoded-size"`
+	MaxDecodeRatio int   `gcfg:"max-decode-ratio"`
+	// If true, detections are logged, audited and counted, but do not block
+	// the requests: they are forwarded with the X-Clammit-Result and
+	// X-Clammit-Signature headers. Routes can also be monitored one by one.
+	Monitor bool `gcfg:"monitor"`
+	// If set, the requests forwarded to the application carry the scan
+	// verdict in X-Clammit headers, signed with this key (HMAC-SHA256)
+	VerdictHMACKey string `gcfg:"verdict-hmac-key"`
+	// Directory of the templates of the responses refusing requests, and the
+	// support contact they can mention
+	ResponseTemplates string `gcfg:"response-templates"`
+	SupportContact    string `gcfg:"support-contact"`
+	// Number of multipart parts of a request scanned at the same time, each
+	// spooled first. Up to 1, parts are scanned one after another.
+	ScanParallelism int `gcfg:"scan-parallelism"`
+	// Maximum number of requests being scanned at the same time. Zero means
+	// unlimited.
+	MaxConcurrentScans int `gcfg:"max-concurrent-scans"`
+	// Maximum bytes held in memory, and spooled to disk, by the requests
+	// being scanned. Zero means unlimited.
+	MaxMemoryBytes int64 `gcfg:"max-memory-bytes"`
+	MaxSpoolBytes  int64 `gcfg:"max-spool-bytes"`
+	// Number of requests that can wait for the limits above, and for how long
+	// (as a Go duration, e.g. 5s). Requests that cannot wait are refused with
+	// a 503.
+	AdmissionQueueSize int    `gcfg:"admission-queue-size"`
+	AdmissionTimeout   string `gcfg:"admission-timeout"`
+	// Seconds to advertise in the Retry-After header of 503 responses
+	RetryAfter int `gcfg:"retry-after"`
+	// Per-client rate limits, in requests and body bytes per second, and the
+	// bursts allowed above them. Zero means unlimited.
+	RateLimitRequests   float64 `gcfg:"rate-limit-requests"`
+	RateLimitBurst      float64 `gcfg:"rate-limit-burst"`
+	RateLimitBytes      float64 `gcfg:"rate-limit-bytes"`
+	RateLimitBytesBurst float64 `gcfg:"rate-limit-bytes-burst"`
+	// What identifies a client: "ip" (the default), "header:<name>" (e.g.
+	// header:X-Api-Key) or "route"
+	RateLimitKey string `gcfg:"rate-limit-key"`
+	// Maximum number of clients tracked by the rate limiter: beyond, the
+	// least recently seen are forgotten. Zero means unlimited.
+	RateLimitMaxKeys int `gcfg:"rate-limit-max-keys"`
+	// Addresses or networks of the reverse proxies whose X-Forwarded-For
+	// header is trusted to find the client address
+	TrustedProxies []string `gcfg:"trusted-proxy"`
+	// Credentials required for /clammit/scan, and for all the other /clammit
+	// endpoints except readyz: bearer tokens, htpasswd files with bcrypt
+	// hashes, and client certificate subjects (common name or distinguished
+	// name). Admin credentials are also accepted for scanning. Endpoints
+	// without credentials are open.
+	ScanTokens        []string `gcfg:"scan-token"`
+	ScanHtpasswdFile  string   `gcfg:"scan-htpasswd-file"`
+	ScanTLSSubjects   []string `gcfg:"scan-tls-subject"`
+	AdminTokens       []string `gcfg:"admin-token"`
+	AdminHtpasswdFile string   `gcfg:"admin-htpasswd-file"`
+	AdminTLSSubjects  []string `gcfg:"admin-tls-subject"`
 	// Log file name (default is to log to stdout)
 	Logfile string `gcfg:"log-file"`
 	// If true, clammit will expose a small test HTML page.
@@ -79,6 +177,121 @@ type ApplicationConfig struct {
 	NumThreads int `gcfg:"num-threads"`
 }
 
+// Configuration of a named application backend, e.g.:
+//
+//	[backend "documents"]
+//	url             = https://documents.internal:8443/
+//	tls-ca-file     = /etc/clammit/internal-ca.pem
+//	tls-cert-file   = /etc/clammit/client.pem
+//	tls-key-file    = /etc/clammit/client.key
+//
+// Requests forwarded to the same scheme and host as the backend URL, be it
+// from application-url or the X-Clammit-Backend header, use these settings.
+type BackendConfig struct {
+	// The backend base URL, e.g. https://host:port/ or unix:/path/to/socket
+	URL string `gcfg:"url"`
+	// Time limit for forwarding a request and reading the response, as a
+	// Go duration (e.g. 30s, 2m). Empty means no limit.
+	Timeout string `gcfg:"timeout"`
+	// PEM bundle of the CAs to trust when connecting to the backend
+	TLSCAFile string `gcfg:"tls-ca-file"`
+	// Client certificate and key to present to the backend (mTLS)
+	TLSCertFile string `gcfg:"tls-cert-file"`
+	TLSKeyFile  string `gcfg:"tls-key-file"`
+	// Overrides the server name used for SNI and certificate verification
+	TLSServerName string `gcfg:"tls-server-name"`
+	// Minimum TLS version (1.0, 1.1, 1.2 or 1.3)
+	TLSMinVersion string `gcfg:"tls-min-version"`
+	// Skips backend certificate verification. Only use this in development!
+	TLSInsecureSkipVerify bool `gcfg:"tls-insecure-skip-verify"`
+}
+
+// Configuration of a route, mapping requests to a named backend, e.g.:
+//
+//	[route "uploads"]
+//	path-prefix = /documents
+//	host        = docs.example.com
+//	method      = POST
+//	method      = PUT
+//	backend     = documents
+//
+// Multi-valued settings can be repeated, or given as a comma separated list.
+// Empty criteria match any request; the most specific route wins.
+type RouteConfig struct {
+	// Path prefix to match
+	PathPrefix string `gcfg:"path-prefix"`
+	// Host names to match ("*.example.com" matches any subdomain)
+	Hosts []string `gcfg:"host"`
+	// HTTP methods to match
+	Methods []string `gcfg:"method"`
+	// Name of the backend section to forward to
+	Backend string `gcfg:"backend"`
+	// Name of the scan policy section to apply
+	Policy string `gcfg:"policy"`
+	// If true, the requests matching the route are scanned in monitor mode
+	Monitor bool `gcfg:"monitor"`
+}
+
+// Configuration of a scan policy, e.g.:
+//
+//	[policy "api"]
+//	scan-method       = POST, PUT, PATCH
+//	skip-content-type = application/json
+//	max-body-size     = 10485760
+//	file-field        = attachment
+//	skip-path         = /api/health
+//
+// Policies are attached to routes. The policy named "default", if present,
+// applies to the requests not matching a route with a policy.
+type PolicyConfig struct {
+	// Methods to scan, all if empty
+	ScanMethods []string `gcfg:"scan-method"`
+	// Request content types to scan, all if empty. Wildcards like image/*
+	// are allowed.
+	ScanContentTypes []string `gcfg:"scan-content-type"`
+	// Request content types not to scan
+	SkipContentTypes []string `gcfg:"skip-content-type"`
+	// Size limits, overriding the global ones
+	MaxBodySize int64 `gcfg:"max-body-size"`
+	MaxPartSize int64 `gcfg:"max-part-size"`
+	MaxParts    int   `gcfg:"max-parts"`
+	// Multipart form fields to scan (glob patterns), all if empty
+	FileFields []string `gcfg:"file-field"`
+	// Path prefixes to pass through without scanning
+	SkipPaths []string `gcfg:"skip-path"`
+	// File types or classes allowed, detected from their contents, e.g.
+	// pdf, image. All if empty.
+	AllowTypes []string `gcfg:"allow-type"`
+	// File types or classes refused, e.g. executable, script, office-macro
+	BlockTypes []string `gcfg:"block-type"`
+	// Refuse files whose contents do not match their declared content type
+	// or extension
+	StrictTypes bool `gcfg:"strict-type"`
+	// JSON paths of the base64 fields to decode and scan in JSON bodies, e.g.
+	// $.files[*].content. If empty, the long base64 strings and the data:
+	// URIs are found anywhere.
+	JSONFields []string `gcfg:"json-field"`
+	// Minimum length of the strings found to be base64, 128 if unset
+	Base64MinLength int `gcfg:"base64-min-length"`
+}
+
+// Configuration of the response to an outcome, e.g.:
+//
+//	[outcome "upstream-error"]
+//	status-code = 503
+//	header      = Retry-After: 30
+//
+// The section name is the outcome: clean, virus, policy, scan-error,
+// parse-error, unsupported-encoding, too-large, rate-limited, overloaded,
+// upstream-error or internal-error.
+type OutcomeConfig struct {
+	// The status code of the response, replacing the default one (and
+	// virus-status-code or policy-status-code)
+	StatusCode int `gcfg:"status-code"`
+	// Headers to add to the response, as "Name: value"
+	Headers []string `gcfg:"header"`
+}
+
 // Default configuration
 var DefaultApplicationConfig = ApplicationConfig{
 	Listen:                 ":8438",
@@ -86,7 +299,13 @@ var DefaultApplicationConfig = ApplicationConfig{
 	ApplicationURL:         "",
 	ClamdURL:               "",
 	VirusStatusCode:        418,
+	PolicyStatusCode:       415,
+	AdmissionTimeout:       "10s",
+	RetryAfter:             5,
+	RateLimitMaxKeys:       100000,
 	ContentMemoryThreshold: 1024 * 1024,
+	MaxExtractSize:         32 * 1024 * 1024,
+	MaxDecodeRatio:         100,
 	Logfile:                "",
 	TestPages:              true,
 	Debug:                  false,
@@ -95,14 +314,21 @@ var DefaultApplicationConfig = ApplicationConfig{
 
 // Application context
 type Ctx struct {
-	Config          Config
-	ApplicationURL  *url.URL
-	ScanInterceptor *ScanInterceptor
-	Scanner         scanner.Scanner
-	Logger          *log.Logger
-	Listener        net.Listener
-	ActivityChan    chan int
-	ShuttingDown    bool
+	// The configuration read at startup. The settings that can be reloaded
+	// are read from the runtime.
+	Config           Config
+	Metrics          *metrics.Registry
+	RateLimited      *metrics.Metric
+	RateLimitEvicted *metrics.Metric
+	Detections       *metrics.Metric
+	Logger           *log.Logger
+	Listener         net.Listener
+	AdminListener    net.Listener
+	ActivityChan     chan int
+	ShuttingDown     bool
+
+	runtime atomic.Pointer[Runtime]
+	logFile *os.File
 }
 
 // JSON server information response
@@ -125,6 +351,15 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(configCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "scan":
+			os.Exit(scanCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	/*
 	 * Construct configuration, set up logging
 	 */
@@ -148,43 +383,83 @@ func main() {
 	/*
 	 * Construct objects, validate the URLs
 	 */
-	ctx.ApplicationURL = checkURL(ctx.Config.App.ApplicationURL)
-	checkURL(ctx.Config.App.ClamdURL)
-
-	ctx.Scanner = new(scanner.Clamav)
-	ctx.Scanner.SetLogger(ctx.Logger, ctx.Config.App.Debug)
-	ctx.Scanner.SetAddress(ctx.Config.App.ClamdURL)
-
-	ctx.ScanInterceptor = &ScanInterceptor{
-		VirusStatusCode: ctx.Config.App.VirusStatusCode,
-		Scanner:         ctx.Scanner,
+	ctx.Metrics = metrics.NewRegistry()
+	registerMetrics(ctx.Metrics)
+	if rt, err := buildRuntime(&ctx.Config); err != nil {
+		ctx.Logger.Fatal(err)
+	} else {
+		ctx.SetRuntime(rt)
 	}
 
 	/*
-	 * Set up the HTTP server
+	 * Set up the HTTP servers
 	 */
-	router := http.NewServeMux()
-
-	router.HandleFunc("/clammit", infoHandler)
-	router.HandleFunc("/clammit/scan", scanHandler)
-	router.HandleFunc("/clammit/readyz", readyzHandler)
+	router, adminRouter := buildRouters()
 
-	if ctx.Config.App.TestPages {
-		fs := http.FileServer(http.Dir("testfiles"))
-		router.Handle("/clammit/test/", http.StripPrefix("/clammit/test/", fs))
+	if adminRouter != nil {
+		if listener, err := listen(ctx.Config.App.AdminListen, socketPerms); err != nil {
+			ctx.Logger.Fatal("Unable to listen on: ", ctx.Config.App.AdminListen, ", reason: ", err)
+		} else {
+			ctx.AdminListener = listener
+		}
 	}
-	router.HandleFunc("/", scanForwardHandler)
-
-	if listener, err := getListener(ctx.Config.App.Listen, socketPerms); err != nil {
+	if listener, err := listen(ctx.Config.App.Listen, socketPerms); err != nil {
 		ctx.Logger.Fatal("Unable to listen on: ", ctx.Config.App.Listen, ", reason: ", err)
 	} else {
 		ctx.Listener = listener
 		beGraceful() // graceful shutdown from here on in
+		handleReload()
+		if ctx.AdminListener != nil {
+			ctx.Logger.Println("Admin listening on", ctx.Config.App.AdminListen)
+			go http.Serve(ctx.AdminListener, adminRouter)
+		}
 		ctx.Logger.Println("Listening on", ctx.Config.App.Listen)
 		http.Serve(listener, router)
 	}
 }
 
+/*
+ * Returns the proxy router and, if admin-listen is set, the admin router.
+ * Without an admin listener, the /clammit endpoints are served by the proxy
+ * router; with one, the proxy router forwards every path.
+ */
+func buildRouters() (router *http.ServeMux, adminRouter *http.ServeMux) {
+	router = http.NewServeMux()
+	if ctx.Config.App.AdminListen == "" {
+		registerAdminHandlers(router)
+	} else {
+		adminRouter = http.NewServeMux()
+		registerAdminHandlers(adminRouter)
+	}
+	router.HandleFunc("/", scanForwardHandler)
+	return router, adminRouter
+}
+
+/*
+ * Registers the /clammit endpoints: info, scan, health, metrics and test
+ * pages
+ */
+func registerAdminHandlers(router *http.ServeMux) {
+	router.Handle("/clammit", protect(ROLE_ADMIN, http.HandlerFunc(infoHandler)))
+	router.Handle("/clammit/scan", protect(ROLE_SCAN, http.HandlerFunc(scanHandler)))
+	router.HandleFunc("/clammit/readyz", readyzHandler)
+	router.Handle("/clammit/metrics", protect(ROLE_ADMIN, ctx.Metrics.Handler()))
+
+	if ctx.Config.App.TestPages {
+		fs := http.FileServer(http.Dir("testfiles"))
+		router.Handle("/clammit/test/", protect(ROLE_ADMIN, http.StripPrefix("/clammit/test/", fs)))
+	}
+}
+
+/*
+ * Requires the credentials of the role, as configured in the current runtime
+ */
+func protect(role string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx.Runtime().Authenticator.Protect(role, handler).ServeHTTP(w, req)
+	})
+}
+
 /*
  * Returns the value of an environment variable, or a default value
  */
@@ -219,6 +494,18 @@ func getInt64Env(key string, fallback int64) int64 {
 	return fallback
 }
 
+/*
+ * Returns the value of an environment variable casted as float64, or a default value
+ */
+func getFloatEnv(key string, fallback float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
 /*
  * Returns the value of an environment variable casted as boolean, or a default value
  */
@@ -241,26 +528,86 @@ func constructConfig() {
 		ShuttingDown: false,
 	}
 
-	ctx.Config.App = DefaultApplicationConfig
+	config, err := readConfig(configFile)
+	if err != nil {
+		log.Fatalf("Configuration read failure: %s", err.Error())
+	}
+	ctx.Config = *config
+}
+
+/*
+ * Reads the configuration from the file, if any, and environment variables.
+ * Unknown settings are returned as a warnings.List along with the
+ * configuration.
+ */
+func readConfig(filename string) (*Config, error) {
+	config := &Config{App: DefaultApplicationConfig}
 
-	// Read the configuration file if configfile is set
-	if configFile != "" {
-		if err := gcfg.ReadFileInto(&ctx.Config, configFile); err != nil {
-			log.Fatalf("Configuration read failure: %s", err.Error())
+	// Read the configuration file if configfile is set. Unknown settings
+	// are only warnings: the configuration is returned along with them.
+	var warning error
+	if filename != "" {
+		if err := gcfg.ReadFileInto(config, filename); err != nil {
+			if gcfg.FatalOnly(err) != nil {
+				return nil, err
+			}
+			warning = err
 		}
 	}
 
 	// Check for environmant variables to overwrite config
-	ctx.Config.App.Listen = getEnv("CLAMMIT_LISTEN", ctx.Config.App.Listen)
-	ctx.Config.App.SocketPerms = getEnv("CLAMMIT_SOCKET_PERMS", ctx.Config.App.SocketPerms)
-	ctx.Config.App.ApplicationURL = getEnv("CLAMMIT_APPLICATION_URL", ctx.Config.App.ApplicationURL)
-	ctx.Config.App.ClamdURL = getEnv("CLAMMIT_CLAMD_URL", ctx.Config.App.ClamdURL)
-	ctx.Config.App.VirusStatusCode = getIntEnv("CLAMMIT_VIRUS_STATUS_CODE", ctx.Config.App.VirusStatusCode)
-	ctx.Config.App.ContentMemoryThreshold = getInt64Env("CLAMMIT_CONTENT_MEMORY_THRESHOLD", ctx.Config.App.ContentMemoryThreshold)
-	ctx.Config.App.Logfile = getEnv("CLAMMIT_LOGFILE", ctx.Config.App.Logfile)
-	ctx.Config.App.TestPages = getBoolEnv("CLAMMIT_TEST_PAGES", ctx.Config.App.TestPages)
-	ctx.Config.App.Debug = getBoolEnv("CLAMMIT_DEBUG", ctx.Config.App.Debug)
-	ctx.Config.App.NumThreads = getIntEnv("CLAMMIT_NUM_THREADS", ctx.Config.App.NumThreads)
+	config.App.Listen = getEnv("CLAMMIT_LISTEN", config.App.Listen)
+	config.App.SocketPerms = getEnv("CLAMMIT_SOCKET_PERMS", config.App.SocketPerms)
+	config.App.AdminListen = getEnv("CLAMMIT_ADMIN_LISTEN", config.App.AdminListen)
+	config.App.TLSCertFile = getEnv("CLAMMIT_TLS_CERT_FILE", config.App.TLSCertFile)
+	config.App.TLSKeyFile = getEnv("CLAMMIT_TLS_KEY_FILE", config.App.TLSKeyFile)
+	config.App.TLSClientCAFile = getEnv("CLAMMIT_TLS_CLIENT_CA_FILE", config.App.TLSClientCAFile)
+	config.App.TLSClientAuth = getEnv("CLAMMIT_TLS_CLIENT_AUTH", config.App.TLSClientAuth)
+	config.App.TLSMinVersion = getEnv("CLAMMIT_TLS_MIN_VERSION", config.App.TLSMinVersion)
+	config.App.ApplicationURL = getEnv("CLAMMIT_APPLICATION_URL", config.App.ApplicationURL)
+	config.App.ClamdURL = getEnv("CLAMMIT_CLAMD_URL", config.App.ClamdURL)
+	config.App.VirusStatusCode = getIntEnv("CLAMMIT_VIRUS_STATUS_CODE", config.App.VirusStatusCode)
+	config.App.PolicyStatusCode = getIntEnv("CLAMMIT_POLICY_STATUS_CODE", config.App.PolicyStatusCode)
+	config.App.ContentMemoryThreshold = getInt64Env("CLAMMIT_CONTENT_MEMORY_THRESHOLD", config.App.ContentMemoryThreshold)
+	config.App.MaxBodySize = getInt64Env("CLAMMIT_MAX_BODY_SIZE", config.App.MaxBodySize)
+	config.App.MaxPartSize = getInt64Env("CLAMMIT_MAX_PART_SIZE", config.App.MaxPartSize)
+	config.App.MaxParts = getIntEnv("CLAMMIT_MAX_PARTS", config.App.MaxParts)
+	config.App.MaxExtractSize = getInt64Env("CLAMMIT_MAX_EXTRACT_SIZE", config.App.MaxExtractSize)
+	config.App.MaxDecodedSize = getInt64Env("CLAMMIT_MAX_DECODED_SIZE", config.App.MaxDecodedSize)
+	config.App.MaxDecodeRatio = getIntEnv("CLAMMIT_MAX_DECODE_RATIO", config.App.MaxDecodeRatio)
+	config.App.Monitor = getBoolEnv("CLAMMIT_MONITOR", config.App.Monitor)
+	config.App.VerdictHMACKey = getEnv("CLAMMIT_VERDICT_HMAC_KEY", config.App.VerdictHMACKey)
+	config.App.ResponseTemplates = getEnv("CLAMMIT_RESPONSE_TEMPLATES", config.App.ResponseTemplates)
+	config.App.SupportContact = getEnv("CLAMMIT_SUPPORT_CONTACT", config.App.SupportContact)
+	config.App.ScanParallelism = getIntEnv("CLAMMIT_SCAN_PARALLELISM", config.App.ScanParallelism)
+	config.App.MaxConcurrentScans = getIntEnv("CLAMMIT_MAX_CONCURRENT_SCANS", config.App.MaxConcurrentScans)
+	config.App.MaxMemoryBytes = getInt64Env("CLAMMIT_MAX_MEMORY_BYTES", config.App.MaxMemoryBytes)
+	config.App.MaxSpoolBytes = getInt64Env("CLAMMIT_MAX_SPOOL_BYTES", config.App.MaxSpoolBytes)
+	config.App.AdmissionQueueSize = getIntEnv("CLAMMIT_ADMISSION_QUEUE_SIZE", config.App.AdmissionQueueSize)
+	config.App.AdmissionTimeout = getEnv("CLAMMIT_ADMISSION_TIMEOUT", config.App.AdmissionTimeout)
+	config.App.RetryAfter = getIntEnv("CLAMMIT_RETRY_AFTER", config.App.RetryAfter)
+	config.App.RateLimitRequests = getFloatEnv("CLAMMIT_RATE_LIMIT_REQUESTS", config.App.RateLimitRequests)
+	config.App.RateLimitBurst = getFloatEnv("CLAMMIT_RATE_LIMIT_BURST", config.App.RateLimitBurst)
+	config.App.RateLimitBytes = getFloatEnv("CLAMMIT_RATE_LIMIT_BYTES", config.App.RateLimitBytes)
+	config.App.RateLimitBytesBurst = getFloatEnv("CLAMMIT_RATE_LIMIT_BYTES_BURST", config.App.RateLimitBytesBurst)
+	config.App.RateLimitKey = getEnv("CLAMMIT_RATE_LIMIT_KEY", config.App.RateLimitKey)
+	config.App.RateLimitMaxKeys = getIntEnv("CLAMMIT_RATE_LIMIT_MAX_KEYS", config.App.RateLimitMaxKeys)
+	if proxies, ok := os.LookupEnv("CLAMMIT_TRUSTED_PROXIES"); ok {
+		config.App.TrustedProxies = []string{proxies}
+	}
+	if tokens, ok := os.LookupEnv("CLAMMIT_SCAN_TOKENS"); ok {
+		config.App.ScanTokens = []string{tokens}
+	}
+	if tokens, ok := os.LookupEnv("CLAMMIT_ADMIN_TOKENS"); ok {
+		config.App.AdminTokens = []string{tokens}
+	}
+	config.App.ScanHtpasswdFile = getEnv("CLAMMIT_SCAN_HTPASSWD_FILE", config.App.ScanHtpasswdFile)
+	config.App.AdminHtpasswdFile = getEnv("CLAMMIT_ADMIN_HTPASSWD_FILE", config.App.AdminHtpasswdFile)
+	config.App.Logfile = getEnv("CLAMMIT_LOGFILE", config.App.Logfile)
+	config.App.TestPages = getBoolEnv("CLAMMIT_TEST_PAGES", config.App.TestPages)
+	config.App.Debug = getBoolEnv("CLAMMIT_DEBUG", config.App.Debug)
+	config.App.NumThreads = getIntEnv("CLAMMIT_NUM_THREADS", config.App.NumThreads)
+	return config, warning
 }
 
 /*
@@ -271,6 +618,7 @@ func startLogging() {
 		w, err := os.OpenFile(ctx.Config.App.Logfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 		if err == nil {
 			ctx.Logger = log.New(w, "", log.LstdFlags)
+			ctx.logFile = w
 		} else {
 			log.Fatal("Failed to open log file", ctx.Config.App.Logfile, ":", err)
 		}
@@ -286,7 +634,7 @@ func startLogging() {
  * HTTP listener.
  */
 func beGraceful() {
-	sigchan := make(chan os.Signal)
+	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		activity := 0
@@ -302,6 +650,9 @@ func beGraceful() {
 				}
 				// This will cause main() to continue from http.Serve()
 				// it will also clean up the unix socket (if relevant)
+				if ctx.AdminListener != nil {
+					ctx.AdminListener.Close()
+				}
 				ctx.Listener.Close()
 			case i := <-ctx.ActivityChan:
 				activity += i
@@ -311,14 +662,271 @@ func beGraceful() {
 }
 
 /*
- * Validates the URL is OK (fatal error if not) and returns it
+ * Constructs the application backends from their configuration
+ */
+func buildBackends(configs map[string]*BackendConfig) ([]*forwarder.Backend, error) {
+	backends := make([]*forwarder.Backend, 0, len(configs))
+	for name, config := range configs {
+		backendURL, err := url.Parse(config.URL)
+		if err != nil || (backendURL.Host == "" && !(backendURL.Scheme == "unix" && backendURL.Path != "")) {
+			return nil, fmt.Errorf("Backend %s: invalid URL: %s", name, config.URL)
+		}
+		options := &tlsconfig.Options{
+			CAFile:             config.TLSCAFile,
+			CertFile:           config.TLSCertFile,
+			KeyFile:            config.TLSKeyFile,
+			ServerName:         config.TLSServerName,
+			MinVersion:         config.TLSMinVersion,
+			InsecureSkipVerify: config.TLSInsecureSkipVerify,
+		}
+		var tlsConfig *tls.Config
+		if !options.IsZero() {
+			if tlsConfig, err = options.ClientConfig(); err != nil {
+				return nil, fmt.Errorf("Backend %s: %s", name, err.Error())
+			}
+		}
+		if config.TLSInsecureSkipVerify {
+			ctx.Logger.Printf("WARNING: TLS verification is disabled for backend %s", name)
+		}
+		backend := forwarder.NewBackend(name, backendURL, tlsConfig)
+		if config.Timeout != "" {
+			if backend.Timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return nil, fmt.Errorf("Backend %s: invalid timeout: %s", name, config.Timeout)
+			}
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+/*
+ * Constructs the routing table from its configuration
+ */
+func buildRoutes(configs map[string]*RouteConfig, backends []*forwarder.Backend) (forwarder.Routes, error) {
+	routes := make([]*forwarder.Route, 0, len(configs))
+	for name, config := range configs {
+		route := &forwarder.Route{
+			Name:       name,
+			PathPrefix: config.PathPrefix,
+			Hosts:      splitList(config.Hosts),
+			Methods:    splitList(config.Methods),
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, fmt.Errorf("Route %s: path-prefix must start with /: %s", name, route.PathPrefix)
+		}
+		if config.Backend != "" {
+			for _, backend := range backends {
+				if backend.Name == config.Backend {
+					route.Backend = backend
+				}
+			}
+			if route.Backend == nil {
+				return nil, fmt.Errorf("Route %s: unknown backend %s", name, config.Backend)
+			}
+		}
+		routes = append(routes, route)
+	}
+	return forwarder.NewRoutes(routes), nil
+}
+
+/*
+ * Constructs the scan policies from their configuration, and assigns them
+ * to the interceptor by route name
+ */
+func buildPolicies(interceptor *ScanInterceptor, configs map[string]*PolicyConfig, routes map[string]*RouteConfig) error {
+	policies := make(map[string]*ScanPolicy, len(configs))
+	for name, config := range configs {
+		if config.MaxBodySize < 0 || config.MaxPartSize < 0 || config.MaxParts < 0 || config.Base64MinLength < 0 {
+			return fmt.Errorf("Policy %s: size limits cannot be negative", name)
+		}
+		var jsonFields []*JSONPath
+		for _, expression := range splitList(config.JSONFields) {
+			path, err := ParseJSONPath(expression)
+			if err != nil {
+				return fmt.Errorf("Policy %s: invalid JSON path %s: %s", name, expression, err.Error())
+			}
+			jsonFields = append(jsonFields, path)
+		}
+		for _, t := range append(splitList(config.AllowTypes), splitList(config.BlockTypes)...) {
+			if !filetype.Known(t) {
+				return fmt.Errorf("Policy %s: unknown file type: %s", name, t)
+			}
+		}
+		policies[name] = &ScanPolicy{
+			Name:             name,
+			Methods:          splitList(config.ScanMethods),
+			ScanContentTypes: splitList(config.ScanContentTypes),
+			SkipContentTypes: splitList(config.SkipContentTypes),
+			MaxBodySize:      config.MaxBodySize,
+			MaxPartSize:      config.MaxPartSize,
+			MaxParts:         config.MaxParts,
+			FileFields:       splitList(config.FileFields),
+			SkipPaths:        splitList(config.SkipPaths),
+			AllowTypes:       splitList(config.AllowTypes),
+			BlockTypes:       splitList(config.BlockTypes),
+			StrictTypes:      config.StrictTypes,
+			JSONFields:       jsonFields,
+			Base64MinLength:  config.Base64MinLength,
+		}
+	}
+
+	interceptor.DefaultPolicy = policies[defaultPolicyName]
+	interceptor.Policies = make(map[string]*ScanPolicy)
+	for name, route := range routes {
+		if route.Policy == "" {
+			continue
+		}
+		if policy, ok := policies[route.Policy]; ok {
+			interceptor.Policies[name] = policy
+		} else {
+			return fmt.Errorf("Route %s: unknown policy %s", name, route.Policy)
+		}
+	}
+	return nil
+}
+
+/*
+ * Constructs the admission controller, or returns nil if there are no limits
  */
-func checkURL(urlString string) *url.URL {
-	parsedURL, err := url.Parse(urlString)
+func buildAdmission(config *ApplicationConfig) (*Admission, error) {
+	var timeout time.Duration
+	if config.AdmissionTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(config.AdmissionTimeout); err != nil {
+			return nil, fmt.Errorf("Invalid admission-timeout: %s", config.AdmissionTimeout)
+		}
+	}
+	if config.MaxConcurrentScans <= 0 && config.MaxMemoryBytes <= 0 && config.MaxSpoolBytes <= 0 {
+		return nil, nil
+	}
+	return &Admission{
+		MaxConcurrent:   config.MaxConcurrentScans,
+		MaxMemory:       config.MaxMemoryBytes,
+		MaxSpool:        config.MaxSpoolBytes,
+		QueueSize:       config.AdmissionQueueSize,
+		RetryAfter:      config.RetryAfter,
+		MemoryThreshold: config.ContentMemoryThreshold,
+		Timeout:         timeout,
+	}, nil
+}
+
+/*
+ * Constructs the rate limiter, or returns nil if there are no limits
+ */
+func buildRateLimiter(config *ApplicationConfig, limited *metrics.Metric, evicted *metrics.Metric) (*RateLimiter, error) {
+	if config.RateLimitRequests < 0 || config.RateLimitBytes < 0 || config.RateLimitBurst < 0 || config.RateLimitBytesBurst < 0 || config.RateLimitMaxKeys < 0 {
+		return nil, fmt.Errorf("Rate limits cannot be negative")
+	}
+	proxies, err := ParseTrustedProxies(splitList(config.TrustedProxies))
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewRateLimitKey(config.RateLimitKey, proxies, func() forwarder.Routes { return ctx.Runtime().Routes })
 	if err != nil {
-		log.Fatal("Invalid URL:", urlString)
+		return nil, err
 	}
-	return parsedURL
+	if config.RateLimitRequests == 0 && config.RateLimitBytes == 0 {
+		return nil, nil
+	}
+	limiter := &RateLimiter{
+		Requests:     config.RateLimitRequests,
+		RequestBurst: config.RateLimitBurst,
+		Bytes:        config.RateLimitBytes,
+		ByteBurst:    config.RateLimitBytesBurst,
+		Key:          key,
+		MaxKeys:      config.RateLimitMaxKeys,
+		Limited:      limited,
+		Evicted:      evicted,
+	}
+	return limiter, nil
+}
+
+/*
+ * Constructs the authenticator of the /clammit endpoints. Subjects are not
+ * split on commas, as distinguished names contain them.
+ */
+func buildAuthenticator(config *ApplicationConfig) (*Authenticator, error) {
+	authenticator := &Authenticator{
+		Scan:  Credentials{Tokens: splitList(config.ScanTokens), Subjects: config.ScanTLSSubjects},
+		Admin: Credentials{Tokens: splitList(config.AdminTokens), Subjects: config.AdminTLSSubjects},
+	}
+	if config.ScanHtpasswdFile != "" {
+		users, err := LoadHtpasswd(config.ScanHtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load scan-htpasswd-file: %s", err.Error())
+		}
+		authenticator.Scan.Users = users
+	}
+	if config.AdminHtpasswdFile != "" {
+		users, err := LoadHtpasswd(config.AdminHtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load admin-htpasswd-file: %s", err.Error())
+		}
+		authenticator.Admin.Users = users
+	}
+	return authenticator, nil
+}
+
+/*
+ * Registers the metrics. Those exposing the state of the admission
+ * controller and the rate limiter read the current runtime.
+ */
+func registerMetrics(registry *metrics.Registry) {
+	ctx.RateLimited = registry.NewCounter("clammit_rate_limited_total", "Requests refused by the rate limiter", "limit")
+	ctx.RateLimitEvicted = registry.NewCounter("clammit_rate_limit_evictions_total", "Clients forgotten by the rate limiter to stay within rate-limit-max-keys")
+	ctx.Detections = registry.NewCounter("clammit_detections_total", "Files found infected or not allowed", "result", "mode")
+
+	gauge := func(name, help string, value func(rt *Runtime) float64) {
+		registry.NewGaugeFunc(name, help, func() []metrics.Sample {
+			return []metrics.Sample{{Value: value(ctx.Runtime())}}
+		})
+	}
+	admission := func(value func(AdmissionStats) float64) func(rt *Runtime) float64 {
+		return func(rt *Runtime) float64 {
+			if rt.Admission == nil {
+				return 0
+			}
+			return value(rt.Admission.Stats())
+		}
+	}
+	gauge("clammit_admission_in_flight", "Requests being scanned", admission(func(s AdmissionStats) float64 { return float64(s.InFlight) }))
+	gauge("clammit_admission_waiting", "Requests waiting for admission", admission(func(s AdmissionStats) float64 { return float64(s.Waiting) }))
+	gauge("clammit_admission_memory_bytes", "Body bytes held in memory", admission(func(s AdmissionStats) float64 { return float64(s.Memory) }))
+	gauge("clammit_admission_spool_bytes", "Body bytes spooled to disk", admission(func(s AdmissionStats) float64 { return float64(s.Spool) }))
+	gauge("clammit_rate_limit_keys", "Clients tracked by the rate limiter", func(rt *Runtime) float64 {
+		if rt.RateLimiter == nil {
+			return 0
+		}
+		keys, _ := rt.RateLimiter.Stats()
+		return float64(keys)
+	})
+	gauge("clammit_rate_limit_limited_keys", "Clients currently over their rate limit", func(rt *Runtime) float64 {
+		if rt.RateLimiter == nil {
+			return 0
+		}
+		_, limited := rt.RateLimiter.Stats()
+		return float64(limited)
+	})
+	gauge("clammit_rate_limit_max_keys", "Maximum number of clients tracked by the rate limiter, 0 if unlimited", func(rt *Runtime) float64 {
+		if rt.RateLimiter == nil {
+			return 0
+		}
+		return float64(rt.RateLimiter.MaxKeys)
+	})
+}
+
+/*
+ * Flattens multi-valued settings, that may also be given as comma or space
+ * separated lists
+ */
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		list = append(list, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
+	return list
 }
 
 /*
@@ -363,6 +971,39 @@ func getListener(address string, socketPerms int) (listener net.Listener, err er
 	return listener, err
 }
 
+/*
+ * Returns a listener on the address, terminating TLS if configured
+ */
+func listen(address string, socketPerms int) (net.Listener, error) {
+	listener, err := getListener(address, socketPerms)
+	if err != nil || ctx.Config.App.TLSCertFile == "" {
+		return listener, err
+	}
+	if listener, err = getTLSListener(listener); err != nil {
+		return nil, fmt.Errorf("Unable to set up TLS: %s", err.Error())
+	}
+	return listener, nil
+}
+
+/*
+ * Wraps the listener to terminate TLS, with the certificates from the
+ * configuration. The certificate files are watched and reloaded when they
+ * change.
+ */
+func getTLSListener(listener net.Listener) (net.Listener, error) {
+	tlsConfig, err := tlsconfig.NewServerConfig(&tlsconfig.ServerOptions{
+		CertFile:     ctx.Config.App.TLSCertFile,
+		KeyFile:      ctx.Config.App.TLSKeyFile,
+		ClientCAFile: ctx.Config.App.TLSClientCAFile,
+		ClientAuth:   ctx.Config.App.TLSClientAuth,
+		MinVersion:   ctx.Config.App.TLSMinVersion,
+	}, ctx.Logger)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
 /*
  * Handler for /scan
  *
@@ -375,8 +1016,22 @@ func scanHandler(w http.ResponseWriter, req *http.Request) {
 	ctx.ActivityChan <- 1
 	defer func() { ctx.ActivityChan <- -1 }()
 
-	if !ctx.ScanInterceptor.Handle(w, req, req.Body) {
-		w.Write([]byte("No virus found"))
+	rt := ctx.Runtime()
+	if !rt.RateLimiter.Allow(w, req, rt.Responses) {
+		return
+	}
+	release, admitted := rt.Admission.Admit(w, req, rt.ScanInterceptor.BodyLimit(req), rt.Responses)
+	if !admitted {
+		return
+	}
+	defer release()
+
+	// The scan endpoint reports what it finds, even in monitor mode, and
+	// forwards nothing to sign
+	interceptor := *rt.ScanInterceptor
+	interceptor.Monitor, interceptor.MonitorRoutes, interceptor.Verdict = false, nil, nil
+	if !interceptor.Handle(w, req, req.Body) {
+		rt.Responses.Respond(w, req, OUTCOME_CLEAN, &ResponseData{})
 	}
 }
 
@@ -392,8 +1047,22 @@ func scanForwardHandler(w http.ResponseWriter, req *http.Request) {
 	ctx.ActivityChan <- 1
 	defer func() { ctx.ActivityChan <- -1 }()
 
-	fw := forwarder.NewForwarder(ctx.ApplicationURL, ctx.Config.App.ContentMemoryThreshold, ctx.ScanInterceptor)
-	fw.SetLogger(ctx.Logger, ctx.Config.App.Debug)
+	rt := ctx.Runtime()
+	if !rt.RateLimiter.Allow(w, req, rt.Responses) {
+		return
+	}
+	// The route decides the body limit, and so what admission reserves
+	req = rt.Routes.MatchRequest(req)
+	release, admitted := rt.Admission.Admit(w, req, rt.ScanInterceptor.BodyLimit(req), rt.Responses)
+	if !admitted {
+		return
+	}
+	defer release()
+
+	fw := forwarder.NewForwarder(rt.ApplicationURL, rt.Config.App.ContentMemoryThreshold, rt.ScanInterceptor)
+	fw.SetLogger(ctx.Logger, rt.Config.App.Debug)
+	fw.SetBackends(rt.Backends)
+	fw.SetRoutes(rt.Routes)
 	fw.HandleRequest(w, req)
 }
 
@@ -410,15 +1079,16 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 	ctx.ActivityChan <- 1
 	defer func() { ctx.ActivityChan <- -1 }()
 
+	scanner := ctx.Runtime().Scanner
 	info := &Info{
-		Address: ctx.Scanner.Address(),
+		Address: scanner.Address(),
 		Version: version,
 	}
-	if err := ctx.Scanner.Ping(); err != nil {
+	if err := scanner.Ping(); err != nil {
 		info.PingResult = err.Error()
 	} else {
 		info.PingResult = "Connected to server OK"
-		if response, err := ctx.Scanner.Version(); err != nil {
+		if response, err := scanner.Version(); err != nil {
 			info.ScannerVersion = err.Error()
 		} else {
 			info.ScannerVersion = response
@@ -427,7 +1097,7 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 		 * Validate the Clamd response for a viral string
 		 */
 		reader := bytes.NewReader(EICAR)
-		if result, err := ctx.Scanner.Scan(reader); err != nil {
+		if result, err := scanner.Scan(reader); err != nil {
 			info.TestScanVirusResult = err.Error()
 		} else {
 			info.TestScanVirusResult = result.String()
@@ -436,7 +1106,7 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 		 * Validate the Clamd response for a non-viral string
 		 */
 		reader = bytes.NewReader([]byte("foo bar mcgrew"))
-		if result, err := ctx.Scanner.Scan(reader); err != nil {
+		if result, err := scanner.Scan(reader); err != nil {
 			info.TestScanCleanResult = err.Error()
 		} else {
 			info.TestScanCleanResult = result.String()
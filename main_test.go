@@ -1,8 +1,19 @@
 package main
 
 import (
+	"clammit/clamdtest"
+	"clammit/metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gcfg.v1"
 )
 
 func disableIPv6(t *testing.T) bool {
@@ -127,16 +138,20 @@ func TestGetListener_Unix(t *testing.T) {
 }
 
 func TestConstructConfig_Env(t *testing.T) {
-	os.Setenv("CLAMMIT_LISTEN", ":1234")
-	os.Setenv("CLAMMIT_SOCKET_PERMS", "0444")
-	os.Setenv("CLAMMIT_APPLICATION_URL", "http://foo.bar:123")
-	os.Setenv("CLAMMIT_CLAMD_URL", "tcp://av.foo.bar:3310")
-	os.Setenv("CLAMMIT_VIRUS_STATUS_CODE", "111")
-	os.Setenv("CLAMMIT_CONTENT_MEMORY_THRESHOLD", "666")
-	os.Setenv("CLAMMIT_LOGFILE", "/var/log/foo.log")
-	os.Setenv("CLAMMIT_TEST_PAGES", "false")
-	os.Setenv("CLAMMIT_DEBUG", "true")
-	os.Setenv("CLAMMIT_NUM_THREADS", "90000")
+	t.Setenv("CLAMMIT_LISTEN", ":1234")
+	t.Setenv("CLAMMIT_SOCKET_PERMS", "0444")
+	t.Setenv("CLAMMIT_APPLICATION_URL", "http://foo.bar:123")
+	t.Setenv("CLAMMIT_CLAMD_URL", "tcp://av.foo.bar:3310")
+	t.Setenv("CLAMMIT_VIRUS_STATUS_CODE", "111")
+	t.Setenv("CLAMMIT_CONTENT_MEMORY_THRESHOLD", "666")
+	t.Setenv("CLAMMIT_LOGFILE", "/var/log/foo.log")
+	t.Setenv("CLAMMIT_TEST_PAGES", "false")
+	t.Setenv("CLAMMIT_DEBUG", "true")
+	t.Setenv("CLAMMIT_NUM_THREADS", "90000")
+	t.Setenv("CLAMMIT_TLS_CERT_FILE", "/etc/clammit/server.pem")
+	t.Setenv("CLAMMIT_TLS_CLIENT_AUTH", "require")
+	t.Setenv("CLAMMIT_MAX_BODY_SIZE", "1000000")
+	t.Setenv("CLAMMIT_MAX_PARTS", "12")
 
 	constructConfig()
 
@@ -179,4 +194,145 @@ func TestConstructConfig_Env(t *testing.T) {
 	if ctx.Config.App.NumThreads != 90000 {
 		t.Errorf("Expected NumThreads to be 90000, got %d", ctx.Config.App.NumThreads)
 	}
+
+	if ctx.Config.App.TLSCertFile != "/etc/clammit/server.pem" {
+		t.Errorf("Expected TLSCertFile to be '/etc/clammit/server.pem', got %s", ctx.Config.App.TLSCertFile)
+	}
+
+	if ctx.Config.App.TLSClientAuth != "require" {
+		t.Errorf("Expected TLSClientAuth to be 'require', got %s", ctx.Config.App.TLSClientAuth)
+	}
+
+	if ctx.Config.App.MaxBodySize != 1000000 {
+		t.Errorf("Expected MaxBodySize to be 1000000, got %d", ctx.Config.App.MaxBodySize)
+	}
+
+	if ctx.Config.App.MaxParts != 12 {
+		t.Errorf("Expected MaxParts to be 12, got %d", ctx.Config.App.MaxParts)
+	}
+}
+
+func TestBuildRoutes(t *testing.T) {
+	var config Config
+	err := gcfg.ReadStringInto(&config, `
+[backend "documents"]
+url     = https://documents.internal:8443/
+timeout = 30s
+
+[backend "local"]
+url = unix:/tmp/app.sock
+
+[route "uploads"]
+path-prefix = /documents
+method      = POST, PUT
+method      = PATCH
+backend     = documents
+
+[route "default"]
+backend = local
+`)
+	if err != nil {
+		t.Fatal("Unable to parse configuration:", err)
+	}
+
+	backends, err := buildBackends(config.Backends)
+	if err != nil {
+		t.Fatal("buildBackends failed:", err)
+	}
+	routes, err := buildRoutes(config.Routes, backends)
+	if err != nil {
+		t.Fatal("buildRoutes failed:", err)
+	}
+
+	if len(routes) != 2 || routes[0].Name != "uploads" {
+		t.Fatalf("Expected the uploads route first, got %v", routes)
+	}
+	if strings.Join(routes[0].Methods, " ") != "POST PUT PATCH" {
+		t.Errorf("Expected methods POST PUT PATCH, got %v", routes[0].Methods)
+	}
+	if routes[0].Backend.Name != "documents" || routes[0].Backend.Timeout != 30*time.Second {
+		t.Errorf("Unexpected backend %v", routes[0].Backend)
+	}
+	if routes[1].Backend.URL.Path != "/tmp/app.sock" {
+		t.Errorf("Unexpected backend URL %v", routes[1].Backend.URL)
+	}
+
+	config.Routes["uploads"].Backend = "nowhere"
+	if _, err := buildRoutes(config.Routes, backends); err == nil {
+		t.Errorf("Expected an error for an unknown backend")
+	}
+}
+
+func TestBuildRouters(t *testing.T) {
+	ctx = &Ctx{Metrics: metrics.NewRegistry()}
+	ctx.Config.App = DefaultApplicationConfig
+
+	pattern := func(router *http.ServeMux, path string) string {
+		_, pattern := router.Handler(httptest.NewRequest("GET", path, nil))
+		return pattern
+	}
+
+	router, adminRouter := buildRouters()
+	if adminRouter != nil {
+		t.Fatal("Expected no admin router")
+	}
+	if p := pattern(router, "/clammit/readyz"); p != "/clammit/readyz" {
+		t.Errorf("Expected /clammit/readyz on the proxy router, got %s", p)
+	}
+
+	ctx.Config.App.AdminListen = "tcp:127.0.0.1:8439"
+	router, adminRouter = buildRouters()
+	if adminRouter == nil {
+		t.Fatal("Expected an admin router")
+	}
+	for _, path := range []string{"/clammit", "/clammit/scan", "/clammit/readyz", "/clammit/metrics", "/clammit/test/"} {
+		if p := pattern(router, path); p != "/" {
+			t.Errorf("Expected %s to be forwarded by the proxy router, got %s", path, p)
+		}
+		if p := pattern(adminRouter, path); p != path {
+			t.Errorf("Expected %s on the admin router, got %s", path, p)
+		}
+	}
+}
+
+/*
+ * Uploads through clammit, configured with a fake clamd, to a backend
+ */
+func TestEndToEnd(t *testing.T) {
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(clamdtest.Drop("drop"))
+	var forwarded []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		forwarded = append(forwarded, string(body))
+	}))
+	defer backend.Close()
+
+	setupReload(t, `
+[application]
+application-url = `+backend.URL+`
+clamd-url       = `+clamd.URL+`
+`)
+	ctx.ActivityChan = make(chan int)
+	go func() {
+		for range ctx.ActivityChan {
+		}
+	}()
+	router, _ := buildRouters()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for body, status := range map[string]int{
+		"hello":                 200,
+		string(clamdtest.EICAR): 418,
+		"drop":                  500,
+	} {
+		resp, err := http.Post(server.URL+"/upload", "application/octet-stream", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, body)
+	}
+	assert.Equal(t, []string{"hello"}, forwarded)
+	assert.Equal(t, 3, clamd.Scans())
 }
@@ -0,0 +1,225 @@
+/*
+ * The metrics package keeps counters and gauges, and exposes them in the
+ * Prometheus text format.
+ */
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	COUNTER = "counter"
+	GAUGE   = "gauge"
+)
+
+/*
+ * A value with its label values, in the order of the metric label names
+ */
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+/*
+ * A named metric, with optional labels. Values are either kept by the
+ * metric (see Add and Set), or collected when exposed (see NewGaugeFunc).
+ */
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+
+	mutex   sync.Mutex
+	values  map[string]*Sample
+	collect func() []Sample
+}
+
+/*
+ * A set of metrics, exposed in registration order
+ */
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+/*
+ * Registers a counter with the given label names
+ */
+func (r *Registry) NewCounter(name, help string, labels ...string) *Metric {
+	return r.register(&Metric{Name: name, Help: help, Type: COUNTER, Labels: labels})
+}
+
+/*
+ * Registers a gauge with the given label names
+ */
+func (r *Registry) NewGauge(name, help string, labels ...string) *Metric {
+	return r.register(&Metric{Name: name, Help: help, Type: GAUGE, Labels: labels})
+}
+
+/*
+ * Registers a gauge whose samples are collected by calling the given
+ * function each time the metrics are exposed
+ */
+func (r *Registry) NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) *Metric {
+	return r.register(&Metric{Name: name, Help: help, Type: GAUGE, Labels: labels, collect: collect})
+}
+
+func (r *Registry) register(metric *Metric) *Metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, m := range r.metrics {
+		if m.Name == metric.Name {
+			panic("metrics: duplicate metric " + metric.Name)
+		}
+	}
+	metric.values = make(map[string]*Sample)
+	r.metrics = append(r.metrics, metric)
+	return metric
+}
+
+/*
+ * Adds to the value with the given label values. Nil-safe, so that metrics
+ * can be left out in tests.
+ */
+func (m *Metric) Add(value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.sample(labels, func(s *Sample) { s.Value += value })
+}
+
+/*
+ * Increments the value with the given label values
+ */
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+/*
+ * Sets the value with the given label values
+ */
+func (m *Metric) Set(value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.sample(labels, func(s *Sample) { s.Value = value })
+}
+
+/*
+ * Returns the value with the given label values
+ */
+func (m *Metric) Value(labels ...string) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.values[strings.Join(labels, "\xff")]; ok {
+		return s.Value
+	}
+	return 0
+}
+
+func (m *Metric) sample(labels []string, update func(*Sample)) {
+	if len(labels) != len(m.Labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d labels, got %d", m.Name, len(m.Labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.values[key]
+	if !ok {
+		s = &Sample{Labels: append([]string(nil), labels...)}
+		m.values[key] = s
+	}
+	update(s)
+}
+
+/*
+ * Returns the samples of the metric, sorted by label values
+ */
+func (m *Metric) samples() []Sample {
+	if m.collect != nil {
+		return m.collect()
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	samples := make([]Sample, 0, len(m.values))
+	for _, s := range m.values {
+		samples = append(samples, *s)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].Labels, "\xff") < strings.Join(samples[j].Labels, "\xff")
+	})
+	return samples
+}
+
+/*
+ * Writes all the metrics in the Prometheus text format
+ */
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	metrics := append([]*Metric(nil), r.metrics...)
+	r.mutex.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.Name, m.Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.Name, m.Type)
+		samples := m.samples()
+		if len(samples) == 0 && len(m.Labels) == 0 {
+			samples = []Sample{{}}
+		}
+		for _, s := range samples {
+			b.WriteString(m.Name)
+			if len(m.Labels) > 0 {
+				b.WriteByte('{')
+				for i, name := range m.Labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					value := ""
+					if i < len(s.Labels) {
+						value = s.Labels[i]
+					}
+					fmt.Fprintf(&b, "%s=%s", name, quote(value))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+/*
+ * Returns a handler exposing the metrics
+ */
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+/*
+ * Quotes a label value, escaping backslashes, quotes and new lines
+ */
+func quote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
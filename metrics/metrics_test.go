@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounter("test_requests_total", "Requests handled", "code")
+	registry.NewGauge("test_idle", "Unlabelled gauge, never set")
+	registry.NewGaugeFunc("test_queue", "Collected gauge", func() []Sample {
+		return []Sample{{Labels: []string{`a"b\c`}, Value: 2.5}}
+	}, "name")
+
+	requests.Inc("200")
+	requests.Inc("200")
+	requests.Add(3, "429")
+
+	var b strings.Builder
+	registry.WriteTo(&b)
+	assert.Equal(t, `# HELP test_requests_total Requests handled
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="429"} 3
+# HELP test_idle Unlabelled gauge, never set
+# TYPE test_idle gauge
+test_idle 0
+# HELP test_queue Collected gauge
+# TYPE test_queue gauge
+test_queue{name="a\"b\\c"} 2.5
+`, b.String())
+	assert.Equal(t, float64(3), requests.Value("429"))
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewGauge("test_gauge", "A gauge").Set(7)
+
+	w := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/clammit/metrics", nil))
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, w.Body.String(), "test_gauge 7\n")
+}
+
+func TestMetric_NilSafe(t *testing.T) {
+	var m *Metric
+	m.Inc()
+	m.Set(1, "label")
+}
+
+func TestRegistry_Duplicate(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "A counter")
+	assert.Panics(t, func() { registry.NewGauge("test_total", "Again") })
+}
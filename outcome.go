@@ -0,0 +1,137 @@
+/*
+ * Outcomes: what became of a request clammit answered itself, rather than
+ * forwarding it. Each one has a status code and a message, which can be
+ * configured along with extra response headers in [outcome] sections, and
+ * is rendered by Responses.
+ */
+package main
+
+import (
+	"clammit/forwarder"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Outcomes
+const (
+	OUTCOME_CLEAN                = "clean"
+	OUTCOME_VIRUS                = "virus"
+	OUTCOME_POLICY               = "policy"
+	OUTCOME_SCAN_ERROR           = "scan-error"
+	OUTCOME_PARSE_ERROR          = "parse-error"
+	OUTCOME_UNSUPPORTED_ENCODING = "unsupported-encoding"
+	OUTCOME_TOO_LARGE            = "too-large"
+	OUTCOME_RATE_LIMITED         = "rate-limited"
+	OUTCOME_OVERLOADED           = "overloaded"
+	OUTCOME_UPSTREAM_ERROR       = "upstream-error"
+	OUTCOME_INTERNAL_ERROR       = "internal-error"
+)
+
+/*
+ * The built-in response to an outcome
+ */
+type outcomeDefault struct {
+	statusCode int
+	// The plain text message, which is also the built-in text template
+	message string
+}
+
+var outcomeDefaults = map[string]outcomeDefault{
+	OUTCOME_CLEAN:                {200, "No virus found"},
+	OUTCOME_VIRUS:                {418, "File {{.Filename}} has a virus!"},
+	OUTCOME_POLICY:               {415, "File {{.Filename}} is not allowed: {{.Signature}}"},
+	OUTCOME_SCAN_ERROR:           {500, "Internal Server Error\n"},
+	OUTCOME_PARSE_ERROR:          {400, "Bad Request\n"},
+	OUTCOME_UNSUPPORTED_ENCODING: {415, "Unsupported Media Type\n"},
+	OUTCOME_TOO_LARGE:            {413, "Request Entity Too Large\n"},
+	OUTCOME_RATE_LIMITED:         {429, "Too Many Requests\n"},
+	OUTCOME_OVERLOADED:           {503, "Service Unavailable\n"},
+	OUTCOME_UPSTREAM_ERROR:       {502, "Bad Gateway\n"},
+	OUTCOME_INTERNAL_ERROR:       {500, "Internal Server Error\n"},
+}
+
+/*
+ * Returns the outcome names, sorted
+ */
+func outcomeNames() []string {
+	names := make([]string, 0, len(outcomeDefaults))
+	for name := range outcomeDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * The configured response to an outcome
+ */
+type OutcomeResponse struct {
+	// Zero for the default status code
+	StatusCode int
+	// Added to the response
+	Header http.Header
+}
+
+/*
+ * Returns the outcome of an error: the one of the errors it knows, the
+ * fallback otherwise
+ */
+func outcomeOf(err error, fallback string) string {
+	var limitErr *forwarder.LimitError
+	var upstreamErr *forwarder.UpstreamError
+	switch {
+	case errors.As(err, &limitErr):
+		return OUTCOME_TOO_LARGE
+	case errors.As(err, &upstreamErr):
+		return OUTCOME_UPSTREAM_ERROR
+	case errors.Is(err, errSpoolFull):
+		return OUTCOME_OVERLOADED
+	}
+	return fallback
+}
+
+/*
+ * Constructs the outcome responses from the [outcome] sections
+ */
+func buildOutcomes(configs map[string]*OutcomeConfig) (map[string]*OutcomeResponse, error) {
+	outcomes := make(map[string]*OutcomeResponse, len(configs))
+	for name, config := range configs {
+		if _, ok := outcomeDefaults[name]; !ok {
+			return nil, fmt.Errorf("Unknown outcome %s (expected one of %s)", name, strings.Join(outcomeNames(), ", "))
+		}
+		if config.StatusCode != 0 {
+			if err := validateStatusCode("status-code", config.StatusCode); err != nil {
+				return nil, fmt.Errorf("Outcome %s: %s", name, err.Error())
+			}
+		}
+		outcome := &OutcomeResponse{StatusCode: config.StatusCode, Header: http.Header{}}
+		for _, header := range config.Headers {
+			key, value, found := strings.Cut(header, ":")
+			if key = strings.TrimSpace(key); !found || key == "" || strings.ContainsAny(key, " \t") {
+				return nil, fmt.Errorf("Outcome %s: invalid header (expected Name: value): %s", name, header)
+			}
+			outcome.Header.Add(key, strings.TrimSpace(value))
+		}
+		outcomes[name] = outcome
+	}
+	return outcomes, nil
+}
+
+/*
+ * Constructs the responses: the templates and the configured outcomes
+ */
+func buildResponses(config *Config) (*Responses, error) {
+	outcomes, err := buildOutcomes(config.Outcomes)
+	if err != nil {
+		return nil, err
+	}
+	responses, err := LoadResponses(config.App.ResponseTemplates, config.App.SupportContact)
+	if err != nil {
+		return nil, err
+	}
+	responses.Outcomes = outcomes
+	return responses, nil
+}
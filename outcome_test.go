@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"clammit/forwarder"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutcomeOf(t *testing.T) {
+	limitErr := &forwarder.LimitError{Limit: "max-part-size", Value: 10}
+	assert.Equal(t, OUTCOME_TOO_LARGE, outcomeOf(fmt.Errorf("reading part: %w", limitErr), OUTCOME_PARSE_ERROR))
+	assert.Equal(t, OUTCOME_UPSTREAM_ERROR, outcomeOf(&forwarder.UpstreamError{Err: errors.New("refused")}, OUTCOME_INTERNAL_ERROR))
+	assert.Equal(t, OUTCOME_PARSE_ERROR, outcomeOf(errors.New("unexpected EOF"), OUTCOME_PARSE_ERROR))
+}
+
+func TestBuildOutcomes(t *testing.T) {
+	outcomes, err := buildOutcomes(map[string]*OutcomeConfig{
+		"virus":          {StatusCode: 403, Headers: []string{"Cache-Control: no-store", "x-reason:infected"}},
+		"upstream-error": {Headers: []string{"Retry-After: 30"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 403, outcomes["virus"].StatusCode)
+	assert.Equal(t, http.Header{"Cache-Control": {"no-store"}, "X-Reason": {"infected"}}, outcomes["virus"].Header)
+	assert.Equal(t, 0, outcomes["upstream-error"].StatusCode)
+
+	for name, config := range map[string]*OutcomeConfig{
+		"infected":    {StatusCode: 403},
+		"parse-error": {StatusCode: 1000},
+		"clean":       {Headers: []string{"no colon"}},
+		"policy":      {Headers: []string{"Bad Name: value"}},
+	} {
+		_, err := buildOutcomes(map[string]*OutcomeConfig{name: config})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestResponses_Outcomes(t *testing.T) {
+	setup()
+	responses := &Responses{Outcomes: map[string]*OutcomeResponse{
+		OUTCOME_VIRUS:       {StatusCode: 403, Header: http.Header{"Cache-Control": {"no-store"}}},
+		OUTCOME_PARSE_ERROR: {Header: http.Header{"X-Reason": {"malformed"}}},
+	}}
+
+	// The configured status code wins over the caller's
+	rr := blockResponse(responses, map[string]string{"Accept": "application/json"}, OUTCOME_VIRUS, 418, &ResponseData{Filename: "eicar.com"})
+	assert.Equal(t, 403, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	assert.Contains(t, rr.Body.String(), `"outcome":"virus","status":403`)
+
+	// Without one, the caller's, then the built-in
+	rr = blockResponse(responses, nil, OUTCOME_POLICY, 422, &ResponseData{})
+	assert.Equal(t, 422, rr.Code)
+	rr = blockResponse(responses, nil, OUTCOME_PARSE_ERROR, 0, &ResponseData{})
+	assert.Equal(t, 400, rr.Code)
+	assert.Equal(t, "malformed", rr.Header().Get("X-Reason"))
+	assert.Equal(t, "Bad Request\n", rr.Body.String())
+}
+
+func TestScanInterceptor_Outcomes(t *testing.T) {
+	setup()
+	responses := &Responses{Outcomes: map[string]*OutcomeResponse{
+		OUTCOME_PARSE_ERROR:    {StatusCode: 422},
+		OUTCOME_UPSTREAM_ERROR: {StatusCode: 503, Header: http.Header{"Retry-After": {"30"}}},
+	}}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: &recordingScanner{}, Responses: responses}
+
+	// Malformed messages
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	writePart(t, w, "message/rfc822", `form-data; name="upload"`, "not a header\r\n")
+	w.Close()
+	req := newHTTPRequest("POST", w.FormDataContentType(), body)
+	rr := httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 422, rr.Code)
+
+	// Unsupported content encodings keep their default
+	req = newHTTPRequest("POST", "text/plain", strings.NewReader("clean"))
+	req.Header.Set("Content-Encoding", "compress")
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 415, rr.Code)
+
+	// Applications that cannot be reached
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Close()
+	req = newHTTPRequest("POST", "text/plain", strings.NewReader("clean"))
+	rr = httptest.NewRecorder()
+	forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, req)
+	assert.Equal(t, 503, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "Bad Gateway\n", rr.Body.String())
+}
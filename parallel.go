@@ -0,0 +1,243 @@
+/*
+ * Parallel scanning of the parts of a request: the parts are still read one
+ * after another, but each is spooled and scanned in the background, so that
+ * a request with many attachments does not wait for as many clamd round
+ * trips in series.
+ */
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// The size up to which spooled parts are held in memory, larger ones are
+// written to a temporary file
+const spoolMemoryLimit = 1024 * 1024
+
+var errScanCancelled = errors.New("scan cancelled")
+
+/*
+ * The background scans of the parts of a request. Each scan writes its
+ * response, if any, to its own buffer: once they are all over, the response
+ * of the first part in order wins, as if they had been scanned one after
+ * another.
+ */
+type parallelScans struct {
+	// The response written while reading the parts, e.g. for a read error
+	response *bufferedResponse
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	scans    []*backgroundScan
+	// The index of the first part found infected, or MaxInt64
+	stop atomic.Int64
+}
+
+type backgroundScan struct {
+	response  *bufferedResponse
+	responded bool
+}
+
+/*
+ * Constructs the scans of a request, running at most parallelism of them at
+ * the same time
+ */
+func newParallelScans(parallelism int) *parallelScans {
+	p := &parallelScans{
+		response: newBufferedResponse(),
+		slots:    make(chan struct{}, parallelism),
+	}
+	p.stop.Store(math.MaxInt64)
+	return p
+}
+
+/*
+ * Starts a scan, once there is a free slot. The scan writes its response to
+ * the given writer, and returns whether it did. It should stop reading once
+ * cancelled returns true, which happens when a previous part was found
+ * infected.
+ */
+func (p *parallelScans) start(scan func(w http.ResponseWriter, cancelled func() bool) bool) {
+	index := int64(len(p.scans))
+	s := &backgroundScan{response: newBufferedResponse()}
+	p.scans = append(p.scans, s)
+	cancelled := func() bool { return p.stop.Load() < index }
+
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		if s.responded = scan(s.response, cancelled); s.responded {
+			// Cancel the scans of the following parts
+			for {
+				stop := p.stop.Load()
+				if index >= stop || p.stop.CompareAndSwap(stop, index) {
+					break
+				}
+			}
+		}
+	}()
+}
+
+/*
+ * Returns true once a part has been found infected, or could not be scanned
+ */
+func (p *parallelScans) stopped() bool {
+	return p.stop.Load() != math.MaxInt64
+}
+
+/*
+ * Waits for the scans to be over, and writes the response of the first part
+ * that has one or, failing that, the response written while reading the
+ * parts, if responded is true.
+ *
+ * returns True if a http response has been written
+ */
+func (p *parallelScans) finish(w http.ResponseWriter, responded bool) bool {
+	p.wg.Wait()
+	for _, s := range p.scans {
+		if s.responded {
+			s.response.replay(w)
+			return true
+		}
+	}
+	if responded {
+		p.response.replay(w)
+	}
+	return responded
+}
+
+/*
+ * A http.ResponseWriter holding the response, to write it later
+ */
+type bufferedResponse struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+/*
+ * Writes the response held
+ */
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	if b.statusCode != 0 {
+		w.WriteHeader(b.statusCode)
+	}
+	w.Write(b.body.Bytes())
+}
+
+/*
+ * Spools a part to scan it in the background: in memory up to
+ * spoolMemoryLimit, to a temporary file past it. The memory and disk space
+ * are reserved from the admission controller as the part is read. Returns
+ * false if they ran out: the reader then returns what was spooled followed
+ * by the rest of the part, to scan it inline. Either way, cleanup releases
+ * them.
+ */
+func spool(reader io.Reader, admission *Admission) (io.Reader, func(), bool, error) {
+	var releases []func()
+	reserve := func(memory int64, spool int64) bool {
+		release, ok := admission.Reserve(memory, spool)
+		if ok {
+			releases = append(releases, release)
+		}
+		return ok
+	}
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	if _, err := io.CopyN(buffer, reader, spoolMemoryLimit+1); err == io.EOF {
+		whole := reserve(int64(buffer.Len()), 0)
+		return buffer, release, whole, nil
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+	if !reserve(0, int64(buffer.Len())) {
+		return io.MultiReader(buffer, reader), release, false, nil
+	}
+	file, err := os.CreateTemp("", "clammit-part")
+	if err != nil {
+		release()
+		return nil, nil, false, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+		release()
+	}
+	if _, err := io.Copy(file, buffer); err != nil {
+		cleanup()
+		return nil, nil, false, err
+	}
+	whole := true
+	for {
+		if !reserve(0, admissionSpoolStep) {
+			whole = false
+			break
+		}
+		if _, err := io.CopyN(file, reader, admissionSpoolStep); err == io.EOF {
+			break
+		} else if err != nil {
+			cleanup()
+			return nil, nil, false, err
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, false, err
+	}
+	if !whole {
+		return io.MultiReader(file, reader), cleanup, false, nil
+	}
+	return file, cleanup, true, nil
+}
+
+/*
+ * A reader failing once cancelled, to stop a scan early
+ */
+type cancellableReader struct {
+	reader    io.Reader
+	cancelled func() bool
+}
+
+func (c *cancellableReader) Read(p []byte) (int, error) {
+	if c.cancelled() {
+		return 0, errScanCancelled
+	}
+	return c.reader.Read(p)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"clammit/clamdtest"
+	"clammit/client"
+	"clammit/scanner"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * A scanner taking its time: files containing "slow" take 100ms, others
+ * 20ms. Files containing "VIRUS" are infected.
+ */
+type slowScanner struct {
+	scanner.Engine
+	running, maxRunning, scans atomic.Int32
+}
+
+func (s *slowScanner) Scan(reader io.Reader) (*scanner.Result, error) {
+	running := s.running.Add(1)
+	defer s.running.Add(-1)
+	for {
+		max := s.maxRunning.Load()
+		if running <= max || s.maxRunning.CompareAndSwap(max, running) {
+			break
+		}
+	}
+	s.scans.Add(1)
+	data, err := io.ReadAll(reader)
+	if bytes.Contains(data, []byte("slow")) {
+		time.Sleep(100 * time.Millisecond)
+	} else {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return testResult(bytes.Contains(data, []byte("VIRUS"))), nil
+}
+
+func makeFilesBody(t *testing.T, contents ...string) (string, []byte) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for i, content := range contents {
+		part, err := w.CreateFormFile("file", fmt.Sprintf("file%d.txt", i+1))
+		require.NoError(t, err)
+		io.WriteString(part, content)
+	}
+	require.NoError(t, w.Close())
+	return w.FormDataContentType(), body.Bytes()
+}
+
+func TestScanInterceptor_Parallel(t *testing.T) {
+	setup()
+	scanner := &slowScanner{}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner, ScanParallelism: 3}
+
+	contentType, body := makeFilesBody(t, "clean", "clean", "clean", "clean", "clean", "clean")
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, int32(6), scanner.scans.Load())
+	assert.Equal(t, int32(3), scanner.maxRunning.Load())
+
+	// The first infected part is reported, even if it is not the first one
+	// found infected
+	contentType, body = makeFilesBody(t, "clean", "slow VIRUS", "VIRUS")
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+	assert.Equal(t, "File file2.txt has a virus!", rr.Body.String())
+
+	// A virus cancels the scans of the following parts
+	scanner.scans.Store(0)
+	contentType, body = makeFilesBody(t, "VIRUS", "slow", "slow", "slow", "slow", "slow", "slow", "slow", "slow", "slow")
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, "File file1.txt has a virus!", rr.Body.String())
+	assert.Less(t, scanner.scans.Load(), int32(10))
+
+	// Read errors after an infected part do not hide it
+	interceptor.MaxParts = 2
+	contentType, body = makeFilesBody(t, "slow VIRUS", "clean", "clean")
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+
+	contentType, body = makeFilesBody(t, "clean", "clean", "clean")
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Request Entity Too Large")
+}
+
+func TestScanInterceptor_ParallelClamd(t *testing.T) {
+	setup()
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(clamdtest.Found("EICAR", "Test.Virus"), clamdtest.Slow(50*time.Millisecond))
+	clamav := new(scanner.Clamav)
+	clamav.SetLogger(ctx.Logger, false)
+	clamav.SetAddress(clamd.URL)
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: clamav, ScanParallelism: 10}
+
+	contents := make([]string, 20)
+	for i := range contents {
+		contents[i] = "clean"
+	}
+	contentType, body := makeFilesBody(t, contents...)
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Less(t, time.Since(start), 20*50*time.Millisecond/2)
+	assert.Equal(t, 20, clamd.Scans())
+
+	contents[12] = string(clamdtest.EICAR)
+	contentType, body = makeFilesBody(t, contents...)
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, "File file13.txt has a virus!", rr.Body.String())
+}
+
+func TestScanInterceptor_ParallelOrder(t *testing.T) {
+	setup()
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         &slowScanner{},
+		ScanParallelism: 3,
+		Monitor:         true,
+		Verdict:         &VerdictSigner{Key: verdictKey, Scanner: &recordingScanner{}},
+	}
+
+	// Files with the same name are reported in request order, although the
+	// first one takes longer to scan
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, content := range []string{"slow VIRUS", "VIRUS", "clean"} {
+		part, err := w.CreateFormFile("file", "same.txt")
+		require.NoError(t, err)
+		io.WriteString(part, content)
+	}
+	require.NoError(t, w.Close())
+	req := newHTTPRequest("POST", w.FormDataContentType(), body)
+	assert.False(t, interceptor.Handle(httptest.NewRecorder(), req, req.Body))
+	var hashes []string
+	for _, content := range []string{"slow VIRUS", "VIRUS", "clean"} {
+		hashes = append(hashes, client.PartHash{Name: "same.txt", SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}.String())
+	}
+	assert.Equal(t, hashes, req.Header.Values(client.PartHashHeader))
+}
+
+func TestScanInterceptor_ParallelAdmission(t *testing.T) {
+	setup()
+	scanner := &slowScanner{}
+	admission := &Admission{MaxMemory: 10}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner, ScanParallelism: 3, Admission: admission}
+
+	// Parts that do not fit are scanned inline, and the spooled ones give
+	// their memory back
+	contentType, body := makeFilesBody(t, "clean", "too large to be spooled", "VIRUS")
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, "File file3.txt has a virus!", rr.Body.String())
+	assert.Equal(t, int32(3), scanner.scans.Load())
+	assert.Equal(t, int64(0), admission.Stats().Memory)
+}
+
+func TestSpool(t *testing.T) {
+	reader, cleanup, whole, err := spool(strings.NewReader("small"), nil)
+	require.NoError(t, err)
+	assert.True(t, whole)
+	data, _ := io.ReadAll(reader)
+	assert.Equal(t, "small", string(data))
+	cleanup()
+
+	large := strings.Repeat("x", spoolMemoryLimit+10)
+	admission := &Admission{MaxSpool: spoolMemoryLimit + 1 + admissionSpoolStep}
+	reader, cleanup, whole, err = spool(strings.NewReader(large), admission)
+	require.NoError(t, err)
+	assert.True(t, whole)
+	file, ok := reader.(*os.File)
+	require.True(t, ok, "large parts are spooled to disk")
+	assert.Equal(t, int64(spoolMemoryLimit+1+admissionSpoolStep), admission.Stats().Spool)
+	data, _ = io.ReadAll(reader)
+	assert.Equal(t, large, string(data))
+	cleanup()
+	_, err = os.Stat(file.Name())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), admission.Stats().Spool)
+
+	// Without room to spool it all, the part is read back whole
+	larger := strings.Repeat("x", spoolMemoryLimit+2*admissionSpoolStep)
+	reader, cleanup, whole, err = spool(strings.NewReader(larger), admission)
+	require.NoError(t, err)
+	assert.False(t, whole)
+	data, _ = io.ReadAll(reader)
+	assert.Equal(t, larger, string(data))
+	cleanup()
+	assert.Equal(t, int64(0), admission.Stats().Spool)
+}
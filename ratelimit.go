@@ -0,0 +1,294 @@
+/*
+ * Per-client rate limiting: token buckets of requests and body bytes per
+ * second, keyed by client address, a request header or the route. Clients
+ * over their limits are refused with a 429.
+ */
+package main
+
+import (
+	"clammit/forwarder"
+	"clammit/metrics"
+	"container/list"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idle buckets are forgotten once they are full again, checked this often
+const rateLimitPruneInterval = time.Minute
+
+/*
+ * Returns the rate limiting key of a request
+ */
+type RateLimitKey func(req *http.Request) string
+
+/*
+ * The rate limiter. Zero rates mean unlimited.
+ */
+type RateLimiter struct {
+	// Requests per second, and the number of requests allowed in a burst
+	Requests     float64
+	RequestBurst float64
+	// Body bytes per second, and the bytes allowed in a burst. Bodies larger
+	// than the burst are allowed when the bucket is full, and leave it in
+	// debt.
+	Bytes     float64
+	ByteBurst float64
+	// The key of the bucket each request is counted against
+	Key RateLimitKey
+	// Maximum number of keys tracked: beyond, the least recently used are
+	// forgotten. Zero means unlimited.
+	MaxKeys int
+	// Counter of refused requests, by reason, and of keys forgotten to stay
+	// within MaxKeys
+	Limited *metrics.Metric
+	Evicted *metrics.Metric
+
+	mutex   sync.Mutex
+	buckets map[string]*rateBuckets
+	// The buckets, most recently used first
+	recent    *list.List
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+/*
+ * The tokens left of a key. The bytes bucket can be in debt.
+ */
+type rateBuckets struct {
+	requests float64
+	bytes    float64
+	updated  time.Time
+	// The element of the buckets in the recently used list
+	element *list.Element
+}
+
+/*
+ * Builds the key function for the given setting: "ip" (the default) for the
+ * client address, "header:<name>" for the value of a request header, falling
+ * back to the client address when it is missing, or "route" for the name of
+ * the matching route.
+ */
+func NewRateLimitKey(setting string, proxies TrustedProxies, routes func() forwarder.Routes) (RateLimitKey, error) {
+	switch {
+	case setting == "" || setting == "ip":
+		return func(req *http.Request) string {
+			return "ip:" + proxies.ClientIP(req)
+		}, nil
+	case strings.HasPrefix(setting, "header:") && len(setting) > len("header:"):
+		header := http.CanonicalHeaderKey(strings.TrimPrefix(setting, "header:"))
+		return func(req *http.Request) string {
+			if value := req.Header.Get(header); value != "" {
+				return "header:" + value
+			}
+			return "ip:" + proxies.ClientIP(req)
+		}, nil
+	case setting == "route":
+		return func(req *http.Request) string {
+			if route := routes().Match(req); route != nil {
+				return "route:" + route.Name
+			}
+			return "route:" + defaultPolicyName
+		}, nil
+	}
+	return nil, fmt.Errorf("Invalid rate-limit-key: %s", setting)
+}
+
+/*
+ * Checks the request against the buckets of its key, or writes the
+ * rate-limited response with a Retry-After header. Bodies of
+ * unknown length are counted as they are read.
+ */
+func (l *RateLimiter) Allow(w http.ResponseWriter, req *http.Request, responses *Responses) bool {
+	if l == nil {
+		return true
+	}
+	key := l.Key(req)
+	size := float64(0)
+	if req.ContentLength > 0 {
+		size = float64(req.ContentLength)
+	}
+
+	l.mutex.Lock()
+	buckets := l.bucketsFor(key)
+	wait, reason := l.check(buckets, size)
+	if reason == "" && l.Requests > 0 {
+		buckets.requests--
+	}
+	if reason == "" && l.Bytes > 0 {
+		buckets.bytes -= size
+	}
+	l.mutex.Unlock()
+
+	if reason != "" {
+		l.Limited.Inc(reason)
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		ctx.Logger.Printf("Request %s %s rate limited: %s over the %s limit", req.Method, req.URL.Path, key, reason)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		responses.Respond(w, req, OUTCOME_RATE_LIMITED, &ResponseData{RetryAfter: retryAfter})
+		return false
+	}
+	if req.ContentLength < 0 && l.Bytes > 0 && req.Body != nil {
+		req.Body = &rateLimitedBody{ReadCloser: req.Body, limiter: l, key: key}
+	}
+	return true
+}
+
+/*
+ * Returns how long to wait and the limit reached, if the request cannot be
+ * allowed now. Must be called with the mutex held.
+ */
+func (l *RateLimiter) check(buckets *rateBuckets, size float64) (time.Duration, string) {
+	var wait time.Duration
+	reason := ""
+	if l.Requests > 0 && buckets.requests < 1 {
+		wait = seconds((1 - buckets.requests) / l.Requests)
+		reason = "requests"
+	}
+	if l.Bytes > 0 {
+		needed := math.Min(size, l.byteBurst())
+		if buckets.bytes < needed {
+			if byteWait := seconds((needed - buckets.bytes) / l.Bytes); byteWait > wait {
+				wait = byteWait
+			}
+			reason = "bytes"
+		}
+	}
+	return wait, reason
+}
+
+/*
+ * Returns the buckets of the key, refilled up to now. Must be called with
+ * the mutex held.
+ */
+func (l *RateLimiter) bucketsFor(key string) *rateBuckets {
+	now := l.clock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBuckets)
+		l.recent = list.New()
+		l.lastPrune = now
+	}
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		for k, b := range l.buckets {
+			if l.refill(b, now) {
+				l.forget(k)
+			}
+		}
+		l.lastPrune = now
+	}
+	buckets, ok := l.buckets[key]
+	if !ok {
+		if l.MaxKeys > 0 && len(l.buckets) >= l.MaxKeys {
+			l.forget(l.recent.Back().Value.(string))
+			l.Evicted.Inc()
+		}
+		buckets = &rateBuckets{
+			requests: l.requestBurst(),
+			bytes:    l.byteBurst(),
+			updated:  now,
+			element:  l.recent.PushFront(key),
+		}
+		l.buckets[key] = buckets
+	}
+	l.recent.MoveToFront(buckets.element)
+	l.refill(buckets, now)
+	return buckets
+}
+
+/*
+ * Forgets the buckets of a key. Must be called with the mutex held.
+ */
+func (l *RateLimiter) forget(key string) {
+	l.recent.Remove(l.buckets[key].element)
+	delete(l.buckets, key)
+}
+
+/*
+ * Adds the tokens earned since the last update, and returns true if the
+ * buckets are full
+ */
+func (l *RateLimiter) refill(buckets *rateBuckets, now time.Time) bool {
+	elapsed := now.Sub(buckets.updated).Seconds()
+	buckets.updated = now
+	buckets.requests = math.Min(buckets.requests+elapsed*l.Requests, l.requestBurst())
+	buckets.bytes = math.Min(buckets.bytes+elapsed*l.Bytes, l.byteBurst())
+	return buckets.requests >= l.requestBurst() && buckets.bytes >= l.byteBurst()
+}
+
+/*
+ * Takes body bytes from the bucket of the key
+ */
+func (l *RateLimiter) charge(key string, n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bucketsFor(key).bytes -= float64(n)
+}
+
+/*
+ * Bursts default to one second worth of the rate, and at least one request
+ */
+func (l *RateLimiter) requestBurst() float64 {
+	if l.RequestBurst > 0 {
+		return l.RequestBurst
+	}
+	return math.Max(math.Ceil(l.Requests), 1)
+}
+
+func (l *RateLimiter) byteBurst() float64 {
+	if l.ByteBurst > 0 {
+		return l.ByteBurst
+	}
+	return l.Bytes
+}
+
+func (l *RateLimiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+/*
+ * Returns the number of keys tracked, and of those currently limited
+ */
+func (l *RateLimiter) Stats() (keys int, limited int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock()
+	for _, buckets := range l.buckets {
+		l.refill(buckets, now)
+		if _, reason := l.check(buckets, 0); reason != "" {
+			limited++
+		}
+	}
+	return len(l.buckets), limited
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+/*
+ * Counts body bytes against the bucket as they are read
+ */
+type rateLimitedBody struct {
+	io.ReadCloser
+	limiter *RateLimiter
+	key     string
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.charge(b.key, n)
+	}
+	return n, err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"clammit/forwarder"
+	"clammit/metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gcfg.v1"
+)
+
+/*
+ * A rate limiter on a fake clock, keyed by remote address
+ */
+func newTestRateLimiter(limiter *RateLimiter) (*RateLimiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	limiter.Key = func(req *http.Request) string { return req.RemoteAddr }
+	return limiter, &now
+}
+
+func rateLimitedRequest(remote string, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+	req.RemoteAddr = remote
+	return req
+}
+
+func TestRateLimiter_Requests(t *testing.T) {
+	setup()
+	limiter, now := newTestRateLimiter(&RateLimiter{Requests: 2, RequestBurst: 3})
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil), "request %d", i)
+	}
+	rr := httptest.NewRecorder()
+	assert.False(t, limiter.Allow(rr, rateLimitedRequest("a", "x"), nil))
+	assert.Equal(t, 429, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "Too Many Requests\n", rr.Body.String())
+
+	// The response comes from the templates
+	responses, err := LoadResponses(writeTemplates(t, map[string]string{"rate-limited.txt": "Retry in {{.RetryAfter}}s"}), "")
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	assert.False(t, limiter.Allow(rr, rateLimitedRequest("a", "x"), responses))
+	assert.Equal(t, "Retry in 1s", rr.Body.String())
+
+	// Other clients have their own bucket
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("b", "x"), nil))
+
+	// Two requests per second
+	*now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+	assert.False(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+
+	keys, limited := limiter.Stats()
+	assert.Equal(t, 2, keys)
+	assert.Equal(t, 1, limited)
+
+	// Full buckets are forgotten
+	*now = now.Add(rateLimitPruneInterval)
+	limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("c", "x"), nil)
+	keys, _ = limiter.Stats()
+	assert.Equal(t, 1, keys)
+}
+
+func TestRateLimiter_Bytes(t *testing.T) {
+	setup()
+	registry := metrics.NewRegistry()
+	limiter, now := newTestRateLimiter(&RateLimiter{
+		Bytes:   10,
+		Limited: registry.NewCounter("limited_total", "Limited", "limit"),
+	})
+
+	// Larger than the burst, but the bucket is full
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", strings.Repeat("x", 30)), nil))
+
+	// 20 bytes in debt: 3 seconds to have a full burst again
+	rr := httptest.NewRecorder()
+	assert.False(t, limiter.Allow(rr, rateLimitedRequest("a", strings.Repeat("x", 20)), nil))
+	assert.Equal(t, "3", rr.Header().Get("Retry-After"))
+	assert.Equal(t, float64(1), limiter.Limited.Value("bytes"))
+
+	*now = now.Add(3 * time.Second)
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "1234567890"), nil))
+}
+
+func TestRateLimiter_UnknownLength(t *testing.T) {
+	setup()
+	limiter, _ := newTestRateLimiter(&RateLimiter{Bytes: 10})
+
+	req := rateLimitedRequest("a", strings.Repeat("x", 25))
+	req.ContentLength = -1
+	require.True(t, limiter.Allow(httptest.NewRecorder(), req, nil))
+
+	// The body is counted as it is read
+	data, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Len(t, data, 25)
+	assert.False(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+}
+
+func TestRateLimiter_MaxKeys(t *testing.T) {
+	setup()
+	evicted := metrics.NewRegistry().NewCounter("evicted", "")
+	limiter, _ := newTestRateLimiter(&RateLimiter{Requests: 1, MaxKeys: 2, Evicted: evicted})
+
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("b", "x"), nil))
+	assert.False(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+
+	// A new key forgets the least recently used one, b
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("c", "x"), nil))
+	keys, _ := limiter.Stats()
+	assert.Equal(t, 2, keys)
+	assert.Equal(t, float64(1), evicted.Value())
+	assert.False(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil), "a is still limited")
+	assert.True(t, limiter.Allow(httptest.NewRecorder(), rateLimitedRequest("b", "x"), nil), "b starts over")
+	assert.Equal(t, float64(2), evicted.Value())
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	assert.True(t, (*RateLimiter)(nil).Allow(httptest.NewRecorder(), rateLimitedRequest("a", "x"), nil))
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "203.0.113.7", proxies.ClientIP(req), "untrusted peers cannot forward")
+
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 198.51.100.1")
+	req.Header.Add("X-Forwarded-For", "192.168.1.1")
+	assert.Equal(t, "198.51.100.1", proxies.ClientIP(req), "the rightmost untrusted address")
+
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.1.2.3", proxies.ClientIP(req))
+
+	req.RemoteAddr = "@"
+	req.Header.Set("X-Forwarded-For", "198.51.100.2")
+	assert.Equal(t, "198.51.100.2", proxies.ClientIP(req), "unix socket peers are trusted")
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies([]string{"proxy.local"})
+	assert.Error(t, err)
+}
+
+func TestNewRateLimitKey(t *testing.T) {
+	routes := forwarder.NewRoutes([]*forwarder.Route{{Name: "api", PathPrefix: "/api"}})
+	getRoutes := func() forwarder.Routes { return routes }
+
+	req := httptest.NewRequest("POST", "/api/upload", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+
+	key, err := NewRateLimitKey("", nil, getRoutes)
+	require.NoError(t, err)
+	assert.Equal(t, "ip:203.0.113.7", key(req))
+
+	key, err = NewRateLimitKey("header:x-api-key", nil, getRoutes)
+	require.NoError(t, err)
+	assert.Equal(t, "ip:203.0.113.7", key(req))
+	req.Header.Set("X-Api-Key", "tenant1")
+	assert.Equal(t, "header:tenant1", key(req))
+
+	key, err = NewRateLimitKey("route", nil, getRoutes)
+	require.NoError(t, err)
+	assert.Equal(t, "route:api", key(req))
+	assert.Equal(t, "route:default", key(httptest.NewRequest("POST", "/other", nil)))
+
+	_, err = NewRateLimitKey("cookie", nil, getRoutes)
+	assert.Error(t, err)
+	_, err = NewRateLimitKey("header:", nil, getRoutes)
+	assert.Error(t, err)
+}
+
+func TestBuildRateLimiter(t *testing.T) {
+	var config Config
+	err := gcfg.ReadStringInto(&config, `
+[application]
+rate-limit-requests = 0.5
+rate-limit-bytes    = 1048576
+rate-limit-key      = header:X-Tenant
+trusted-proxy       = 10.0.0.0/8, ::1
+`)
+	require.NoError(t, err)
+
+	limited := metrics.NewRegistry().NewCounter("limited_total", "Limited", "limit")
+	limiter, err := buildRateLimiter(&config.App, limited, nil)
+	require.NoError(t, err)
+	require.NotNil(t, limiter)
+	assert.Equal(t, 0.5, limiter.Requests)
+	assert.Equal(t, float64(1), limiter.requestBurst())
+	assert.Equal(t, limited, limiter.Limited)
+
+	config.App.RateLimitRequests, config.App.RateLimitBytes = 0, 0
+	limiter, err = buildRateLimiter(&config.App, limited, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, limiter)
+
+	config.App.RateLimitKey = "nonsense"
+	_, err = buildRateLimiter(&config.App, limited, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,242 @@
+/*
+ * Live configuration reload. Everything built from the configuration lives
+ * in a Runtime, which is swapped as a whole on SIGHUP: requests pick up the
+ * current Runtime when they start, so in-flight requests finish with the
+ * configuration they started with.
+ */
+package main
+
+import (
+	"clammit/forwarder"
+	"clammit/scanner"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+/*
+ * The state built from the configuration
+ */
+type Runtime struct {
+	Config          Config
+	ApplicationURL  *url.URL
+	ScanInterceptor *ScanInterceptor
+	Scanner         scanner.Scanner
+	Backends        []*forwarder.Backend
+	Routes          forwarder.Routes
+	Admission       *Admission
+	RateLimiter     *RateLimiter
+	Authenticator   *Authenticator
+	Responses       *Responses
+}
+
+/*
+ * Returns the current runtime
+ */
+func (c *Ctx) Runtime() *Runtime {
+	return c.runtime.Load()
+}
+
+/*
+ * Replaces the current runtime
+ */
+func (c *Ctx) SetRuntime(rt *Runtime) {
+	c.runtime.Store(rt)
+}
+
+/*
+ * Builds and validates the runtime of a configuration
+ */
+func buildRuntime(config *Config) (*Runtime, error) {
+	rt := &Runtime{Config: *config}
+	var err error
+
+	if rt.ApplicationURL, err = url.Parse(config.App.ApplicationURL); err != nil {
+		return nil, fmt.Errorf("Invalid application-url: %s", config.App.ApplicationURL)
+	}
+	if _, err = url.Parse(config.App.ClamdURL); err != nil {
+		return nil, fmt.Errorf("Invalid clamd-url: %s", config.App.ClamdURL)
+	}
+	if rt.Backends, err = buildBackends(config.Backends); err != nil {
+		return nil, err
+	}
+	if rt.Routes, err = buildRoutes(config.Routes, rt.Backends); err != nil {
+		return nil, err
+	}
+
+	rt.Scanner = new(scanner.Clamav)
+	rt.Scanner.SetLogger(ctx.Logger, config.App.Debug)
+	rt.Scanner.SetAddress(config.App.ClamdURL)
+
+	if rt.Responses, err = buildResponses(config); err != nil {
+		return nil, err
+	}
+
+	rt.ScanInterceptor = &ScanInterceptor{
+		VirusStatusCode:  config.App.VirusStatusCode,
+		PolicyStatusCode: config.App.PolicyStatusCode,
+		Scanner:          rt.Scanner,
+		MaxBodySize:      config.App.MaxBodySize,
+		MaxPartSize:      config.App.MaxPartSize,
+		MaxParts:         config.App.MaxParts,
+		MaxExtractSize:   config.App.MaxExtractSize,
+		MaxDecodedSize:   config.App.MaxDecodedSize,
+		MaxDecodeRatio:   config.App.MaxDecodeRatio,
+		ScanParallelism:  config.App.ScanParallelism,
+		Monitor:          config.App.Monitor,
+		MonitorRoutes:    make(map[string]bool),
+		Detections:       ctx.Detections,
+		Responses:        rt.Responses,
+		Debug:            config.App.Debug,
+	}
+	for name, route := range config.Routes {
+		if route.Monitor {
+			rt.ScanInterceptor.MonitorRoutes[name] = true
+		}
+	}
+	if rt.ScanInterceptor.Verdict, err = buildVerdictSigner(&config.App, rt.Scanner); err != nil {
+		return nil, err
+	}
+	if err = buildPolicies(rt.ScanInterceptor, config.Policies, config.Routes); err != nil {
+		return nil, err
+	}
+	if rt.Admission, err = buildAdmission(&config.App); err != nil {
+		return nil, err
+	}
+	rt.ScanInterceptor.Admission = rt.Admission
+	if rt.RateLimiter, err = buildRateLimiter(&config.App, ctx.RateLimited, ctx.RateLimitEvicted); err != nil {
+		return nil, err
+	}
+	if rt.Authenticator, err = buildAuthenticator(&config.App); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+/*
+ * Re-reads the configuration file and the environment, and swaps in the new
+ * runtime if it is valid. The admission controller and the rate limiter are
+ * kept when their settings have not changed, so that their state survives.
+ * The log file is reopened, to play well with logrotate.
+ */
+func reload() error {
+	config, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+	rt, err := buildRuntime(config)
+	if err != nil {
+		return err
+	}
+	// Only once the configuration is known to be valid, so that a failed
+	// reload keeps logging where it did
+	if err := reopenLog(config.App.Logfile); err != nil {
+		return err
+	}
+
+	old := ctx.Runtime()
+	if sameAdmissionConfig(&old.Config.App, &config.App) {
+		rt.Admission = old.Admission
+		rt.ScanInterceptor.Admission = old.Admission
+	}
+	if sameRateLimitConfig(&old.Config.App, &config.App) {
+		rt.RateLimiter = old.RateLimiter
+	}
+	for _, setting := range restartSettings(&ctx.Config.App, &config.App) {
+		ctx.Logger.Printf("Changing %s requires a restart, ignored", setting)
+	}
+	runtime.GOMAXPROCS(config.App.NumThreads)
+
+	ctx.SetRuntime(rt)
+	return nil
+}
+
+/*
+ * Reloads the configuration on SIGHUP
+ */
+func handleReload() {
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGHUP)
+	go func() {
+		for range sigchan {
+			ctx.Logger.Println("Received reload signal")
+			if err := reload(); err != nil {
+				ctx.Logger.Println("Configuration reload failed, keeping the current configuration:", err)
+			} else {
+				ctx.Logger.Println("Configuration reloaded")
+			}
+		}
+	}()
+}
+
+/*
+ * Reopens the log file, which may have been moved away, or changed in the
+ * configuration
+ */
+func reopenLog(filename string) error {
+	if filename == "" {
+		if ctx.logFile != nil {
+			ctx.Logger.SetOutput(os.Stdout)
+			ctx.logFile.Close()
+			ctx.logFile = nil
+		}
+		return nil
+	}
+	w, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file %s: %s", filename, err.Error())
+	}
+	ctx.Logger.SetOutput(w)
+	if ctx.logFile != nil {
+		ctx.logFile.Close()
+	}
+	ctx.logFile = w
+	return nil
+}
+
+func sameAdmissionConfig(a, b *ApplicationConfig) bool {
+	return a.MaxConcurrentScans == b.MaxConcurrentScans &&
+		a.MaxMemoryBytes == b.MaxMemoryBytes &&
+		a.MaxSpoolBytes == b.MaxSpoolBytes &&
+		a.AdmissionQueueSize == b.AdmissionQueueSize &&
+		a.AdmissionTimeout == b.AdmissionTimeout &&
+		a.RetryAfter == b.RetryAfter &&
+		a.ContentMemoryThreshold == b.ContentMemoryThreshold &&
+		a.MaxBodySize == b.MaxBodySize
+}
+
+func sameRateLimitConfig(a, b *ApplicationConfig) bool {
+	return a.RateLimitRequests == b.RateLimitRequests &&
+		a.RateLimitBurst == b.RateLimitBurst &&
+		a.RateLimitBytes == b.RateLimitBytes &&
+		a.RateLimitBytesBurst == b.RateLimitBytesBurst &&
+		a.RateLimitKey == b.RateLimitKey &&
+		a.RateLimitMaxKeys == b.RateLimitMaxKeys &&
+		strings.Join(a.TrustedProxies, ",") == strings.Join(b.TrustedProxies, ",")
+}
+
+/*
+ * Returns the settings that differ, and are only read at startup
+ */
+func restartSettings(a, b *ApplicationConfig) []string {
+	var changed []string
+	check := func(setting string, same bool) {
+		if !same {
+			changed = append(changed, setting)
+		}
+	}
+	check("listen", a.Listen == b.Listen)
+	check("admin-listen", a.AdminListen == b.AdminListen)
+	check("unix-socket-perms", a.SocketPerms == b.SocketPerms)
+	check("tls-cert-file", a.TLSCertFile == b.TLSCertFile)
+	check("tls-key-file", a.TLSKeyFile == b.TLSKeyFile)
+	check("tls-client-ca-file", a.TLSClientCAFile == b.TLSClientCAFile)
+	check("tls-client-auth", a.TLSClientAuth == b.TLSClientAuth)
+	check("tls-min-version", a.TLSMinVersion == b.TLSMinVersion)
+	check("test-pages", a.TestPages == b.TestPages)
+	return changed
+}
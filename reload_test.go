@@ -0,0 +1,172 @@
+package main
+
+import (
+	"clammit/metrics"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * Starts clammit's context from the given configuration file contents, and
+ * returns the function to rewrite the file
+ */
+func setupReload(t *testing.T, contents string) func(string) {
+	filename := filepath.Join(t.TempDir(), "clammit.cfg")
+	write := func(contents string) {
+		require.NoError(t, os.WriteFile(filename, []byte(contents), 0600))
+	}
+	write(contents)
+
+	previous := configFile
+	configFile = filename
+	t.Cleanup(func() { configFile = previous })
+
+	ctx = &Ctx{Logger: log.New(os.Stdout, "", log.LstdFlags), Metrics: metrics.NewRegistry()}
+	registerMetrics(ctx.Metrics)
+	config, err := readConfig(configFile)
+	require.NoError(t, err)
+	ctx.Config = *config
+	rt, err := buildRuntime(config)
+	require.NoError(t, err)
+	ctx.SetRuntime(rt)
+	return write
+}
+
+func TestReload(t *testing.T) {
+	write := setupReload(t, `
+[application]
+application-url      = http://localhost:9000/
+virus-status-code    = 418
+max-concurrent-scans = 4
+rate-limit-requests  = 10
+`)
+	inFlight := ctx.Runtime()
+
+	write(`
+[application]
+application-url      = http://localhost:9001/
+virus-status-code    = 451
+max-concurrent-scans = 4
+rate-limit-requests  = 20
+listen               = :9999
+
+[backend "documents"]
+url = http://documents:8080/
+
+[route "uploads"]
+path-prefix = /documents
+backend     = documents
+`)
+	require.NoError(t, reload())
+
+	rt := ctx.Runtime()
+	assert.Equal(t, 451, rt.ScanInterceptor.VirusStatusCode)
+	assert.Equal(t, "localhost:9001", rt.ApplicationURL.Host)
+	assert.Len(t, rt.Routes, 1)
+	assert.Same(t, inFlight.Admission, rt.Admission, "unchanged admission limits keep their state")
+	assert.Same(t, rt.Admission, rt.ScanInterceptor.Admission)
+	assert.NotSame(t, inFlight.RateLimiter, rt.RateLimiter)
+	assert.Equal(t, float64(20), rt.RateLimiter.Requests)
+	assert.Equal(t, ":8438", ctx.Config.App.Listen, "the listen address needs a restart")
+
+	// In-flight requests keep the configuration they started with
+	assert.Equal(t, 418, inFlight.ScanInterceptor.VirusStatusCode)
+	assert.Equal(t, "localhost:9000", inFlight.ApplicationURL.Host)
+}
+
+func TestReload_Invalid(t *testing.T) {
+	write := setupReload(t, `
+[application]
+virus-status-code = 418
+`)
+	current := ctx.Runtime()
+
+	write(`
+[application]
+virus-status-code = 451
+
+[route "uploads"]
+backend = nowhere
+`)
+	assert.Error(t, reload())
+	assert.Same(t, current, ctx.Runtime())
+
+	write(`[application`)
+	assert.Error(t, reload())
+	assert.Same(t, current, ctx.Runtime())
+}
+
+func TestReload_LogFile(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "clammit.log")
+	write := setupReload(t, "[application]\nlog-file = "+logFile+"\n")
+	t.Cleanup(func() {
+		ctx.Logger.SetOutput(os.Stdout)
+		ctx.logFile.Close()
+	})
+	require.NoError(t, reopenLog(logFile))
+	ctx.Logger.Println("before rotation")
+
+	// logrotate moves the file away, then signals clammit
+	require.NoError(t, os.Rename(logFile, logFile+".1"))
+	require.NoError(t, reload())
+	ctx.Logger.Println("after rotation")
+
+	rotated, err := os.ReadFile(logFile + ".1")
+	require.NoError(t, err)
+	current, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(rotated), "before rotation")
+	assert.NotContains(t, string(rotated), "after rotation")
+	assert.Contains(t, string(current), "after rotation")
+
+	// An invalid configuration does not move the log either
+	otherLogFile := filepath.Join(t.TempDir(), "other.log")
+	write("[application]\nlog-file = " + otherLogFile + "\n\n[route \"uploads\"]\nbackend = nowhere\n")
+	assert.Error(t, reload())
+	ctx.Logger.Println("after failed reload")
+	assert.NoFileExists(t, otherLogFile)
+	current, err = os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(current), "after failed reload")
+}
+
+func TestReload_Signal(t *testing.T) {
+	write := setupReload(t, "[application]\nvirus-status-code = 418\n")
+	handleReload()
+
+	write("[application]\nvirus-status-code = 451\n")
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.Runtime().ScanInterceptor.VirusStatusCode != 451 {
+		if time.Now().After(deadline) {
+			t.Fatal("The configuration was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	setupReload(t, `
+[application]
+max-concurrent-scans = 4
+rate-limit-requests  = 10
+`)
+	release, err := ctx.Runtime().Admission.Acquire(context.Background(), 0, 0)
+	require.NoError(t, err)
+	defer release()
+
+	var b strings.Builder
+	ctx.Metrics.WriteTo(&b)
+	assert.Contains(t, b.String(), "clammit_admission_in_flight 1\n")
+	assert.Contains(t, b.String(), "clammit_rate_limit_keys 0\n")
+}
@@ -0,0 +1,387 @@
+/*
+ * Responses: the responses clammit writes itself, for the outcomes of the
+ * requests, rendered from templates in the format the client accepts (HTML,
+ * JSON or plain text) and, if there are translations, in its language.
+ *
+ * Templates are read from a directory: <outcome>.<format>, e.g. virus.html,
+ * and <language>/<outcome>.<format> for the translations, e.g. fr/virus.html.
+ * Those missing fall back to the untranslated ones, then to the built-in
+ * ones.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// The header carrying the request ID, generated if the client did not send one
+const requestIDHeader = "X-Request-Id"
+
+/*
+ * A response format: its template file extension and its content type
+ */
+type responseFormat struct {
+	extension   string
+	contentType string
+}
+
+// The formats, in order of preference when the client accepts several
+var responseFormats = []responseFormat{
+	{"txt", "text/plain; charset=utf-8"},
+	{"html", "text/html; charset=utf-8"},
+	{"json", "application/json"},
+}
+
+const defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Status}}</title></head>
+<body>
+<h1>{{.Status}}</h1>
+<p>{{.Message}}</p>
+{{if .SupportContact}}<p>If you need help, contact {{.SupportContact}} and mention the request ID {{.RequestID}}.</p>
+{{else}}<p>Request ID: {{.RequestID}}</p>
+{{end}}</body>
+</html>
+`
+
+/*
+ * The variables of the templates
+ */
+type ResponseData struct {
+	Outcome    string `json:"outcome"`
+	StatusCode int    `json:"status"`
+	// The status text, e.g. "Payload Too Large"
+	Status string `json:"-"`
+	// The plain text message, e.g. "File eicar.com has a virus!"
+	Message string `json:"message"`
+	// The file, or the part of the request, at fault
+	Filename string `json:"file,omitempty"`
+	// The virus found, or the reason the file type is not allowed
+	Signature      string `json:"signature,omitempty"`
+	RequestID      string `json:"request_id"`
+	SupportContact string `json:"support_contact,omitempty"`
+	// Seconds to wait before retrying, for rate limited requests
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+/*
+ * A template, HTML or text
+ */
+type responseTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+/*
+ * The response templates, and the configured outcomes
+ */
+type Responses struct {
+	SupportContact string
+	// The outcomes configured, by name
+	Outcomes map[string]*OutcomeResponse
+	// Templates by language ("" for the untranslated ones), then by outcome
+	// and format, e.g. "virus.html"
+	templates map[string]map[string]responseTemplate
+}
+
+// The built-in templates
+var builtinResponses = &Responses{templates: map[string]map[string]responseTemplate{"": builtinTemplates()}}
+
+func builtinTemplates() map[string]responseTemplate {
+	templates := map[string]responseTemplate{}
+	for outcome, defaults := range outcomeDefaults {
+		templates[outcome+".txt"] = texttemplate.Must(texttemplate.New(outcome).Parse(defaults.message))
+		templates[outcome+".html"] = htmltemplate.Must(htmltemplate.New(outcome).Parse(defaultHTMLTemplate))
+	}
+	return templates
+}
+
+/*
+ * Reads the templates of a directory. Without a directory, only the
+ * built-in templates are used.
+ */
+func LoadResponses(dir string, supportContact string) (*Responses, error) {
+	r := &Responses{SupportContact: supportContact, templates: map[string]map[string]responseTemplate{}}
+	if dir == "" {
+		return r, nil
+	}
+	if err := r.loadDir(dir, ""); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := r.loadDir(filepath.Join(dir, entry.Name()), strings.ToLower(entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *Responses) loadDir(dir string, language string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	templates := map[string]responseTemplate{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		outcome, extension, _ := strings.Cut(name, ".")
+		if !knownResponse(outcome, extension) {
+			return fmt.Errorf("Unknown response template %s (expected <outcome>.<html|json|txt>, the outcomes being %s)", filepath.Join(dir, name), strings.Join(outcomeNames(), ", "))
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		var t responseTemplate
+		if extension == "html" {
+			t, err = htmltemplate.New(name).Parse(string(data))
+		} else {
+			t, err = texttemplate.New(name).Funcs(texttemplate.FuncMap{"json": jsonValue}).Parse(string(data))
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid response template %s: %s", filepath.Join(dir, name), err.Error())
+		}
+		templates[outcome+"."+extension] = t
+	}
+	r.templates[language] = templates
+	return nil
+}
+
+func knownResponse(outcome string, extension string) bool {
+	for _, format := range responseFormats {
+		if format.extension == extension {
+			_, ok := outcomeDefaults[outcome]
+			return ok
+		}
+	}
+	return false
+}
+
+/*
+ * Encodes a value as JSON, for the JSON templates: {{json .Filename}}
+ */
+func jsonValue(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+/*
+ * Writes the response to an outcome, with the status code and headers
+ * configured for it. data.StatusCode, if set, replaces the built-in status
+ * code of the outcome, but not the configured one. Templates that fail are
+ * logged, and the built-in plain text is sent instead. Nil-safe: without
+ * templates, the built-in ones are used.
+ */
+func (r *Responses) Respond(w http.ResponseWriter, req *http.Request, outcome string, data *ResponseData) {
+	if r == nil {
+		r = builtinResponses
+	}
+	configured := r.Outcomes[outcome]
+	if data.StatusCode == 0 {
+		data.StatusCode = outcomeDefaults[outcome].statusCode
+	}
+	if configured != nil && configured.StatusCode != 0 {
+		data.StatusCode = configured.StatusCode
+	}
+	data.Outcome = outcome
+	data.Status = http.StatusText(data.StatusCode)
+	data.SupportContact = r.SupportContact
+	if data.RequestID = req.Header.Get(requestIDHeader); data.RequestID == "" {
+		data.RequestID = newRequestID()
+	}
+	data.Message = strings.TrimSpace(render(builtinResponses.templates[""][outcome+".txt"], data))
+
+	format := negotiateFormat(req.Header.Values("Accept"))
+	body := &bytes.Buffer{}
+	if t := r.template(req, outcome, format.extension); t != nil {
+		if err := t.Execute(body, data); err != nil {
+			ctx.Logger.Printf("Unable to render the %s response template: %v", outcome+"."+format.extension, err)
+			format, body = responseFormats[0], bytes.NewBufferString(render(builtinResponses.templates[""][outcome+".txt"], data))
+		}
+	} else if format.extension == "json" {
+		json.NewEncoder(body).Encode(data)
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(requestIDHeader, data.RequestID)
+	w.Header().Add("Vary", "Accept, Accept-Language")
+	if configured != nil {
+		for key, values := range configured.Header {
+			w.Header()[key] = append(w.Header()[key], values...)
+		}
+	}
+	w.WriteHeader(data.StatusCode)
+	w.Write(body.Bytes())
+}
+
+/*
+ * Returns the template of the outcome and format, in the language the client
+ * prefers, or nil for the built-in JSON
+ */
+func (r *Responses) template(req *http.Request, outcome string, extension string) responseTemplate {
+	name := outcome + "." + extension
+	for _, language := range r.languages(req.Header.Values("Accept-Language")) {
+		if t, ok := r.templates[language][name]; ok {
+			return t
+		}
+	}
+	if t, ok := r.templates[""][name]; ok {
+		return t
+	}
+	return builtinResponses.templates[""][name]
+}
+
+/*
+ * Returns the languages of the templates the client accepts, preferred
+ * first. "fr-CA" matches the "fr-ca" templates, then the "fr" ones.
+ */
+func (r *Responses) languages(acceptLanguage []string) []string {
+	var languages []string
+	for _, tag := range parseQualityList(acceptLanguage) {
+		tag = strings.ToLower(tag)
+		for _, candidate := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if _, ok := r.templates[candidate]; ok && candidate != "" {
+				languages = append(languages, candidate)
+			}
+		}
+	}
+	return languages
+}
+
+/*
+ * Returns the format the client prefers, from its Accept header: plain
+ * text if it does not say
+ */
+func negotiateFormat(accept []string) responseFormat {
+	best, bestQuality := responseFormats[0], 0.0
+	for _, format := range responseFormats {
+		mediaType, _, _ := mime.ParseMediaType(format.contentType)
+		if quality := acceptQuality(accept, mediaType); quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
+
+/*
+ * Returns the quality the Accept header gives a media type: the one of the
+ * most specific range matching it. 1 without header.
+ */
+func acceptQuality(accept []string, mediaType string) float64 {
+	ranges := splitHeader(accept)
+	if len(ranges) == 0 {
+		return 1
+	}
+	quality, specificity := 0.0, -1
+	for _, r := range ranges {
+		value, params, err := mime.ParseMediaType(r)
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch {
+		case value == mediaType:
+			s = 2
+		case strings.HasSuffix(value, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(value, "*")):
+			s = 1
+		case value == "*/*":
+			s = 0
+		}
+		if s > specificity {
+			quality, specificity = parseQuality(params["q"]), s
+		}
+	}
+	return quality
+}
+
+/*
+ * Returns the values of a header like Accept-Language, highest quality
+ * first, leaving out those of quality 0
+ */
+func parseQualityList(header []string) []string {
+	type value struct {
+		name    string
+		quality float64
+	}
+	var values []value
+	for _, item := range splitHeader(header) {
+		name, params, _ := strings.Cut(item, ";")
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			quality = parseQuality(q)
+		}
+		if quality > 0 {
+			values = append(values, value{strings.TrimSpace(name), quality})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool { return values[i].quality > values[j].quality })
+	names := make([]string, len(values))
+	for i, v := range values {
+		names[i] = v.name
+	}
+	return names
+}
+
+/*
+ * Splits the comma separated values of a header
+ */
+func splitHeader(header []string) []string {
+	var values []string
+	for _, line := range header {
+		for _, value := range strings.Split(line, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func parseQuality(q string) float64 {
+	if q == "" {
+		return 1
+	}
+	quality, err := strconv.ParseFloat(q, 64)
+	if err != nil || quality < 0 || quality > 1 {
+		return 0
+	}
+	return quality
+}
+
+func render(t responseTemplate, data *ResponseData) string {
+	var message strings.Builder
+	t.Execute(&message, data)
+	return message.String()
+}
+
+/*
+ * Returns a random request ID
+ */
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func blockResponse(responses *Responses, header map[string]string, outcome string, statusCode int, data *ResponseData) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/upload", nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	data.StatusCode = statusCode
+	responses.Respond(rr, req, outcome, data)
+	return rr
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":    "txt",
+		"*/*": "txt",
+		"text/html,application/xhtml+xml,*/*;q=0.8":      "html",
+		"application/json, text/javascript, */*; q=0.01": "json",
+		"text/*":             "txt",
+		"text/html;q=0, */*": "txt",
+		"application/json;q=0.5, text/html;q=0.9": "html",
+		"image/png": "txt",
+	} {
+		var header []string
+		if accept != "" {
+			header = []string{accept}
+		}
+		assert.Equal(t, expected, negotiateFormat(header).extension, accept)
+	}
+}
+
+func TestResponses_Builtin(t *testing.T) {
+	setup()
+	var responses *Responses
+
+	// Plain text by default, as before templates
+	rr := blockResponse(responses, nil, OUTCOME_VIRUS, 418, &ResponseData{Filename: "eicar.com", Signature: "Eicar-Test-Signature"})
+	assert.Equal(t, 418, rr.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "File eicar.com has a virus!", rr.Body.String())
+	assert.Len(t, rr.Header().Get("X-Request-Id"), 16)
+
+	rr = blockResponse(responses, nil, OUTCOME_TOO_LARGE, 413, &ResponseData{})
+	assert.Equal(t, "Request Entity Too Large\n", rr.Body.String())
+
+	// JSON
+	rr = blockResponse(responses, map[string]string{"Accept": "application/json", "X-Request-Id": "abc"}, OUTCOME_VIRUS, 418, &ResponseData{Filename: "eicar.com", Signature: "Eicar-Test-Signature"})
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "abc", rr.Header().Get("X-Request-Id"))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, map[string]interface{}{
+		"outcome":    "virus",
+		"status":     float64(418),
+		"message":    "File eicar.com has a virus!",
+		"file":       "eicar.com",
+		"signature":  "Eicar-Test-Signature",
+		"request_id": "abc",
+	}, body)
+
+	// HTML, escaped
+	rr = blockResponse(responses, map[string]string{"Accept": "text/html"}, OUTCOME_POLICY, 415, &ResponseData{Filename: "<script>.exe", Signature: "type exe is blocked"})
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "<title>Unsupported Media Type</title>")
+	assert.Contains(t, rr.Body.String(), "File &lt;script&gt;.exe is not allowed: type exe is blocked")
+	assert.NotContains(t, rr.Body.String(), "<script>")
+}
+
+func TestResponses_Templates(t *testing.T) {
+	setup()
+	dir := writeTemplates(t, map[string]string{
+		"virus.html":       `<p>{{.Filename}} infected by {{.Signature}}, write to {{.SupportContact}} ({{.RequestID}})</p>`,
+		"virus.json":       `{"virus": {{json .Signature}}, "file": {{json .Filename}}}`,
+		"fr/virus.html":    `<p>{{.Filename}} est infecté</p>`,
+		"fr/virus.txt":     `{{.Nope}}`,
+		"rate-limited.txt": `Slow down, retry in {{.RetryAfter}}s`,
+	})
+	responses, err := LoadResponses(dir, "help@example.com")
+	require.NoError(t, err)
+	data := func() *ResponseData { return &ResponseData{Filename: `"x".com`, Signature: "Eicar-Test-Signature"} }
+
+	rr := blockResponse(responses, map[string]string{"Accept": "text/html", "X-Request-Id": "abc"}, OUTCOME_VIRUS, 418, data())
+	assert.Equal(t, `<p>&#34;x&#34;.com infected by Eicar-Test-Signature, write to help@example.com (abc)</p>`, rr.Body.String())
+
+	rr = blockResponse(responses, map[string]string{"Accept": "application/json"}, OUTCOME_VIRUS, 418, data())
+	assert.JSONEq(t, `{"virus": "Eicar-Test-Signature", "file": "\"x\".com"}`, rr.Body.String())
+
+	// Translations, falling back to the untranslated templates
+	for language, expected := range map[string]string{
+		"fr-CA, en;q=0.5": "est infecté",
+		"en, fr;q=0.5":    "est infecté",
+		"de":              "infected by",
+		"fr;q=0, de":      "infected by",
+	} {
+		rr = blockResponse(responses, map[string]string{"Accept": "text/html", "Accept-Language": language}, OUTCOME_VIRUS, 418, data())
+		assert.Contains(t, rr.Body.String(), expected, language)
+	}
+
+	// Broken templates fall back to the message
+	rr = blockResponse(responses, map[string]string{"Accept-Language": "fr"}, OUTCOME_VIRUS, 418, data())
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "File \"x\".com has a virus!", rr.Body.String())
+
+	// Outcomes without templates use the built-in ones
+	rr = blockResponse(responses, nil, OUTCOME_SCAN_ERROR, 500, &ResponseData{})
+	assert.Equal(t, "Internal Server Error\n", rr.Body.String())
+	rr = blockResponse(responses, nil, OUTCOME_RATE_LIMITED, 429, &ResponseData{RetryAfter: 3})
+	assert.Equal(t, "Slow down, retry in 3s", rr.Body.String())
+
+	for files, expected := range map[string]string{
+		"virus.pdf":         "Unknown response template",
+		"infected.html":     "Unknown response template",
+		"fr/virus.html.bak": "Unknown response template",
+		"virus.txt":         "Invalid response template",
+	} {
+		dir := writeTemplates(t, map[string]string{files: "{{if}}"})
+		_, err := LoadResponses(dir, "")
+		if assert.Error(t, err, files) {
+			assert.Contains(t, err.Error(), expected, files)
+		}
+	}
+	_, err = LoadResponses(filepath.Join(dir, "missing"), "")
+	assert.Error(t, err)
+}
+
+func TestScanInterceptor_Responses(t *testing.T) {
+	setup()
+	responses, err := LoadResponses(writeTemplates(t, map[string]string{
+		"too-large.json": `{"error": "too large", "file": {{json .Filename}}}`,
+	}), "")
+	require.NoError(t, err)
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: &recordingScanner{}, Responses: responses, MaxBodySize: 10}
+
+	req := newHTTPRequest("POST", "text/plain", strings.NewReader("VIRUS"))
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"signature":"Test-Signature"`)
+
+	// The forwarder refuses the large bodies with the interceptor's templates
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	req = newHTTPRequest("POST", "text/plain", strings.NewReader("larger than 10 bytes"))
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, req)
+	assert.Equal(t, 413, rr.Code)
+	assert.JSONEq(t, `{"error": "too large", "file": "body"}`, rr.Body.String())
+}
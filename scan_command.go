@@ -0,0 +1,209 @@
+/*
+ * The scan subcommand scans files, directories and the standard input with
+ * the configured scanner and scan policies, without running the server:
+ *
+ *	clammit scan -config=clammit.cfg [-route=name] [-format=json] path...
+ *
+ * The exit status is 0 if everything is clean, 1 if anything is infected or
+ * not allowed by the policy, 2 if some files could not be scanned.
+ */
+package main
+
+import (
+	"clammit/forwarder"
+	"clammit/scanner"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// The status of files refused by the scan policy, along with the scanner
+// RES_* statuses
+const RES_BLOCKED = "BLOCKED"
+
+/*
+ * The outcome of scanning a file
+ */
+type ScanResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	// The virus name, if found
+	Signature string `json:"signature,omitempty"`
+	// Why the file is blocked, or could not be scanned
+	Reason string `json:"reason,omitempty"`
+}
+
+/*
+ * Runs the scan subcommand, and returns the exit status
+ */
+func scanCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: clammit scan [options] path... (- for the standard input)")
+		flags.PrintDefaults()
+	}
+	filename := flags.String("config", "", "Configuration file")
+	route := flags.String("route", "", "Apply the scan policy of this route rather than the default one")
+	format := flags.String("format", "text", "Output format: text or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	ctx = &Ctx{Logger: log.New(stderr, "", log.LstdFlags)}
+	config, err := readConfig(*filename)
+	if err != nil {
+		fmt.Fprintln(stderr, "Configuration read failure:", err.Error())
+		return 2
+	}
+	rt, err := buildRuntime(config)
+	if err != nil {
+		fmt.Fprintln(stderr, "Invalid configuration:", err.Error())
+		return 2
+	}
+	policy := rt.ScanInterceptor.DefaultPolicy
+	if *route != "" {
+		if config.Routes[*route] == nil {
+			fmt.Fprintln(stderr, "Unknown route:", *route)
+			return 2
+		}
+		if routePolicy, ok := rt.ScanInterceptor.Policies[*route]; ok {
+			policy = routePolicy
+		}
+	}
+
+	var report func(*ScanResult)
+	counts := map[string]int{}
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		report = func(result *ScanResult) {
+			counts[result.Status]++
+			encoder.Encode(result)
+		}
+	} else {
+		report = func(result *ScanResult) {
+			counts[result.Status]++
+			switch result.Status {
+			case scanner.RES_CLEAN:
+				fmt.Fprintf(stdout, "%s: OK\n", result.Path)
+			case scanner.RES_FOUND:
+				fmt.Fprintf(stdout, "%s: %s FOUND\n", result.Path, result.Signature)
+			default:
+				fmt.Fprintf(stdout, "%s: %s (%s)\n", result.Path, result.Status, result.Reason)
+			}
+		}
+	}
+	scanPaths(rt.ScanInterceptor, policy, flags.Args(), stdin, report)
+
+	if *format == "text" {
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		fmt.Fprintf(stdout, "\nScanned %d file(s): %d infected, %d blocked, %d error(s)\n",
+			total, counts[scanner.RES_FOUND], counts[RES_BLOCKED], counts[scanner.RES_ERROR])
+	}
+	switch {
+	case counts[scanner.RES_FOUND] > 0 || counts[RES_BLOCKED] > 0:
+		return 1
+	case counts[scanner.RES_ERROR] > 0:
+		return 2
+	}
+	return 0
+}
+
+/*
+ * Scans the files and directories, recursively, and reports the result for
+ * each file. "-" is the standard input. Special files are skipped.
+ */
+func scanPaths(c *ScanInterceptor, policy *ScanPolicy, paths []string, stdin io.Reader, report func(*ScanResult)) {
+	scanPath := func(path string) {
+		file, err := os.Open(path)
+		if err != nil {
+			report(&ScanResult{Path: path, Status: scanner.RES_ERROR, Reason: err.Error()})
+			return
+		}
+		defer file.Close()
+		report(scanFile(c, policy, path, file))
+	}
+
+	for _, path := range paths {
+		if path == "-" {
+			report(scanFile(c, policy, "stdin", stdin))
+			continue
+		}
+		filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				report(&ScanResult{Path: path, Status: scanner.RES_ERROR, Reason: err.Error()})
+				return nil
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			mode := entry.Type()
+			if mode&fs.ModeSymlink != 0 {
+				// Links are followed to files, not to directories
+				info, err := os.Stat(path)
+				if err != nil {
+					report(&ScanResult{Path: path, Status: scanner.RES_ERROR, Reason: err.Error()})
+					return nil
+				}
+				mode = info.Mode()
+			}
+			if mode.IsRegular() {
+				scanPath(path)
+			}
+			return nil
+		})
+	}
+}
+
+/*
+ * Applies the policy size limits and file type rules to the file, then
+ * scans it
+ */
+func scanFile(c *ScanInterceptor, policy *ScanPolicy, path string, reader io.Reader) *ScanResult {
+	result := &ScanResult{Path: path, Status: scanner.RES_ERROR}
+	if max := c.maxPartSize(policy); max > 0 {
+		reader = forwarder.NewLimitReader(reader, max, &forwarder.LimitError{Limit: "max-part-size", Value: max})
+	}
+	if max := c.maxBodySize(policy); max > 0 {
+		reader = forwarder.NewLimitReader(reader, max, &forwarder.LimitError{Limit: "max-body-size", Value: max})
+	}
+	if policy.checksFileTypes() {
+		var reason string
+		var err error
+		if reader, reason, err = c.checkFileType(policy, filepath.Base(path), "", reader); err != nil {
+			result.Reason = err.Error()
+			return result
+		} else if reason != "" {
+			result.Status, result.Reason = RES_BLOCKED, reason
+			return result
+		}
+	}
+
+	tracker := &trackingReader{reader: reader}
+	scanned, err := c.Scanner.Scan(tracker)
+	switch {
+	case err != nil:
+		result.Reason = err.Error()
+	case scanned.Virus:
+		result.Status, result.Signature = scanner.RES_FOUND, scanned.Description
+	case tracker.err != nil:
+		result.Reason = tracker.err.Error()
+	case scanned.Status != scanner.RES_CLEAN:
+		result.Reason = "scan failed: " + scanned.Description
+	default:
+		result.Status = scanner.RES_CLEAN
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"clammit/scanner"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeScanFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	}
+	return dir
+}
+
+func TestScanPaths(t *testing.T) {
+	setup()
+	dir := writeScanFiles(t, map[string]string{
+		"clean.txt":           "hello",
+		"nested/deeper/virus": "X5O!P%@AP EICAR",
+		"nested/setup.exe":    "MZ\x90\x00\x03\x00\x00\x00",
+		"nested/large.txt":    strings.Repeat("x", 100),
+	})
+	require.NoError(t, os.Symlink(filepath.Join(dir, "clean.txt"), filepath.Join(dir, "link.txt")))
+
+	interceptor := &ScanInterceptor{Scanner: newTestClamav(t), MaxPartSize: 50}
+	policy := &ScanPolicy{Name: "default", BlockTypes: []string{"executable"}}
+	results := map[string]*ScanResult{}
+	report := func(result *ScanResult) {
+		results[strings.TrimPrefix(result.Path, dir+"/")] = result
+	}
+	scanPaths(interceptor, policy, []string{dir, "-", dir + "/missing"}, strings.NewReader("EICAR"), report)
+
+	var paths []string
+	for path := range results {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"clean.txt", "link.txt", "missing", "nested/deeper/virus", "nested/large.txt", "nested/setup.exe", "stdin"}, paths)
+
+	assert.Equal(t, scanner.RES_CLEAN, results["clean.txt"].Status)
+	assert.Equal(t, scanner.RES_CLEAN, results["link.txt"].Status)
+	assert.Equal(t, scanner.RES_ERROR, results["missing"].Status)
+	assert.Equal(t, scanner.RES_FOUND, results["nested/deeper/virus"].Status)
+	assert.Equal(t, "Test.Virus", results["nested/deeper/virus"].Signature)
+	assert.Equal(t, RES_BLOCKED, results["nested/setup.exe"].Status)
+	assert.Equal(t, "type exe is blocked", results["nested/setup.exe"].Reason)
+	assert.Equal(t, scanner.RES_ERROR, results["nested/large.txt"].Status, "a partially read file is not clean")
+	assert.Contains(t, results["nested/large.txt"].Reason, "max-part-size")
+	assert.Equal(t, scanner.RES_FOUND, results["stdin"].Status)
+}
+
+func TestScanCommand(t *testing.T) {
+	// Nothing listens on a closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+	filename := writeConfigFile(t, `
+[application]
+clamd-url = tcp://`+closed.Addr().String()+`
+
+[policy "default"]
+block-type = executable
+`)
+	dir := writeScanFiles(t, map[string]string{"clean.txt": "hello", "setup.exe": "MZ\x90\x00"})
+
+	var stdout, stderr strings.Builder
+	status := scanCommand([]string{"-config=" + filename, dir + "/clean.txt"}, nil, &stdout, &stderr)
+	assert.Equal(t, 2, status, "clamd cannot be reached")
+	assert.Contains(t, stdout.String(), dir+"/clean.txt: ERROR (")
+	assert.Contains(t, stdout.String(), "Scanned 1 file(s): 0 infected, 0 blocked, 1 error(s)")
+
+	stdout.Reset()
+	status = scanCommand([]string{"-config=" + filename, "-format=json", dir}, nil, &stdout, &stderr)
+	assert.Equal(t, 1, status, "blocked files take precedence over errors")
+	decoder := json.NewDecoder(strings.NewReader(stdout.String()))
+	var results []ScanResult
+	for decoder.More() {
+		var result ScanResult
+		require.NoError(t, decoder.Decode(&result))
+		results = append(results, result)
+	}
+	require.Len(t, results, 2)
+	assert.Equal(t, scanner.RES_ERROR, results[0].Status)
+	assert.Equal(t, ScanResult{Path: dir + "/setup.exe", Status: RES_BLOCKED, Reason: "type exe is blocked"}, results[1])
+
+	assert.Equal(t, 2, scanCommand([]string{"-config=" + filename}, nil, &stdout, &stderr), "no paths")
+	assert.Equal(t, 2, scanCommand([]string{"-format=xml", dir}, nil, &stdout, &stderr))
+	assert.Equal(t, 2, scanCommand([]string{"-config=" + filename, "-route=nowhere", dir}, nil, &stdout, &stderr))
+}
@@ -7,18 +7,71 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"clammit/filetype"
+	"clammit/forwarder"
+	"clammit/metrics"
 	"clammit/scanner"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
 )
 
+// How deep multipart parts and messages can be nested in a request
+const maxMIMEDepth = 10
+
 // The implementation of the Scan interceptor
 type ScanInterceptor struct {
 	VirusStatusCode int
-	Scanner         scanner.Scanner
+	// The HTTP status code to return when a file type is not allowed, 415
+	// if unset
+	PolicyStatusCode int
+	Scanner          scanner.Scanner
+	// Scan policies by route name, and the policy applied to the requests
+	// not matching any of them. Without policies, everything is scanned.
+	Policies      map[string]*ScanPolicy
+	DefaultPolicy *ScanPolicy
+	// Size limits, used when the policy does not set its own. Zero means
+	// unlimited.
+	MaxBodySize int64
+	MaxPartSize int64
+	MaxParts    int
+	// Maximum size of the bodies held in memory to extract their contents.
+	// Zero means unlimited.
+	MaxExtractSize int64
+	// Decompression bomb limits: the maximum size of a decoded body or part,
+	// and the maximum ratio of its decoded to its encoded size. Zero means
+	// unlimited.
+	MaxDecodedSize int64
+	MaxDecodeRatio int
+	// Number of parts of a request scanned at the same time. Up to 1, they
+	// are scanned one after another.
+	ScanParallelism int
+	// The admission controller the parts spooled to be scanned in parallel
+	// take their memory and spool space from, if any
+	Admission *Admission
+	// Monitor mode, globally or by route name: detections do not block the
+	// requests, which are forwarded with result headers
+	Monitor       bool
+	MonitorRoutes map[string]bool
+	// Counts the detections, by result and mode
+	Detections *metrics.Metric
+	// If set, signs the verdict headers of the forwarded requests
+	Verdict *VerdictSigner
+	// The templates of the responses refusing requests, the built-in ones if
+	// nil
+	Responses *Responses
+	// If true, logs the progression of each request
+	Debug bool
 }
 
 /*
@@ -29,66 +82,114 @@ type ScanInterceptor struct {
  * returns True if the body contains a virus
  */
 func (c *ScanInterceptor) Handle(w http.ResponseWriter, req *http.Request, body io.Reader) bool {
+	stripClammitHeaders(req.Header)
+
+	scan := &requestScan{req: req, monitor: c.monitors(req)}
+	if c.handle(w, req, body, scan) && !scan.truncated {
+		return true
+	}
+	scan.setResultHeaders()
+	if c.Verdict != nil {
+		c.Verdict.Sign(scan)
+	}
+	return false
+}
+
+/*
+ * Scans the request
+ *
+ * returns True if a http response has been written
+ */
+func (c *ScanInterceptor) handle(w http.ResponseWriter, req *http.Request, body io.Reader, scan *requestScan) bool {
 	//
 	// Don't care unless we have some content. When the length is unknown, the length will be -1,
 	// but we attempt anyway to read the body.
 	//
 	if req.ContentLength == 0 {
-		if ctx.Config.App.Debug {
+		if c.Debug {
 			ctx.Logger.Println("Not handling request with zero length")
 		}
 		return false
 	}
 
+	//
+	// Enforce the maximum body size: upfront if we know the length, otherwise
+	// while reading. The forwarder does it already while storing the body,
+	// but the scan endpoint reads it straight from the request.
+	//
+	policy := c.policyFor(req)
+	if max := c.maxBodySize(policy); max > 0 {
+		if req.ContentLength > max {
+			ctx.Logger.Printf("Request refused: body of %d bytes, max-body-size of %d exceeded (policy %s)", req.ContentLength, max, policy.Name)
+			c.Responses.Respond(w, req, OUTCOME_TOO_LARGE, &ResponseData{Filename: "body"})
+			return true
+		}
+		body = forwarder.NewLimitReader(body, max, &forwarder.LimitError{Limit: "max-body-size", Value: max})
+	}
+
+	if scan, reason := policy.ShouldScan(req); !scan {
+		if c.Debug {
+			ctx.Logger.Printf("Not scanning request %s %s: %s (policy %s)", req.Method, req.URL.Path, reason, policy.Name)
+		}
+		return false
+	}
+
+	scan.scanned = true
 	ctx.Logger.Printf("New request %s %s len %d from %s (%s)\n", req.Method, req.URL.Path, req.ContentLength, req.RemoteAddr, req.Header.Get("X-Forwarded-For"))
 
+	//
+	// Decode the body for scanning: the application still receives it encoded
+	//
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := c.decode(body, func(r io.Reader) (io.Reader, error) {
+			return decodeContentEncoding(encoding, r)
+		})
+		if err != nil {
+			ctx.Logger.Printf("Request refused: %v", err)
+			c.Responses.Respond(w, req, OUTCOME_UNSUPPORTED_ENCODING, &ResponseData{Filename: "body"})
+			return true
+		}
+		body = decoded
+	}
+
 	//
 	// Find any attachments
 	//
+	// Bodies we cannot parse are scanned as a whole: the application might
+	// be more lenient than we are
+	//
 	contentType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
 	if err != nil {
-		ctx.Logger.Println("Unable to parse media type:", err)
-		return false
+		ctx.Logger.Println("Unable to parse media type, scanning the whole body:", err)
+		contentType = ""
+	} else if contentType == "multipart/form-data" && params["boundary"] == "" {
+		ctx.Logger.Println("Multipart boundary is not defined, scanning the whole body")
+		contentType = ""
 	}
 
 	if contentType == "multipart/form-data" {
-		boundary := params["boundary"]
-		if boundary == "" {
-			ctx.Logger.Println("Multipart boundary is not defined")
-			return false
-		}
-
-		reader := multipart.NewReader(body, boundary)
-
 		//
-		// Scan them
+		// Scan them, and the parts of the multipart parts and messages they contain
 		//
-		count := 0
-		for {
-			if part, err := reader.NextPart(); err != nil {
-				if err == io.EOF {
-					break // all done
-				}
-				ctx.Logger.Println("Error parsing multipart form:", err)
-				http.Error(w, "Bad Request", 400)
-				return true
-			} else {
-				count++
-				filename := part.FileName()
-				if filename == "" {
-					filename = "untitled"
-				}
-				defer part.Close()
-				if ctx.Config.App.Debug {
-					ctx.Logger.Println("Scanning", part.FileName())
-				}
-				if responded := c.respondOnVirus(w, filename, part); responded == true {
-					return true
-				}
-			}
+		responseWriter := w
+		if c.ScanParallelism > 1 {
+			// Responses are held until the scans in progress are over
+			scan.parallel = newParallelScans(c.ScanParallelism)
+			responseWriter = scan.parallel.response
+		}
+		responded := c.respondOnMultipart(responseWriter, policy, multipart.NewReader(body, params["boundary"]), "", 0, scan)
+		if scan.truncated {
+			// Nothing to replay, only the scans in progress to wait for
+			responded = false
+		}
+		if scan.parallel != nil {
+			responded = scan.parallel.finish(w, responded)
 		}
-		if ctx.Config.App.Debug {
-			ctx.Logger.Printf("Processed %d form parts", count)
+		if responded {
+			return true
+		}
+		if c.Debug {
+			ctx.Logger.Printf("Processed %d form parts", scan.count)
 		}
 	} else {
 		filename := "untitled"
@@ -96,25 +197,513 @@ func (c *ScanInterceptor) Handle(w http.ResponseWriter, req *http.Request, body
 		if err == nil {
 			filename = params["filename"]
 		}
-		return c.respondOnVirus(w, filename, body)
+		extract := extractorFor(contentType, policy)
+		content := &extractBuffer{max: c.MaxExtractSize}
+		if extract != nil {
+			// Keep a copy of the body while scanning it as a whole, to extract
+			// its contents afterwards
+			body = io.TeeReader(body, content)
+		}
+		if policy.checksFileTypes() {
+			var responded bool
+			if body, responded = c.respondOnFileType(w, scan, policy, filename, req.Header.Get("Content-Type"), body); responded {
+				return true
+			}
+		}
+		if responded := c.respondOnVirus(w, scan, scan.count, filename, body); responded || extract == nil {
+			return responded
+		}
+		return c.respondOnExtracted(w, scan, policy, extract, body, content)
 	}
 	return false
 }
 
+/*
+ * Returns the scan policy for the request: the one of the route matched by
+ * the forwarder, if any, or the default one
+ */
+func (c *ScanInterceptor) policyFor(req *http.Request) *ScanPolicy {
+	if route := forwarder.RouteFromRequest(req); route != nil {
+		if policy, ok := c.Policies[route.Name]; ok {
+			return policy
+		}
+	}
+	return c.DefaultPolicy
+}
+
+/*
+ * Implementation of forwarder.BodyLimiter
+ */
+func (c *ScanInterceptor) BodyLimit(req *http.Request) int64 {
+	return c.maxBodySize(c.policyFor(req))
+}
+
+/*
+ * Implementation of forwarder.BodyChecker: enforces max-parts and
+ * max-part-size on the parts of multipart bodies while they are received,
+ * whether the policy scans them or not. Encoded bodies are only checked
+ * when decoded, while scanning. In monitor mode, the limits are only
+ * reported, while scanning.
+ */
+func (c *ScanInterceptor) CheckBody(req *http.Request, body io.Reader) io.Reader {
+	policy := c.policyFor(req)
+	maxParts, maxPartSize := c.maxParts(policy), c.maxPartSize(policy)
+	if maxParts == 0 && maxPartSize == 0 || req.Header.Get("Content-Encoding") != "" || c.monitors(req) {
+		return body
+	}
+	contentType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || contentType != "multipart/form-data" || params["boundary"] == "" {
+		return body
+	}
+	return forwarder.NewMultipartLimitReader(body, params["boundary"], maxParts, maxPartSize)
+}
+
+/*
+ * Implementation of forwarder.ErrorResponder
+ */
+func (c *ScanInterceptor) RespondOnError(w http.ResponseWriter, req *http.Request, err error) {
+	data := &ResponseData{}
+	outcome := outcomeOf(err, OUTCOME_INTERNAL_ERROR)
+	if outcome == OUTCOME_TOO_LARGE {
+		data.Filename = "body"
+	}
+	c.Responses.Respond(w, req, outcome, data)
+}
+
+/*
+ * Size limits: the policy ones if set, the global ones otherwise
+ */
+func (c *ScanInterceptor) maxBodySize(policy *ScanPolicy) int64 {
+	if policy != nil && policy.MaxBodySize > 0 {
+		return policy.MaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+func (c *ScanInterceptor) maxPartSize(policy *ScanPolicy) int64 {
+	if policy != nil && policy.MaxPartSize > 0 {
+		return policy.MaxPartSize
+	}
+	return c.MaxPartSize
+}
+
+func (c *ScanInterceptor) maxParts(policy *ScanPolicy) int {
+	if policy != nil && policy.MaxParts > 0 {
+		return policy.MaxParts
+	}
+	return c.MaxParts
+}
+
+/*
+ * Decodes a body or a part for scanning, within the decompression bomb limits
+ */
+func (c *ScanInterceptor) decode(encoded io.Reader, decode func(io.Reader) (io.Reader, error)) (io.Reader, error) {
+	return newBombLimitReader(encoded, decode, c.MaxDecodedSize, int64(c.MaxDecodeRatio))
+}
+
 /*
  * This function performs the virus scan and handles the http response in case of a virus.
+ * In monitor mode, viruses are recorded instead. Index is the position of the
+ * file in the request, the number of parts read before it, to report the
+ * files in order whatever the order their scans end in.
  *
  * returns True if a virus has been found and a http error response has been written
  */
-func (c *ScanInterceptor) respondOnVirus(w http.ResponseWriter, filename string, reader io.Reader) bool {
-	if hasVirus, err := c.Scanner.HasVirus(reader); err != nil {
-		ctx.Logger.Printf("Unable to scan file (%s): %v\n", filename, err)
-		http.Error(w, "Internal Server Error", 500)
+func (c *ScanInterceptor) respondOnVirus(w http.ResponseWriter, scan *requestScan, index int, filename string, reader io.Reader) bool {
+	// The scanner stops at the first read error, and scans what it got so far:
+	// keep track of errors, so that a partially read body is not deemed clean
+	var hasher hash.Hash
+	if c.Verdict != nil {
+		hasher = sha256.New()
+		reader = io.TeeReader(reader, hasher)
+	}
+	tracker := &trackingReader{reader: reader}
+
+	result, err := c.Scanner.Scan(tracker)
+	if responded := c.respondOnResult(w, scan, index, filename, result, err); responded {
 		return true
-	} else if hasVirus {
-		w.WriteHeader(c.VirusStatusCode)
-		w.Write([]byte(fmt.Sprintf("File %s has a virus!", filename)))
+	}
+	if hasher != nil && tracker.err == nil {
+		// The scanner may not read the file to the end, e.g. once it found a virus
+		io.Copy(io.Discard, tracker)
+	}
+	if tracker.err != nil {
+		return c.respondOnReadError(w, scan, filename, tracker.err)
+	}
+	if hasher != nil {
+		scan.addHash(index, filename, hex.EncodeToString(hasher.Sum(nil)))
+	}
+	return false
+}
+
+/*
+ * Handles the result of a scan.
+ *
+ * returns True if the scan failed or found a virus, and a http error response
+ * has been written
+ */
+func (c *ScanInterceptor) respondOnResult(w http.ResponseWriter, scan *requestScan, index int, filename string, result *scanner.Result, err error) bool {
+	if err == nil && result.Status == scanner.RES_ERROR {
+		err = fmt.Errorf("clamd failed to scan: %s", result.Description)
+	}
+	if err != nil {
+		ctx.Logger.Printf("Unable to scan file (%s): %v\n", filename, err)
+		if scan.monitor {
+			return c.respondOnDetection(w, scan, &Detection{File: filename, Result: RESULT_ERROR, Signature: err.Error(), Index: index}, 0)
+		}
+		c.Responses.Respond(w, scan.req, OUTCOME_SCAN_ERROR, &ResponseData{Filename: filename})
 		return true
+	} else if result.Virus {
+		detection := &Detection{File: filename, Result: RESULT_FOUND, Signature: result.Description, Index: index}
+		if c.respondOnDetection(w, scan, detection, c.VirusStatusCode) {
+			return true
+		}
 	}
 	return false
 }
+
+/*
+ * Scans the parts of a multipart body, recursing into the multipart parts and
+ * the messages. Path is the path of the body in the MIME tree, "" for the
+ * request itself.
+ *
+ * returns True if a part could not be read, is not allowed or has a virus,
+ * and a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnMultipart(w http.ResponseWriter, policy *ScanPolicy, reader *multipart.Reader, path string, depth int, scan *requestScan) bool {
+	maxParts := c.maxParts(policy)
+	maxPartSize := c.maxPartSize(policy)
+	for index := 1; ; index++ {
+		if scan.parallel != nil && scan.parallel.stopped() {
+			return true // a virus was found, no need to read further
+		}
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return false // all done
+		} else if err != nil {
+			return c.respondOnReadError(w, scan, mimePath(path, "multipart form"), err)
+		}
+		defer part.Close()
+		scan.count++
+		name := partPath(path, part, index)
+		if maxParts > 0 && scan.count > maxParts {
+			return c.respondOnReadError(w, scan, mimePath(path, "multipart form"), &forwarder.LimitError{Limit: "max-parts", Value: int64(maxParts)})
+		}
+		var partReader io.Reader = part
+		if maxPartSize > 0 {
+			partReader = forwarder.NewLimitReader(part, maxPartSize, &forwarder.LimitError{Limit: "max-part-size", Value: maxPartSize})
+		}
+		if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "" {
+			partReader, _ = c.decode(partReader, func(r io.Reader) (io.Reader, error) {
+				return decodeTransferEncoding(encoding, r)
+			})
+		}
+		// The policy selects form fields, the parts of the request itself
+		if depth == 0 && !policy.ShouldScanPart(part) {
+			if c.Debug {
+				ctx.Logger.Printf("Not scanning field %s (policy %s)", part.FormName(), policy.Name)
+			}
+			// Still read it, to enforce the size limit
+			if _, err := io.Copy(io.Discard, partReader); err != nil {
+				return c.respondOnReadError(w, scan, name, err)
+			}
+			continue
+		}
+		isFile := depth > 0 || part.FileName() != "" || policy != nil && len(policy.FileFields) > 0
+		if responded := c.respondOnEntity(w, policy, name, part.Header, partReader, isFile, depth, scan); responded {
+			return true
+		}
+	}
+}
+
+/*
+ * Scans a part or a message body: recurses into it if it is itself a
+ * multipart body or a message, otherwise checks its type if it is a file,
+ * and scans it. Multipart bodies and messages are scanned as a whole as well,
+ * as their preamble, epilogue and headers are not part of any entity.
+ *
+ * returns True if the entity could not be read, is not allowed or has a
+ * virus, and a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnEntity(w http.ResponseWriter, policy *ScanPolicy, name string, header textproto.MIMEHeader, reader io.Reader, isFile bool, depth int, scan *requestScan) bool {
+	contentType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	nested := contentType == "message/rfc822" || strings.HasPrefix(contentType, "multipart/") && params["boundary"] != ""
+	index := scan.count
+	if nested && depth+1 > maxMIMEDepth {
+		return c.respondOnReadError(w, scan, name, &forwarder.LimitError{Limit: "max-mime-depth", Value: maxMIMEDepth})
+	}
+	if nested {
+		raw, finish := c.scanRaw(reader)
+		responded := c.respondOnNested(w, policy, name, contentType, params["boundary"], raw, depth, scan)
+		if responded {
+			finish(errScanCancelled)
+			return true
+		}
+		// Past the closing boundary, the epilogue
+		if _, err := io.Copy(io.Discard, raw); err != nil {
+			finish(err)
+			return c.respondOnReadError(w, scan, name, err)
+		}
+		result, err := finish(nil)
+		return c.respondOnResult(w, scan, index, name, result, err)
+	}
+
+	if policy.checksFileTypes() && isFile {
+		var responded bool
+		if reader, responded = c.respondOnFileType(w, scan, policy, name, header.Get("Content-Type"), reader); responded {
+			return true
+		}
+	}
+	if scan.parallel != nil {
+		spooled, cleanup, whole, err := spool(reader, c.Admission)
+		if err != nil {
+			return c.respondOnReadError(w, scan, name, err)
+		}
+		if !whole {
+			// No memory or spool space left to hold the part: scan it while
+			// reading it, like without parallel scans
+			defer cleanup()
+			ctx.Logger.Printf("Scanning %s inline, the admission limits leave no room to spool it", name)
+			return c.respondOnVirus(w, scan, index, name, spooled)
+		}
+		if c.Debug {
+			ctx.Logger.Println("Scanning in the background", name)
+		}
+		scan.parallel.start(func(w http.ResponseWriter, cancelled func() bool) bool {
+			defer cleanup()
+			if cancelled() {
+				return false
+			}
+			return c.respondOnVirus(w, scan, index, name, &cancellableReader{reader: spooled, cancelled: cancelled})
+		})
+		return false
+	}
+	if c.Debug {
+		ctx.Logger.Println("Scanning", name)
+	}
+	return c.respondOnVirus(w, scan, index, name, reader)
+}
+
+/*
+ * Recurses into a message or the parts of a multipart body.
+ *
+ * returns True if an entity could not be read, is not allowed or has a
+ * virus, and a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnNested(w http.ResponseWriter, policy *ScanPolicy, name string, contentType string, boundary string, reader io.Reader, depth int, scan *requestScan) bool {
+	if contentType == "message/rfc822" {
+		if c.Debug {
+			ctx.Logger.Println("Scanning the message", name)
+		}
+		message, err := mail.ReadMessage(reader)
+		if err != nil {
+			return c.respondOnReadError(w, scan, name, err)
+		}
+		body, _ := c.decode(message.Body, func(r io.Reader) (io.Reader, error) {
+			return decodeTransferEncoding(message.Header.Get("Content-Transfer-Encoding"), r)
+		})
+		return c.respondOnEntity(w, policy, name, textproto.MIMEHeader(message.Header), body, true, depth+1, scan)
+	}
+	if c.Debug {
+		ctx.Logger.Println("Scanning the parts of", name)
+	}
+	return c.respondOnMultipart(w, policy, multipart.NewReader(reader, boundary), name, depth+1, scan)
+}
+
+/*
+ * Scans an entity as a whole, in the background, while it is read through
+ * the returned reader. Finish ends the entity, with the error that stopped
+ * reading it if any, and returns the result of the scan.
+ */
+func (c *ScanInterceptor) scanRaw(reader io.Reader) (io.Reader, func(err error) (*scanner.Result, error)) {
+	pr, pw := io.Pipe()
+	type scanResult struct {
+		result *scanner.Result
+		err    error
+	}
+	done := make(chan scanResult, 1)
+	go func() {
+		result, err := c.Scanner.Scan(pr)
+		// The scanner may not read the entity to the end
+		io.Copy(io.Discard, pr)
+		done <- scanResult{result, err}
+	}()
+	finish := func(err error) (*scanner.Result, error) {
+		pw.CloseWithError(err)
+		scanned := <-done
+		return scanned.result, scanned.err
+	}
+	return io.TeeReader(reader, pw), finish
+}
+
+/*
+ * Returns the path of a part in the MIME tree, e.g. mail.eml/invoice.pdf: its
+ * file name, form name or position, after the path of its parent. Unnamed
+ * parts of the request itself are "untitled".
+ */
+func partPath(parent string, part *multipart.Part, index int) string {
+	name := part.FileName()
+	if name == "" {
+		name = part.FormName()
+	}
+	if name == "" && parent == "" {
+		name = "untitled"
+	} else if name == "" {
+		name = fmt.Sprintf("part %d", index)
+	}
+	return mimePath(parent, name)
+}
+
+/*
+ * Appends a name to a path in the MIME tree
+ */
+func mimePath(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+/*
+ * Extracts the files hidden in the body, e.g. the base64 strings of a JSON
+ * document, and scans them. The rest of the body is read first, in case the
+ * scanner did not need it all.
+ *
+ * The decoded files are scanned one by one, and the plain values, e.g. the
+ * fields of a form, all together in a single scan. Bodies larger than
+ * max-extract-size are only scanned as a whole.
+ *
+ * returns True if the body could not be read, or one of the files is not
+ * allowed or has a virus, and a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnExtracted(w http.ResponseWriter, scan *requestScan, policy *ScanPolicy, extract func([]byte) ([]*Extracted, error), rest io.Reader, content *extractBuffer) bool {
+	if _, err := io.Copy(io.Discard, rest); err != nil {
+		return c.respondOnReadError(w, scan, "body", err)
+	}
+	if content.overflow {
+		ctx.Logger.Printf("Body larger than max-extract-size of %d, scanned as a whole only", content.max)
+		return false
+	}
+	extracted, err := extract(content.content.Bytes())
+	if err != nil {
+		ctx.Logger.Printf("Unable to extract the contents of the body, scanned as a whole only: %v", err)
+		return false
+	}
+	if max := c.maxParts(policy); max > 0 && len(extracted) > max {
+		return c.respondOnReadError(w, scan, "body", &forwarder.LimitError{Limit: "max-parts", Value: int64(max)})
+	}
+	var decoded int
+	var names []string
+	var values [][]byte
+	for _, item := range extracted {
+		if !item.Decoded {
+			names = append(names, item.Name)
+			values = append(values, item.Data)
+			continue
+		}
+		if decoded++; c.maxParts(policy) == 0 && decoded > defaultMaxDecoded {
+			return c.respondOnReadError(w, scan, "body", &forwarder.LimitError{Limit: "max-parts", Value: defaultMaxDecoded})
+		}
+		var reader io.Reader = bytes.NewReader(item.Data)
+		if policy.checksFileTypes() {
+			var responded bool
+			if reader, responded = c.respondOnFileType(w, scan, policy, item.Name, item.ContentType, reader); responded {
+				return true
+			}
+		}
+		if c.Debug {
+			ctx.Logger.Printf("Scanning %s, %d bytes extracted from the body", item.Name, len(item.Data))
+		}
+		if responded := c.respondOnVirus(w, scan, scan.count, item.Name, reader); responded {
+			return true
+		}
+	}
+	if len(values) == 0 {
+		return false
+	}
+	name := strings.Join(names, ",")
+	if c.Debug {
+		ctx.Logger.Printf("Scanning %s, %d values extracted from the body", name, len(values))
+	}
+	return c.respondOnVirus(w, scan, scan.count, name, bytes.NewReader(bytes.Join(values, []byte("\n"))))
+}
+
+/*
+ * Detects the real type of the file and checks it against the policy.
+ *
+ * returns a reader on the whole file, or True if the file is not allowed and
+ * a http error response has been written
+ */
+func (c *ScanInterceptor) respondOnFileType(w http.ResponseWriter, scan *requestScan, policy *ScanPolicy, filename string, declaredType string, reader io.Reader) (io.Reader, bool) {
+	buffered, reason, err := c.checkFileType(policy, filename, declaredType, reader)
+	if err != nil {
+		return nil, c.respondOnReadError(w, scan, filename, err)
+	}
+	if reason != "" {
+		ctx.Logger.Printf("File %s is not allowed: %s (policy %s)", filename, reason, policy.Name)
+		detection := &Detection{File: filename, Result: RESULT_BLOCKED, Signature: reason, Index: scan.count}
+		if c.respondOnDetection(w, scan, detection, c.PolicyStatusCode) {
+			return nil, true
+		}
+	}
+	return buffered, false
+}
+
+/*
+ * Detects the real type of the file and checks it against the policy.
+ *
+ * returns a reader on the whole file, and the reason the file is not allowed,
+ * or "" if it is
+ */
+func (c *ScanInterceptor) checkFileType(policy *ScanPolicy, filename string, declaredType string, reader io.Reader) (io.Reader, string, error) {
+	buffered := bufio.NewReaderSize(reader, filetype.SniffLength)
+	head, err := buffered.Peek(filetype.SniffLength)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	detected := filetype.Detect(head)
+	if c.Debug {
+		ctx.Logger.Printf("Detected type of %s: %s", filename, detected)
+	}
+	return buffered, policy.CheckFileType(detected, declaredType, filename), nil
+}
+
+/*
+ * Handles the http response when the body cannot be read. In monitor mode, a
+ * size limit is a detection instead: the scan stops there, and the request is
+ * forwarded.
+ *
+ * returns True if the scan should stop
+ */
+func (c *ScanInterceptor) respondOnReadError(w http.ResponseWriter, scan *requestScan, what string, err error) bool {
+	outcome := outcomeOf(err, OUTCOME_PARSE_ERROR)
+	if outcome == OUTCOME_TOO_LARGE && scan.monitor {
+		// Stop scanning, but forward the request
+		ctx.Logger.Printf("Stopped scanning at %s: %s", what, err.Error())
+		c.respondOnDetection(w, scan, &Detection{File: what, Result: RESULT_TOO_LARGE, Signature: err.Error(), Index: scan.count}, 0)
+		scan.truncated = true
+		return true
+	} else if outcome == OUTCOME_TOO_LARGE {
+		ctx.Logger.Printf("Request refused while reading %s: %s", what, err.Error())
+	} else {
+		ctx.Logger.Printf("Error reading %s: %v", what, err)
+	}
+	c.Responses.Respond(w, scan.req, outcome, &ResponseData{Filename: what})
+	return true
+}
+
+/*
+ * Remembers the first error returned by the underlying reader
+ */
+type trackingReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
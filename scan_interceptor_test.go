@@ -2,14 +2,25 @@ package main
 
 import (
 	"bytes"
+	"clammit/clamdtest"
+	"clammit/forwarder"
 	"clammit/scanner"
+	"encoding/base64"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const virusCode = 418
@@ -20,8 +31,18 @@ type MockScanner struct {
 	scanner.Engine
 }
 
-func (s MockScanner) HasVirus(reader io.Reader) (bool, error) {
-	return mockVirusFound, nil
+func (s MockScanner) Scan(reader io.Reader) (*scanner.Result, error) {
+	return testResult(mockVirusFound), nil
+}
+
+/*
+ * The result of a test scan: infected files have the Test-Signature virus
+ */
+func testResult(virus bool) *scanner.Result {
+	if virus {
+		return &scanner.Result{Status: scanner.RES_FOUND, Virus: true, Description: "Test-Signature"}
+	}
+	return &scanner.Result{Status: scanner.RES_CLEAN}
 }
 
 var scanInterceptor = ScanInterceptor{
@@ -160,6 +181,20 @@ func addPart(w *multipart.Writer, name, fileName string) {
 	return
 }
 
+/*
+ * Returns a clamav scanner connected to a fake clamd, which finds
+ * Test.Virus in files containing EICAR
+ */
+func newTestClamav(t *testing.T) *scanner.Clamav {
+	clamd := clamdtest.NewServer()
+	t.Cleanup(clamd.Close)
+	clamd.AddRule(clamdtest.Found("EICAR", "Test.Virus"))
+	clamav := new(scanner.Clamav)
+	clamav.SetLogger(ctx.Logger, false)
+	clamav.SetAddress(clamd.URL)
+	return clamav
+}
+
 func setup() {
 	ctx = &Ctx{
 		ShuttingDown: false,
@@ -178,3 +213,317 @@ func newHTTPRequest(method string, contentType string, body io.Reader) *http.Req
 	}
 	return req
 }
+
+func forwarderFor(t *testing.T, backendURL string, interceptor *ScanInterceptor) *forwarder.Forwarder {
+	u, err := url.Parse(backendURL)
+	if err != nil {
+		t.Fatal("Invalid backend URL:", err)
+	}
+	fw := forwarder.NewForwarder(u, 10000, interceptor)
+	fw.SetRoutes(forwarder.NewRoutes([]*forwarder.Route{{Name: "api", PathPrefix: "/api"}}))
+	return fw
+}
+
+func TestScanInterceptor_Clamd(t *testing.T) {
+	setup()
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(
+		clamdtest.Failure("broken", "Can't allocate memory"),
+		clamdtest.Drop("drop"),
+		clamdtest.Malformed("garbage", "this is not clamd"),
+	)
+	clamav := new(scanner.Clamav)
+	clamav.SetLogger(ctx.Logger, false)
+	clamav.SetAddress(clamd.URL)
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: clamav}
+
+	for body, status := range map[string]int{
+		"hello":                 200,
+		string(clamdtest.EICAR): virusCode,
+		"broken":                500,
+		"drop":                  500,
+		"garbage":               500,
+	} {
+		rr := httptest.NewRecorder()
+		req := newHTTPRequest("POST", "application/octet-stream", bytes.NewReader([]byte(body)))
+		if !interceptor.Handle(rr, req, req.Body) {
+			rr.WriteHeader(200)
+		}
+		assert.Equal(t, status, rr.Code, body)
+	}
+
+	// Larger than the clamd stream limit
+	clamd.SetStreamMaxLength(10)
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", "application/octet-stream", bytes.NewReader(bytes.Repeat([]byte("x"), 5000)))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 500, rr.Code)
+}
+
+/*
+ * A scanner remembering what it scanned, and finding a virus in the files
+ * containing "VIRUS"
+ */
+type recordingScanner struct {
+	scanner.Engine
+	// Nested entities are scanned as a whole in the background
+	lock    sync.Mutex
+	scanned [][]byte
+}
+
+func (s *recordingScanner) Scan(reader io.Reader) (*scanner.Result, error) {
+	data, err := io.ReadAll(reader)
+	s.lock.Lock()
+	s.scanned = append(s.scanned, data)
+	s.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return testResult(bytes.Contains(data, []byte("VIRUS"))), nil
+}
+
+func (s *recordingScanner) Version() (string, error) {
+	return "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024\n", nil
+}
+
+func setupFuzz() {
+	ctx = &Ctx{Logger: log.New(io.Discard, "", 0)}
+}
+
+/*
+ * Whatever the body, a request is either refused or forwarded with all its
+ * parts, as the application would parse them, scanned and clean
+ */
+func FuzzScanInterceptor_Multipart(f *testing.F) {
+	body, contentType := makeMultipartBody()
+	f.Add(contentType, body.Bytes())
+	f.Add("multipart/form-data; boundary=foo", []byte("--foo\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\nVIRUS\r\n--foo--\r\n"))
+	f.Add("multipart/form-data; boundary=\"x", []byte("--x\r\n\r\nVIRUS\r\n--x--\r\n"))
+	f.Add("multipart/form-data", []byte("VIRUS"))
+
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		setupFuzz()
+		scanner := &recordingScanner{}
+		interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner}
+		req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+		if interceptor.Handle(httptest.NewRecorder(), req, req.Body) || len(body) == 0 {
+			return
+		}
+
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			if len(scanner.scanned) == 0 || !bytes.Equal(scanner.scanned[0], body) {
+				t.Fatalf("Body forwarded without being scanned as a whole: %q", body)
+			}
+			return
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i := 0; ; i++ {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Unreadable body forwarded: %v", err)
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatalf("Unreadable part %d forwarded: %v", i, err)
+			}
+			// Nested and encoded parts are scanned once decoded
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if strings.HasPrefix(partType, "multipart/") || partType == "message/rfc822" || part.Header.Get("Content-Transfer-Encoding") != "" {
+				continue
+			}
+			scanned := false
+			for _, s := range scanner.scanned {
+				scanned = scanned || bytes.Equal(s, data)
+			}
+			if !scanned {
+				t.Fatalf("Part %d forwarded without being scanned: %q", i, data)
+			}
+			if bytes.Contains(data, []byte("VIRUS")) {
+				t.Fatalf("Infected part %d forwarded", i)
+			}
+		}
+	})
+}
+
+/*
+ * Whatever the Content-Disposition header, a request body is scanned once,
+ * and entirely
+ */
+func FuzzScanInterceptor_ContentDisposition(f *testing.F) {
+	f.Add(`attachment; filename="eicar.com"`, []byte("VIRUS"))
+	f.Add(`attachment; filename*=UTF-8''%E2%82%AC.txt`, []byte("clean"))
+	f.Add(`attachment; filename="../../etc/passwd"; filename="twice"`, []byte("VIRUS"))
+	f.Add(`inline; filename=`, []byte("clean"))
+
+	f.Fuzz(func(t *testing.T, disposition string, body []byte) {
+		if len(body) == 0 {
+			return
+		}
+		setupFuzz()
+		scanner := &recordingScanner{}
+		interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner}
+		req := newHTTPRequest("POST", "application/octet-stream", bytes.NewReader(body))
+		req.Header.Set("Content-Disposition", disposition)
+		rr := httptest.NewRecorder()
+		blocked := interceptor.Handle(rr, req, req.Body)
+
+		if len(scanner.scanned) != 1 || !bytes.Equal(scanner.scanned[0], body) {
+			t.Fatalf("Body not scanned as a whole: %q", scanner.scanned)
+		}
+		if infected := bytes.Contains(body, []byte("VIRUS")); infected != blocked || infected && rr.Code != virusCode {
+			t.Fatalf("Infected %v, but blocked %v with status %d", infected, blocked, rr.Code)
+		}
+	})
+}
+
+/*
+ * Writes a part with the given headers to a multipart body
+ */
+func writePart(t *testing.T, w *multipart.Writer, contentType string, disposition string, content string) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	if disposition != "" {
+		header.Set("Content-Disposition", disposition)
+	}
+	part, err := w.CreatePart(header)
+	require.NoError(t, err)
+	io.WriteString(part, content)
+}
+
+func TestScanInterceptor_Nested(t *testing.T) {
+	setup()
+	scanner := &recordingScanner{}
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: scanner}
+
+	// A file set, and an email with an attachment, in a form
+	files := &bytes.Buffer{}
+	filesWriter := multipart.NewWriter(files)
+	writePart(t, filesWriter, "text/plain", `attachment; filename="a.txt"`, "clean")
+	writePart(t, filesWriter, "text/plain", "", "clean too")
+	filesWriter.Close()
+
+	attachments := &bytes.Buffer{}
+	attachmentsWriter := multipart.NewWriter(attachments)
+	writePart(t, attachmentsWriter, "text/plain", "", "Please find the invoice attached")
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "application/pdf")
+	header.Set("Content-Disposition", `attachment; filename="invoice.pdf"`)
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, _ := attachmentsWriter.CreatePart(header)
+	io.WriteString(part, base64.StdEncoding.EncodeToString([]byte("VIRUS")))
+	attachmentsWriter.Close()
+	message := "From: kermit@example.com\r\nSubject: Invoice\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=" + attachmentsWriter.Boundary() + "\r\n\r\n" + attachments.String()
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	writePart(t, w, "multipart/mixed; boundary="+filesWriter.Boundary(), `form-data; name="files"`, files.String())
+	writePart(t, w, "message/rfc822", `form-data; name="upload"; filename="mail.eml"`, message)
+	w.Close()
+
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, virusCode, rr.Code)
+	assert.Equal(t, "File mail.eml/invoice.pdf has a virus!", rr.Body.String())
+	// The file set is scanned as a whole too, after its parts
+	scanned := scannedStrings(scanner)
+	require.GreaterOrEqual(t, len(scanned), 5)
+	assert.Equal(t, []string{"clean", "clean too", files.String(), "Please find the invoice attached", "VIRUS"}, scanned[:5])
+
+	// A quoted-printable message, not multipart
+	scanner.scanned = nil
+	body.Reset()
+	w = multipart.NewWriter(body)
+	writePart(t, w, "message/rfc822", `form-data; name="upload"`, "Subject: Hi\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nVI=\r\nRUS")
+	w.Close()
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, "File upload has a virus!", rr.Body.String())
+
+	// Malformed messages are refused
+	body.Reset()
+	w = multipart.NewWriter(body)
+	writePart(t, w, "message/rfc822", `form-data; name="upload"`, "not a header\r\n")
+	w.Close()
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 400, rr.Code)
+}
+
+func TestScanInterceptor_NestedOutsideParts(t *testing.T) {
+	setup()
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: newTestClamav(t)}
+
+	// EICAR in the preamble and the epilogue of a nested multipart body, and
+	// in the headers of a message: none of them is in a part
+	inner := "--inner\r\nContent-Type: text/plain\r\n\r\nclean\r\n--inner--\r\n"
+	for name, test := range map[string]struct {
+		contentType string
+		content     string
+	}{
+		"preamble": {"multipart/mixed; boundary=inner", string(clamdtest.EICAR) + "\r\n" + inner},
+		"epilogue": {"multipart/mixed; boundary=inner", inner + string(clamdtest.EICAR) + "\r\n"},
+		"header":   {"message/rfc822", "Subject: " + string(clamdtest.EICAR) + "\r\n\r\nclean"},
+	} {
+		body := &bytes.Buffer{}
+		w := multipart.NewWriter(body)
+		writePart(t, w, test.contentType, `form-data; name="upload"; filename="upload.eml"`, test.content)
+		w.Close()
+		rr := httptest.NewRecorder()
+		req := newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+		assert.True(t, interceptor.Handle(rr, req, req.Body), name)
+		assert.Equal(t, virusCode, rr.Code, name)
+		assert.Equal(t, "File upload.eml has a virus!", rr.Body.String(), name)
+	}
+}
+
+func TestScanInterceptor_NestedDepth(t *testing.T) {
+	setup()
+	interceptor := &ScanInterceptor{VirusStatusCode: virusCode, Scanner: &recordingScanner{}}
+
+	// Messages in messages, one level too deep
+	message := "Subject: innermost\r\n\r\nclean"
+	for i := 0; i < maxMIMEDepth; i++ {
+		message = "Content-Type: message/rfc822\r\n\r\n" + message
+	}
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	writePart(t, w, "message/rfc822", `form-data; name="upload"`, message)
+	w.Close()
+	rr := httptest.NewRecorder()
+	req := newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Parts count at every depth
+	files := &bytes.Buffer{}
+	filesWriter := multipart.NewWriter(files)
+	for i := 0; i < 3; i++ {
+		writePart(t, filesWriter, "text/plain", "", "clean")
+	}
+	filesWriter.Close()
+	body.Reset()
+	w = multipart.NewWriter(body)
+	writePart(t, w, "multipart/mixed; boundary="+filesWriter.Boundary(), `form-data; name="files"`, files.String())
+	w.Close()
+	interceptor.MaxParts = 3
+	rr = httptest.NewRecorder()
+	req = newHTTPRequest("POST", w.FormDataContentType(), bytes.NewReader(body.Bytes()))
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+}
+
+func scannedStrings(scanner *recordingScanner) []string {
+	var scanned []string
+	for _, data := range scanner.scanned {
+		scanned = append(scanned, string(data))
+	}
+	return scanned
+}
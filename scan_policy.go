@@ -0,0 +1,190 @@
+/*
+ * Scan policies decide which requests, and which parts of them, are sent to
+ * the scanner. They are configured in [policy "name"] sections, and attached
+ * to routes; the "default" policy applies to everything else.
+ */
+package main
+
+import (
+	"clammit/filetype"
+	"clammit/forwarder"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The name of the policy applied to requests not matching a route policy
+const defaultPolicyName = "default"
+
+/*
+ * A scan policy. A nil policy scans every request with a body, entirely.
+ */
+type ScanPolicy struct {
+	Name string
+	// Methods to scan. Empty means all.
+	Methods []string
+	// Request content types to scan ("image/*" matches any image). Empty
+	// means all.
+	ScanContentTypes []string
+	// Request content types never to scan
+	SkipContentTypes []string
+	// Maximum body size and part size in bytes, and number of parts. Zero
+	// means the global limit applies.
+	MaxBodySize int64
+	MaxPartSize int64
+	MaxParts    int
+	// Form fields to scan in multipart requests, as path.Match patterns.
+	// Empty means all parts.
+	FileFields []string
+	// Path prefixes passed through without scanning
+	SkipPaths []string
+	// File types allowed, by name or class (see the filetype package).
+	// Empty means all.
+	AllowTypes []string
+	// File types refused, by name or class
+	BlockTypes []string
+	// If true, files whose detected type disagrees with their declared
+	// content type or extension are refused
+	StrictTypes bool
+	// JSON paths of the base64 fields of JSON bodies to decode and scan.
+	// Empty means the long base64 strings and the data: URIs anywhere.
+	JSONFields []*JSONPath
+	// Minimum length of the strings found to be base64 and decoded. Zero
+	// means the default.
+	Base64MinLength int
+}
+
+/*
+ * Returns whether the request should be scanned and, if not, why
+ */
+func (p *ScanPolicy) ShouldScan(req *http.Request) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	for _, prefix := range p.SkipPaths {
+		if forwarder.MatchPathPrefix(prefix, req.URL.Path) {
+			return false, "path " + prefix + " is skipped"
+		}
+	}
+	if len(p.Methods) > 0 && !containsFold(p.Methods, req.Method) {
+		return false, "method " + req.Method + " is not scanned"
+	}
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		// Let the interceptor deal with it
+		return true, ""
+	}
+	if matchContentType(p.SkipContentTypes, contentType) {
+		return false, "content type " + contentType + " is skipped"
+	}
+	if len(p.ScanContentTypes) > 0 && !matchContentType(p.ScanContentTypes, contentType) {
+		return false, "content type " + contentType + " is not scanned"
+	}
+	return true, ""
+}
+
+/*
+ * Returns whether the given multipart part should be scanned
+ */
+func (p *ScanPolicy) ShouldScanPart(part *multipart.Part) bool {
+	if p == nil || len(p.FileFields) == 0 {
+		return true
+	}
+	name := part.FormName()
+	for _, pattern := range p.FileFields {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the minimum length of the strings found to be base64
+ */
+func (p *ScanPolicy) base64MinLength() int {
+	if p != nil && p.Base64MinLength > 0 {
+		return p.Base64MinLength
+	}
+	return defaultBase64MinLength
+}
+
+/*
+ * Returns true if the policy has file type rules
+ */
+func (p *ScanPolicy) checksFileTypes() bool {
+	return p != nil && (len(p.AllowTypes) > 0 || len(p.BlockTypes) > 0 || p.StrictTypes)
+}
+
+/*
+ * Checks a file, given its detected type, declared content type and name,
+ * against the policy. Returns the reason it is refused, or "" if allowed.
+ *
+ * The block list applies to both the detected and the declared types, so that
+ * e.g. a script without a shebang line is still refused by its extension.
+ */
+func (p *ScanPolicy) CheckFileType(detected *filetype.Type, declaredType string, filename string) string {
+	if p == nil {
+		return ""
+	}
+	candidates := []*filetype.Type{detected}
+	if t := filetype.ByExtension(filename); t != nil {
+		candidates = append(candidates, t)
+	}
+	if t := filetype.ByMimeType(declaredType); t != nil {
+		candidates = append(candidates, t)
+	}
+	for _, blocked := range p.BlockTypes {
+		for _, t := range candidates {
+			if t.Is(blocked) {
+				return "type " + t.Name + " is blocked"
+			}
+		}
+	}
+	if len(p.AllowTypes) > 0 {
+		allowed := false
+		for _, name := range p.AllowTypes {
+			allowed = allowed || detected.Is(name)
+		}
+		if !allowed {
+			return "type " + detected.Name + " is not allowed"
+		}
+	}
+	if p.StrictTypes {
+		if mismatch := filetype.Mismatch(detected, declaredType, filename); mismatch != "" {
+			return mismatch
+		}
+	}
+	return ""
+}
+
+/*
+ * Returns true if the media type matches one of the patterns, which can be
+ * either full types or wildcards like "image/*"
+ */
+func matchContentType(patterns []string, contentType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == contentType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Case insensitive list membership
+ */
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"clammit/filetype"
+	"clammit/scanner"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/gcfg.v1"
+)
+
+/*
+ * A scanner recording what it has been asked to scan. Like the real one, it
+ * ignores read errors.
+ */
+type RecordingScanner struct {
+	MockScanner
+	scanned []string
+}
+
+func (s *RecordingScanner) Scan(reader io.Reader) (*scanner.Result, error) {
+	data, _ := io.ReadAll(reader)
+	s.scanned = append(s.scanned, string(data))
+	return testResult(strings.Contains(string(data), "virus")), nil
+}
+
+func TestScanPolicy_ShouldScan(t *testing.T) {
+	policy := &ScanPolicy{
+		Name:             "test",
+		Methods:          []string{"POST", "PUT"},
+		SkipContentTypes: []string{"application/json"},
+		SkipPaths:        []string{"/health"},
+	}
+
+	shouldScan := func(method, path, contentType string) bool {
+		req := newHTTPRequest(method, contentType, nil)
+		req.URL.Path = path
+		scan, _ := policy.ShouldScan(req)
+		return scan
+	}
+
+	assert.True(t, shouldScan("POST", "/upload", "application/octet-stream"))
+	assert.True(t, shouldScan("put", "/upload", "multipart/form-data; boundary=foo"))
+	assert.False(t, shouldScan("DELETE", "/upload", "application/octet-stream"))
+	assert.False(t, shouldScan("POST", "/upload", "application/json; charset=utf-8"))
+	assert.False(t, shouldScan("POST", "/health", "application/octet-stream"))
+	assert.False(t, shouldScan("POST", "/health/db", "application/octet-stream"))
+	assert.True(t, shouldScan("POST", "/healthy", "application/octet-stream"))
+
+	policy = &ScanPolicy{ScanContentTypes: []string{"multipart/form-data", "image/*"}}
+	assert.True(t, shouldScan("POST", "/", "image/png"))
+	assert.True(t, shouldScan("POST", "/", "multipart/form-data; boundary=foo"))
+	assert.False(t, shouldScan("POST", "/", "text/plain"))
+
+	policy = nil
+	assert.True(t, shouldScan("GET", "/", "application/json"))
+}
+
+func TestScanPolicy_MaxBodySize(t *testing.T) {
+	setup()
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         new(RecordingScanner),
+		DefaultPolicy:   &ScanPolicy{Name: "default", MaxBodySize: 10},
+	}
+
+	// Known length
+	req := newHTTPRequest("POST", "application/octet-stream", strings.NewReader("more than ten bytes"))
+	rr := httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Unknown length
+	req = newHTTPRequest("POST", "application/octet-stream", io.MultiReader(strings.NewReader("more than ten bytes")))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Unknown length, multipart
+	body, contentType := makeMultipartBody()
+	req = newHTTPRequest("POST", contentType, io.MultiReader(body))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Within limits
+	req = newHTTPRequest("POST", "application/octet-stream", strings.NewReader("tiny"))
+	rr = httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 200, rr.Code)
+}
+
+func TestScanPolicy_FileFields(t *testing.T) {
+	setup()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		DefaultPolicy:   &ScanPolicy{Name: "default", FileFields: []string{"attachment*"}},
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("comment", "this is not a virus")
+	part, _ := writer.CreateFormFile("attachment1", "doc.pdf")
+	part.Write([]byte("document"))
+	part, _ = writer.CreateFormFile("attachment2", "img.png")
+	part.Write([]byte("image"))
+	require.NoError(t, writer.Close())
+
+	req := newHTTPRequest("POST", writer.FormDataContentType(), body)
+	rr := httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, []string{"document", "image"}, recorder.scanned)
+}
+
+func TestScanPolicy_Skipped(t *testing.T) {
+	setup()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		DefaultPolicy:   &ScanPolicy{Name: "default", SkipContentTypes: []string{"application/json"}},
+	}
+
+	req := newHTTPRequest("POST", "application/json", strings.NewReader(`{"virus": true}`))
+	rr := httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Empty(t, recorder.scanned)
+}
+
+func TestBuildPolicies(t *testing.T) {
+	var config Config
+	err := gcfg.ReadStringInto(&config, `
+[policy "default"]
+scan-method = POST, PUT
+
+[policy "api"]
+skip-content-type = application/json
+max-body-size     = 1024
+block-type        = executable, office-macro
+
+[route "api"]
+path-prefix = /api
+policy      = api
+
+[route "other"]
+path-prefix = /other
+`)
+	require.NoError(t, err)
+
+	interceptor := &ScanInterceptor{}
+	require.NoError(t, buildPolicies(interceptor, config.Policies, config.Routes))
+
+	assert.Equal(t, []string{"POST", "PUT"}, interceptor.DefaultPolicy.Methods)
+	assert.Equal(t, int64(1024), interceptor.Policies["api"].MaxBodySize)
+	assert.NotContains(t, interceptor.Policies, "other")
+	assert.Equal(t, []string{"executable", "office-macro"}, interceptor.Policies["api"].BlockTypes)
+
+	config.Policies["api"].BlockTypes = []string{"exe-cutable"}
+	assert.Error(t, buildPolicies(interceptor, config.Policies, config.Routes))
+	config.Policies["api"].BlockTypes = nil
+
+	config.Routes["other"].Policy = "missing"
+	assert.Error(t, buildPolicies(interceptor, config.Policies, config.Routes))
+}
+
+func TestScanPolicy_Route(t *testing.T) {
+	setup()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		Policies:        map[string]*ScanPolicy{"api": {Name: "api", SkipContentTypes: []string{"application/json"}}},
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+	}))
+	defer backend.Close()
+
+	for path, expected := range map[string]int{"/api/v1": 202, "/upload": virusCode} {
+		fw := forwarderFor(t, backend.URL, interceptor)
+		req := newHTTPRequest("POST", "application/json", strings.NewReader(`{"virus": true}`))
+		req.URL.Path = path
+		rr := httptest.NewRecorder()
+		fw.HandleRequest(rr, req)
+		assert.Equal(t, expected, rr.Code, path)
+	}
+}
+
+func TestScanPolicy_CheckFileType(t *testing.T) {
+	policy := &ScanPolicy{
+		AllowTypes: []string{"pdf", "image"},
+		BlockTypes: []string{"executable", "script"},
+	}
+	assert.Empty(t, policy.CheckFileType(filetype.PDF, "application/pdf", "report.pdf"))
+	assert.Empty(t, policy.CheckFileType(filetype.PNG, "", "photo.png"))
+	assert.NotEmpty(t, policy.CheckFileType(filetype.EXE, "application/pdf", "report.pdf"))
+	assert.NotEmpty(t, policy.CheckFileType(filetype.DOCX, "", "report.docx"))
+	assert.NotEmpty(t, policy.CheckFileType(filetype.PDF, "", "run.sh"), "the declared type should be blocked too")
+	assert.Empty(t, policy.CheckFileType(filetype.PNG, "", "photo.pdf"), "mismatches are only checked in strict mode")
+
+	policy.StrictTypes = true
+	assert.NotEmpty(t, policy.CheckFileType(filetype.PNG, "", "photo.pdf"))
+
+	assert.Empty(t, (*ScanPolicy)(nil).CheckFileType(filetype.EXE, "", "setup.exe"))
+}
+
+func TestScanPolicy_FileTypes(t *testing.T) {
+	setup()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		DefaultPolicy:   &ScanPolicy{Name: "default", AllowTypes: []string{"pdf"}},
+	}
+
+	makeBody := func(filename string, content string) (*bytes.Buffer, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("comment", "fields without file name are not checked")
+		part, _ := writer.CreateFormFile("file", filename)
+		part.Write([]byte(content))
+		writer.Close()
+		return body, writer.FormDataContentType()
+	}
+
+	body, contentType := makeBody("report.pdf", "%PDF-1.4 the whole document")
+	req := newHTTPRequest("POST", contentType, body)
+	rr := httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+	assert.Contains(t, recorder.scanned, "%PDF-1.4 the whole document", "the whole file should be scanned")
+
+	body, contentType = makeBody("report.pdf", "MZ\x90\x00 not a pdf")
+	req = newHTTPRequest("POST", contentType, body)
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 415, rr.Code)
+	assert.Equal(t, "File report.pdf is not allowed: type exe is not allowed", rr.Body.String())
+
+	// Raw body
+	interceptor.PolicyStatusCode = 422
+	req = newHTTPRequest("POST", "application/pdf", strings.NewReader("#!/bin/sh"))
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 422, rr.Code)
+}
+
+func TestScanPolicy_PartLimits(t *testing.T) {
+	setup()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		MaxParts:        5,
+		MaxPartSize:     8,
+	}
+
+	makeBody := func(parts ...string) (*bytes.Buffer, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for i, content := range parts {
+			writer.WriteField(fmt.Sprintf("field%d", i), content)
+		}
+		writer.Close()
+		return body, writer.FormDataContentType()
+	}
+
+	body, contentType := makeBody("one", "two", "three")
+	req := newHTTPRequest("POST", contentType, body)
+	rr := httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+
+	body, contentType = makeBody("one", "two", "three", "four", "five", "six")
+	req = newHTTPRequest("POST", contentType, body)
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	body, contentType = makeBody("one", "this part is too long")
+	req = newHTTPRequest("POST", contentType, body)
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Parts that are not scanned are limited too
+	interceptor.DefaultPolicy = &ScanPolicy{Name: "default", FileFields: []string{"field0"}}
+	body, contentType = makeBody("one", "this part is too long")
+	req = newHTTPRequest("POST", contentType, body)
+	rr = httptest.NewRecorder()
+	assert.True(t, interceptor.Handle(rr, req, req.Body))
+	assert.Equal(t, 413, rr.Code)
+
+	// Policy limits override the global ones
+	interceptor.DefaultPolicy = &ScanPolicy{Name: "default", MaxPartSize: 100}
+	body, contentType = makeBody("one", "this part is too long")
+	req = newHTTPRequest("POST", contentType, body)
+	rr = httptest.NewRecorder()
+	assert.False(t, interceptor.Handle(rr, req, req.Body))
+}
+
+func TestScanPolicy_PartLimitsWhileForwarding(t *testing.T) {
+	setup()
+	forwarded := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		w.WriteHeader(202)
+	}))
+	defer backend.Close()
+	recorder := new(RecordingScanner)
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         recorder,
+		MaxParts:        2,
+		MaxPartSize:     8,
+		// Nothing is scanned
+		DefaultPolicy: &ScanPolicy{Name: "default", Methods: []string{"PUT"}},
+	}
+
+	for _, parts := range [][]string{{"one", "two", "three"}, {"one", "this part is too long"}} {
+		contentType, body := makeFilesBody(t, parts...)
+		req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, req)
+		assert.Equal(t, 413, rr.Code, parts)
+	}
+	assert.Equal(t, 0, forwarded)
+	assert.Empty(t, recorder.scanned)
+
+	contentType, body := makeFilesBody(t, "one", "two")
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, req)
+	assert.Equal(t, 202, rr.Code)
+}
+
+func TestScanInterceptor_BodyLimit(t *testing.T) {
+	interceptor := &ScanInterceptor{MaxBodySize: 100}
+	req := newHTTPRequest("POST", "application/octet-stream", nil)
+	assert.Equal(t, int64(100), interceptor.BodyLimit(req))
+
+	interceptor.DefaultPolicy = &ScanPolicy{MaxBodySize: 10}
+	assert.Equal(t, int64(10), interceptor.BodyLimit(req))
+}
@@ -1,11 +1,16 @@
 package scanner
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	clamd "github.com/dutchcoders/go-clamd"
 )
 
+// Returned when clamd closes the connection without replying
+var errNoResponse = errors.New("clamd closed the connection without replying")
+
 /*
  * Clamav scans files using clamav
  */
@@ -28,6 +33,9 @@ func (c *Clamav) HasVirus(reader io.Reader) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if result.Status == RES_ERROR {
+		return false, fmt.Errorf("clamd failed to scan: %s", result.Description)
+	}
 
 	return result.Virus, nil
 }
@@ -45,18 +53,23 @@ func (c *Clamav) Scan(reader io.Reader) (*Result, error) {
 	}
 	var status string
 
-	r := (<-ch)
+	r, ok := <-ch
+	if !ok {
+		return nil, errNoResponse
+	}
 
 	switch r.Status {
 	case clamd.RES_OK:
 		status = RES_CLEAN
 	case clamd.RES_FOUND:
 		status = RES_FOUND
-	case clamd.RES_ERROR:
-	case clamd.RES_PARSE_ERROR:
 	default:
+		// Errors, including malformed replies
 		status = RES_ERROR
 	}
+	if r.Status == clamd.RES_PARSE_ERROR {
+		r.Description = "unexpected reply: " + r.Raw
+	}
 
 	result := &Result{
 		Status:      status,
@@ -86,6 +99,9 @@ func (c *Clamav) Version() (string, error) {
 		return "", err
 	}
 
-	r := (<-ch)
+	r, ok := <-ch
+	if !ok {
+		return "", errNoResponse
+	}
 	return r.Raw, nil
 }
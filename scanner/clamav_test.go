@@ -0,0 +1,117 @@
+package scanner
+
+import (
+	"bytes"
+	"clammit/clamdtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClamav(address string) *Clamav {
+	clamav := new(Clamav)
+	clamav.SetLogger(nil, false)
+	clamav.SetAddress(address)
+	return clamav
+}
+
+func TestClamav_Scan(t *testing.T) {
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(
+		clamdtest.Found("virus", "Test.Virus"),
+		clamdtest.Failure("broken", "Can't allocate memory"),
+		clamdtest.Malformed("garbage", "this is not clamd"),
+	)
+	clamav := newClamav(clamd.URL)
+
+	result, err := clamav.Scan(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Status: RES_CLEAN}, result)
+
+	result, err = clamav.Scan(bytes.NewReader(clamdtest.EICAR))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Status: RES_FOUND, Virus: true, Description: clamdtest.EICAR_SIGNATURE}, result)
+
+	result, err = clamav.Scan(strings.NewReader(strings.Repeat(".", 3000) + "a virus in the third chunk"))
+	require.NoError(t, err)
+	assert.Equal(t, "Test.Virus", result.Description)
+
+	result, err = clamav.Scan(strings.NewReader("broken"))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Status: RES_ERROR, Description: "Can't allocate memory"}, result)
+
+	result, err = clamav.Scan(strings.NewReader("garbage"))
+	require.NoError(t, err)
+	assert.Equal(t, RES_ERROR, result.Status)
+	assert.Equal(t, "unexpected reply: this is not clamd", result.Description)
+
+	assert.Equal(t, 5, clamd.Scans())
+}
+
+func TestClamav_HasVirus(t *testing.T) {
+	clamd := clamdtest.NewUnixServer()
+	defer clamd.Close()
+	clamd.AddRule(clamdtest.Failure("broken", "Can't allocate memory"), clamdtest.Drop("drop"))
+	clamav := newClamav(clamd.URL)
+
+	virus, err := clamav.HasVirus(bytes.NewReader(clamdtest.EICAR))
+	require.NoError(t, err)
+	assert.True(t, virus)
+
+	virus, err = clamav.HasVirus(strings.NewReader("clean"))
+	require.NoError(t, err)
+	assert.False(t, virus)
+
+	// Failed scans are not clean
+	_, err = clamav.HasVirus(strings.NewReader("broken"))
+	assert.EqualError(t, err, "clamd failed to scan: Can't allocate memory")
+
+	_, err = clamav.HasVirus(strings.NewReader("drop"))
+	assert.Error(t, err)
+}
+
+func TestClamav_StreamMaxLength(t *testing.T) {
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.SetStreamMaxLength(2000)
+	clamav := newClamav(clamd.URL)
+
+	virus, err := clamav.HasVirus(strings.NewReader(strings.Repeat("x", 1500)))
+	require.NoError(t, err)
+	assert.False(t, virus)
+
+	_, err = clamav.HasVirus(strings.NewReader(strings.Repeat("x", 2500)))
+	assert.Error(t, err)
+}
+
+func TestClamav_Latency(t *testing.T) {
+	clamd := clamdtest.NewServer()
+	defer clamd.Close()
+	clamd.AddRule(clamdtest.Slow(100 * time.Millisecond))
+	clamav := newClamav(clamd.URL)
+
+	start := time.Now()
+	virus, err := clamav.HasVirus(strings.NewReader("clean"))
+	require.NoError(t, err)
+	assert.False(t, virus)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestClamav_PingVersion(t *testing.T) {
+	clamd := clamdtest.NewServer()
+	clamav := newClamav(clamd.URL)
+
+	assert.NoError(t, clamav.Ping())
+	version, err := clamav.Version()
+	require.NoError(t, err)
+	assert.Equal(t, clamdtest.VERSION, version)
+
+	clamd.Close()
+	assert.Error(t, clamav.Ping())
+	_, err = clamav.Version()
+	assert.Error(t, err)
+}
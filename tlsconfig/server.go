@@ -0,0 +1,178 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * How often the certificate files are checked for changes
+ */
+var CheckInterval = 10 * time.Second
+
+/*
+ * Server-side TLS options, as read from the configuration file
+ */
+type ServerOptions struct {
+	// PEM certificate and key of the server
+	CertFile string
+	KeyFile  string
+	// PEM bundle of the CAs used to verify client certificates
+	ClientCAFile string
+	// Client certificate policy: "none", "request", "verify-if-given" or
+	// "require". Defaults to "require" when ClientCAFile is set.
+	ClientAuth string
+	// Minimum protocol version: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string
+}
+
+/*
+ * Builds TLS server configurations and rebuilds them whenever one of the
+ * certificate files changes on disk, so that renewed certificates are
+ * picked up without restarting. If a reload fails, the last good
+ * configuration is kept.
+ */
+type serverReloader struct {
+	options   ServerOptions
+	logger    *log.Logger
+	mutex     sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+/*
+ * Constructs a server TLS configuration that reloads its certificates when
+ * they change. The logger is used to report reload failures.
+ */
+func NewServerConfig(options *ServerOptions, logger *log.Logger) (*tls.Config, error) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	r := &serverReloader{options: *options, logger: logger}
+	config, err := r.build()
+	if err != nil {
+		return nil, err
+	}
+	r.config = config
+	r.modTimes = r.currentModTimes()
+	r.checkedAt = time.Now()
+
+	return &tls.Config{
+		MinVersion:         config.MinVersion,
+		GetConfigForClient: r.getConfigForClient,
+	}, nil
+}
+
+/*
+ * Implementation of tls.Config.GetConfigForClient
+ */
+func (r *serverReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checkedAt) < CheckInterval {
+		return r.config, nil
+	}
+	r.checkedAt = time.Now()
+
+	modTimes := r.currentModTimes()
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if changed {
+		if config, err := r.build(); err != nil {
+			r.logger.Println("Unable to reload TLS certificates, keeping the current ones:", err)
+		} else {
+			r.logger.Println("Reloaded TLS certificates from", r.options.CertFile)
+			r.config = config
+			r.modTimes = modTimes
+		}
+	}
+	return r.config, nil
+}
+
+/*
+ * Returns the modification times of the watched files
+ */
+func (r *serverReloader) currentModTimes() []time.Time {
+	files := []string{r.options.CertFile, r.options.KeyFile, r.options.ClientCAFile}
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+/*
+ * Reads the certificate files and builds a new configuration
+ */
+func (r *serverReloader) build() (*tls.Config, error) {
+	o := &r.options
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, fmt.Errorf("Both a certificate and a key file must be given")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load key pair %s, %s: %s", o.CertFile, o.KeyFile, err.Error())
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if o.MinVersion != "" {
+		if config.MinVersion, err = ParseVersion(o.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ClientAuth, err = ParseClientAuth(o.ClientAuth, o.ClientCAFile != ""); err != nil {
+		return nil, err
+	}
+	if o.ClientCAFile != "" {
+		if config.ClientCAs, err = LoadCertPool(o.ClientCAFile); err != nil {
+			return nil, err
+		}
+	} else if config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("A client CA file is needed to verify client certificates")
+	}
+	return config, nil
+}
+
+/*
+ * Converts a client authentication policy to the matching crypto/tls
+ * constant. An empty policy means "require" if a client CA is available,
+ * "none" otherwise.
+ */
+func ParseClientAuth(policy string, haveClientCA bool) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case "":
+		if haveClientCA {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("Unknown client authentication policy: %s", policy)
+}
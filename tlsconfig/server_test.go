@@ -0,0 +1,127 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func commonName(t *testing.T, config *tls.Config) string {
+	require.Len(t, config.Certificates, 1)
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	return cert.Subject.CommonName
+}
+
+func TestServerConfig_Reload(t *testing.T) {
+	defer func(interval time.Duration) { CheckInterval = interval }(CheckInterval)
+	CheckInterval = 0
+
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first.local")
+
+	config, err := NewServerConfig(&ServerOptions{CertFile: certFile, KeyFile: keyFile}, nil)
+	require.NoError(t, err)
+
+	current, err := config.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first.local", commonName(t, current))
+
+	// Replace the certificate on disk
+	newCert, newKey := writeCertificate(t, dir, "second.local")
+	require.NoError(t, os.Rename(newCert, certFile))
+	require.NoError(t, os.Rename(newKey, keyFile))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	current, err = config.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second.local", commonName(t, current))
+
+	// A broken certificate keeps the last good one
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	current, err = config.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second.local", commonName(t, current))
+}
+
+func TestServerConfig_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCertificate(t, dir, "server.local")
+	clientCert, clientKey := writeCertificate(t, dir, "client.local")
+
+	config, err := NewServerConfig(&ServerOptions{
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: clientCert,
+	}, nil)
+	require.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func(clientOptions *Options) error {
+		clientConfig, err := clientOptions.ClientConfig()
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With TLS 1.3 client certificate failures are only reported on read
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	err = handshake(&Options{CAFile: serverCert, ServerName: "server.local"})
+	assert.Error(t, err, "a client without certificate should be refused")
+
+	err = handshake(&Options{CAFile: serverCert, ServerName: "server.local", CertFile: clientCert, KeyFile: clientKey})
+	if err != nil {
+		assert.NotContains(t, err.Error(), "certificate", "a client with a valid certificate should be accepted")
+	}
+}
+
+func TestServerConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "server.local")
+
+	_, err := NewServerConfig(&ServerOptions{CertFile: certFile}, nil)
+	assert.Error(t, err)
+
+	_, err = NewServerConfig(&ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: "require"}, nil)
+	assert.Error(t, err, "verifying clients needs a CA")
+
+	_, err = NewServerConfig(&ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: "sometimes"}, nil)
+	assert.Error(t, err)
+}
+
+func TestParseClientAuth(t *testing.T) {
+	auth, _ := ParseClientAuth("", true)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, auth)
+	auth, _ = ParseClientAuth("", false)
+	assert.Equal(t, tls.NoClientCert, auth)
+	auth, _ = ParseClientAuth("request", true)
+	assert.Equal(t, tls.RequestClientCert, auth)
+	auth, _ = ParseClientAuth("verify-if-given", true)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, auth)
+}
@@ -0,0 +1,114 @@
+/*
+ * Helpers to construct crypto/tls configurations from the settings found in
+ * the configuration file, so that the same options (CA bundles, certificate
+ * pairs, minimum protocol versions) are interpreted consistently wherever
+ * clammit speaks TLS.
+ */
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * TLS options, as read from the configuration file. All fields are optional.
+ */
+type Options struct {
+	// PEM bundle of the certificate authorities to trust
+	CAFile string
+	// PEM certificate and key to present to the peer
+	CertFile string
+	KeyFile  string
+	// Overrides the server name used for SNI and certificate verification
+	ServerName string
+	// Minimum protocol version: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string
+	// Disables verification of the peer certificate. Development only!
+	InsecureSkipVerify bool
+}
+
+/*
+ * Returns true if none of the options have been set
+ */
+func (o *Options) IsZero() bool {
+	return *o == Options{}
+}
+
+/*
+ * Builds a client-side TLS configuration from the options
+ */
+func (o *Options) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.MinVersion != "" {
+		version, err := ParseVersion(o.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		config.MinVersion = version
+	}
+
+	if o.CAFile != "" {
+		pool, err := LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("Both a certificate and a key file must be given")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load key pair %s, %s: %s", o.CertFile, o.KeyFile, err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+/*
+ * Reads a PEM bundle into a certificate pool
+ */
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in CA file %s", filename)
+	}
+	return pool, nil
+}
+
+/*
+ * Converts a version string ("1.2", "TLS1.2", "tls12"...) to the matching
+ * crypto/tls constant
+ */
+func ParseVersion(version string) (uint16, error) {
+	v := strings.ToLower(strings.TrimSpace(version))
+	v = strings.TrimPrefix(v, "tls")
+	v = strings.TrimPrefix(v, "v")
+	switch v {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Unknown TLS version: %s", version)
+}
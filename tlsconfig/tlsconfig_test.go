@@ -0,0 +1,111 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/*
+ * Writes a self-signed certificate and its key into dir, returning the
+ * file names
+ */
+func writeCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestParseVersion(t *testing.T) {
+	for input, expected := range map[string]uint16{
+		"1.0":    tls.VersionTLS10,
+		"1.1":    tls.VersionTLS11,
+		"1.2":    tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13,
+		"tls12":  tls.VersionTLS12,
+	} {
+		v, err := ParseVersion(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, v, input)
+	}
+
+	_, err := ParseVersion("1.4")
+	assert.Error(t, err)
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "backend.local")
+
+	options := &Options{
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "backend.local",
+		MinVersion: "1.2",
+	}
+	config, err := options.ClientConfig()
+	require.NoError(t, err)
+
+	assert.Equal(t, "backend.local", config.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.NotNil(t, config.RootCAs)
+	assert.Len(t, config.Certificates, 1)
+	assert.False(t, config.InsecureSkipVerify)
+}
+
+func TestClientConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, _ := writeCertificate(t, dir, "backend.local")
+
+	_, err := (&Options{CertFile: certFile}).ClientConfig()
+	assert.Error(t, err, "a certificate without key should fail")
+
+	_, err = (&Options{CAFile: filepath.Join(dir, "missing.pem")}).ClientConfig()
+	assert.Error(t, err, "a missing CA file should fail")
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a certificate"), 0600))
+	_, err = (&Options{CAFile: garbage}).ClientConfig()
+	assert.Error(t, err, "an empty CA bundle should fail")
+
+	_, err = (&Options{MinVersion: "2.0"}).ClientConfig()
+	assert.Error(t, err)
+}
+
+func TestIsZero(t *testing.T) {
+	assert.True(t, (&Options{}).IsZero())
+	assert.False(t, (&Options{ServerName: "foo"}).IsZero())
+}
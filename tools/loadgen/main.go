@@ -0,0 +1,432 @@
+/*
+ * A load generator for clammit: sends a mix of clean, EICAR and large files,
+ * as multipart or raw bodies, from concurrent workers, then reports the
+ * throughput and latency percentiles, e.g.
+ *
+ *	go run ./tools/loadgen -url=http://localhost:8438/clammit/scan \
+ *		-concurrency=20 -duration=30s -mix=clean=8,eicar=1,large=1
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var EICAR = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+/*
+ * The load test settings
+ */
+type Options struct {
+	URL         string
+	Concurrency int
+	Count       int
+	Duration    time.Duration
+	Timeout     time.Duration
+	// Weights of the kinds of files, and of the body formats
+	Mix    map[string]int
+	Bodies map[string]int
+	// Sizes of the clean and large files
+	CleanSize int
+	LargeSize int
+	// The multipart field name
+	Field string
+	// Bearer token, if the scan endpoint is protected
+	Token string
+	// The status code returned by clammit on viruses
+	VirusStatusCode int
+}
+
+/*
+ * A file to send, as a prepared request body
+ */
+type payload struct {
+	kind string
+	// How often it is sent, relative to the others
+	weight      int
+	body        []byte
+	contentType string
+	// The status code expected
+	expected int
+}
+
+/*
+ * The outcome of a request
+ */
+type sample struct {
+	kind       string
+	latency    time.Duration
+	statusCode int
+	err        error
+	unexpected bool
+	bytes      int64
+}
+
+/*
+ * Latency statistics, in milliseconds
+ */
+type Latency struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+/*
+ * The load test results
+ */
+type Report struct {
+	URL         string  `json:"url"`
+	Concurrency int     `json:"concurrency"`
+	Requests    int     `json:"requests"`
+	Seconds     float64 `json:"seconds"`
+	Throughput  float64 `json:"requests_per_second"`
+	BytesPerSec float64 `json:"bytes_per_second"`
+	// Number of answers by status code
+	StatusCodes map[string]int `json:"status_codes"`
+	// Connection and timeout errors
+	Errors int `json:"errors"`
+	// Answers other than 200 for clean files and the virus status code for
+	// EICAR files, errors included
+	Unexpected int                 `json:"unexpected"`
+	Latency    Latency             `json:"latency"`
+	ByKind     map[string]*Latency `json:"latency_by_kind"`
+}
+
+func main() {
+	options := &Options{}
+	var mix, bodies string
+	var jsonOutput bool
+	flag.StringVar(&options.URL, "url", "http://localhost:8438/clammit/scan", "URL to send the files to")
+	flag.IntVar(&options.Concurrency, "concurrency", 10, "Number of concurrent requests")
+	flag.IntVar(&options.Count, "count", 0, "Number of requests to send, if no duration is given (default 100)")
+	flag.DurationVar(&options.Duration, "duration", 0, "How long to send requests for")
+	flag.DurationVar(&options.Timeout, "timeout", 30*time.Second, "Request timeout")
+	flag.StringVar(&mix, "mix", "clean=8,eicar=1,large=1", "Weights of the clean, eicar and large files")
+	flag.StringVar(&bodies, "body", "multipart=1,raw=1", "Weights of the multipart and raw bodies")
+	flag.IntVar(&options.CleanSize, "clean-size", 16*1024, "Size in bytes of the clean files")
+	flag.IntVar(&options.LargeSize, "large-size", 10*1024*1024, "Size in bytes of the large files")
+	flag.StringVar(&options.Field, "field", "file", "Multipart field name")
+	flag.StringVar(&options.Token, "token", "", "Bearer token for the scan endpoint")
+	flag.IntVar(&options.VirusStatusCode, "virus-status-code", 418, "Status code returned by clammit on viruses")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+	flag.Parse()
+
+	var err error
+	if options.Mix, err = parseWeights(mix, "clean", "eicar", "large"); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -mix:", err)
+		os.Exit(2)
+	}
+	if options.Bodies, err = parseWeights(bodies, "multipart", "raw"); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -body:", err)
+		os.Exit(2)
+	}
+	if options.Count == 0 && options.Duration == 0 {
+		options.Count = 100
+	}
+
+	report := run(options)
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printReport(report, os.Stdout)
+	}
+	if report.Unexpected > 0 {
+		os.Exit(1)
+	}
+}
+
+/*
+ * Parses weights like "clean=8,eicar=1", accepting only the given names
+ */
+func parseWeights(value string, names ...string) (map[string]int, error) {
+	weights := map[string]int{}
+	total := 0
+	for _, item := range strings.Split(value, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, fmt.Errorf("expected name=weight: %s", item)
+		}
+		known := false
+		for _, n := range names {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown name %s, expected one of %s", name, strings.Join(names, ", "))
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight: %s", item)
+		}
+		weights[name] = w
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("all the weights are zero")
+	}
+	return weights, nil
+}
+
+/*
+ * Prepares a request body for each kind of file and body format
+ */
+func payloads(options *Options) []*payload {
+	random := rand.New(rand.NewSource(1))
+	files := map[string][]byte{
+		"clean": randomText(random, options.CleanSize),
+		"eicar": EICAR,
+		"large": randomText(random, options.LargeSize),
+	}
+	var prepared []*payload
+	for _, kind := range []string{"clean", "eicar", "large"} {
+		expected := http.StatusOK
+		if kind == "eicar" {
+			expected = options.VirusStatusCode
+		}
+		for _, format := range []string{"multipart", "raw"} {
+			weight := options.Mix[kind] * options.Bodies[format]
+			if weight == 0 {
+				continue
+			}
+			p := &payload{kind: kind, weight: weight, body: files[kind], contentType: "application/octet-stream", expected: expected}
+			if format == "multipart" {
+				p.body, p.contentType = multipartBody(options.Field, kind+".dat", files[kind])
+			}
+			prepared = append(prepared, p)
+		}
+	}
+	return prepared
+}
+
+func randomText(random *rand.Rand, size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz \n"
+	text := make([]byte, size)
+	for i := range text {
+		text[i] = letters[random.Intn(len(letters))]
+	}
+	return text
+}
+
+func multipartBody(field string, filename string, contents []byte) ([]byte, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile(field, filename)
+	part.Write(contents)
+	writer.Close()
+	return body.Bytes(), writer.FormDataContentType()
+}
+
+/*
+ * Sends the requests from concurrent workers, and returns the report
+ */
+func run(options *Options) *Report {
+	prepared := payloads(options)
+	client := &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: options.Concurrency,
+		},
+	}
+
+	runCtx, cancel := context.Background(), func() {}
+	if options.Duration > 0 {
+		runCtx, cancel = context.WithTimeout(runCtx, options.Duration)
+	}
+	defer cancel()
+
+	jobs := make(chan *payload)
+	go func() {
+		defer close(jobs)
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; options.Duration > 0 || i < options.Count; i++ {
+			select {
+			case jobs <- pick(random, prepared):
+			case <-runCtx.Done():
+				return
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var samples []sample
+	start := time.Now()
+	for i := 0; i < options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []sample
+			for p := range jobs {
+				local = append(local, send(client, options, p))
+			}
+			mutex.Lock()
+			samples = append(samples, local...)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	return buildReport(options, samples, time.Since(start))
+}
+
+/*
+ * Picks a payload at random, according to the weights
+ */
+func pick(random *rand.Rand, prepared []*payload) *payload {
+	total := 0
+	for _, p := range prepared {
+		total += p.weight
+	}
+	n := random.Intn(total)
+	for _, p := range prepared {
+		if n < p.weight {
+			return p
+		}
+		n -= p.weight
+	}
+	return prepared[len(prepared)-1]
+}
+
+/*
+ * Sends a request, and times it until its answer is read
+ */
+func send(client *http.Client, options *Options, p *payload) sample {
+	s := sample{kind: p.kind, bytes: int64(len(p.body))}
+	req, err := http.NewRequest("POST", options.URL, bytes.NewReader(p.body))
+	if err != nil {
+		s.err, s.unexpected = err, true
+		return s
+	}
+	req.Header.Set("Content-Type", p.contentType)
+	if options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+options.Token)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		s.statusCode = resp.StatusCode
+	}
+	s.latency = time.Since(start)
+	s.err = err
+	s.unexpected = err != nil || s.statusCode != p.expected
+	return s
+}
+
+func buildReport(options *Options, samples []sample, elapsed time.Duration) *Report {
+	report := &Report{
+		URL:         options.URL,
+		Concurrency: options.Concurrency,
+		Requests:    len(samples),
+		Seconds:     elapsed.Seconds(),
+		StatusCodes: map[string]int{},
+		ByKind:      map[string]*Latency{},
+	}
+	var totalBytes int64
+	all := []time.Duration{}
+	byKind := map[string][]time.Duration{}
+	for _, s := range samples {
+		totalBytes += s.bytes
+		if s.err != nil {
+			report.Errors++
+		} else {
+			report.StatusCodes[strconv.Itoa(s.statusCode)]++
+		}
+		if s.unexpected {
+			report.Unexpected++
+		}
+		all = append(all, s.latency)
+		byKind[s.kind] = append(byKind[s.kind], s.latency)
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(len(samples)) / elapsed.Seconds()
+		report.BytesPerSec = float64(totalBytes) / elapsed.Seconds()
+	}
+	report.Latency = latencies(all)
+	for kind, durations := range byKind {
+		l := latencies(durations)
+		report.ByKind[kind] = &l
+	}
+	return report
+}
+
+/*
+ * Computes the latency statistics, with nearest-rank percentiles
+ */
+func latencies(durations []time.Duration) Latency {
+	if len(durations) == 0 {
+		return Latency{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	percentile := func(p float64) float64 {
+		rank := int(p/100*float64(len(durations))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(durations) {
+			rank = len(durations) - 1
+		}
+		return ms(durations[rank])
+	}
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	return Latency{
+		Count: len(durations),
+		Mean:  ms(total / time.Duration(len(durations))),
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P95:   percentile(95),
+		P99:   percentile(99),
+		Max:   ms(durations[len(durations)-1]),
+	}
+}
+
+func printReport(report *Report, w io.Writer) {
+	fmt.Fprintf(w, "Requests:    %d in %.2fs (%.1f req/s, %.2f MB/s) with %d workers\n",
+		report.Requests, report.Seconds, report.Throughput, report.BytesPerSec/1024/1024, report.Concurrency)
+	var codes []string
+	for code, count := range report.StatusCodes {
+		codes = append(codes, fmt.Sprintf("%s: %d", code, count))
+	}
+	sort.Strings(codes)
+	fmt.Fprintf(w, "Answers:     %s\n", strings.Join(codes, ", "))
+	fmt.Fprintf(w, "Errors:      %d\n", report.Errors)
+	fmt.Fprintf(w, "Unexpected:  %d\n\n", report.Unexpected)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "kind\tcount\tmean ms\tp50 ms\tp90 ms\tp95 ms\tp99 ms\tmax ms\t")
+	row := func(name string, l *Latency) {
+		fmt.Fprintf(table, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\t\n", name, l.Count, l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max)
+	}
+	for _, kind := range []string{"clean", "eicar", "large"} {
+		if l, ok := report.ByKind[kind]; ok {
+			row(kind, l)
+		}
+	}
+	row("all", &report.Latency)
+	table.Flush()
+}
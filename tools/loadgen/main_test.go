@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWeights(t *testing.T) {
+	weights, err := parseWeights("clean=8, eicar=0", "clean", "eicar", "large")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"clean": 8, "eicar": 0}, weights)
+
+	for _, value := range []string{"clean", "virus=1", "clean=-1", "clean=0,eicar=0"} {
+		_, err := parseWeights(value, "clean", "eicar", "large")
+		assert.Error(t, err, value)
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	var durations []time.Duration
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, Latency{Count: 100, Mean: 50.5, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100}, latencies(durations))
+	assert.Equal(t, Latency{}, latencies(nil))
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if bytes.Contains(body, EICAR) {
+			w.WriteHeader(418)
+		} else if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+			// Pretend multipart bodies of clean files fail
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	report := run(&Options{
+		URL:             server.URL,
+		Concurrency:     4,
+		Count:           200,
+		Mix:             map[string]int{"clean": 1, "eicar": 1},
+		Bodies:          map[string]int{"raw": 1},
+		CleanSize:       100,
+		VirusStatusCode: 418,
+	})
+	assert.Equal(t, 200, report.Requests)
+	assert.Equal(t, 200, report.StatusCodes["200"]+report.StatusCodes["418"])
+	assert.Equal(t, 0, report.Unexpected)
+	assert.Equal(t, 200, report.ByKind["clean"].Count+report.ByKind["eicar"].Count)
+	assert.Nil(t, report.ByKind["large"])
+
+	report = run(&Options{
+		URL:             server.URL,
+		Concurrency:     2,
+		Duration:        100 * time.Millisecond,
+		Mix:             map[string]int{"clean": 1},
+		Bodies:          map[string]int{"multipart": 1},
+		CleanSize:       100,
+		Field:           "file",
+		VirusStatusCode: 418,
+	})
+	assert.Greater(t, report.Requests, 0)
+	assert.Equal(t, report.Requests, report.Unexpected)
+
+	var text strings.Builder
+	printReport(report, &text)
+	assert.Contains(t, text.String(), "Answers:     500: ")
+}
@@ -0,0 +1,110 @@
+/*
+ * The scan verdict added to the requests forwarded to the application, and
+ * signed with a key it shares with clammit: without it, the application
+ * cannot tell a scanned request from one that bypassed clammit. See
+ * client.VerifyVerdict for the verification.
+ */
+package main
+
+import (
+	"clammit/client"
+	"clammit/scanner"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The shortest key accepted
+const minVerdictKeyLength = 16
+
+// How long the scanner version is cached: asking clamd is a round trip
+const scannerVersionTTL = time.Minute
+
+/*
+ * Signs the verdict headers of the requests
+ */
+type VerdictSigner struct {
+	Key     []byte
+	Scanner scanner.Scanner
+
+	mutex       sync.Mutex
+	version     string
+	versionTime time.Time
+}
+
+/*
+ * Constructs the verdict signer, or returns nil if verdict-hmac-key is not set
+ */
+func buildVerdictSigner(config *ApplicationConfig, scanner scanner.Scanner) (*VerdictSigner, error) {
+	if config.VerdictHMACKey == "" {
+		return nil, nil
+	}
+	if len(config.VerdictHMACKey) < minVerdictKeyLength {
+		return nil, fmt.Errorf("verdict-hmac-key must be at least %d characters long", minVerdictKeyLength)
+	}
+	return &VerdictSigner{Key: []byte(config.VerdictHMACKey), Scanner: scanner}, nil
+}
+
+/*
+ * Sets the verdict headers of a request about to be forwarded, and signs
+ * them
+ */
+func (v *VerdictSigner) Sign(scan *requestScan) {
+	header := scan.req.Header
+	if header.Get(ResultHeader) == "" {
+		if scan.scanned {
+			header.Set(ResultHeader, client.RES_CLEAN)
+		} else {
+			header.Set(ResultHeader, client.RES_SKIPPED)
+		}
+	}
+	if version := v.scannerVersion(); version != "" {
+		header.Set(client.ScannerHeader, version)
+	}
+	// In request order, whatever the order the scans ended in
+	sort.SliceStable(scan.hashes, func(i, j int) bool {
+		a, b := scan.hashes[i], scan.hashes[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		return a.Name < b.Name
+	})
+	for _, hash := range scan.hashes {
+		header.Add(client.PartHashHeader, hash.String())
+	}
+	header.Set(client.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	header.Set(client.HMACHeader, client.SignVerdict(v.Key, scan.req.Method, scan.req.URL.RequestURI(), header))
+}
+
+/*
+ * Returns the scanner version, e.g. "ClamAV 1.0.1/26789/Mon Feb 13 08:20:07
+ * 2023", or "" if it is unavailable
+ */
+func (v *VerdictSigner) scannerVersion() string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if time.Since(v.versionTime) > scannerVersionTTL {
+		version, err := v.Scanner.Version()
+		if err != nil {
+			ctx.Logger.Printf("Unable to get the scanner version for the verdict headers: %v", err)
+		}
+		v.version, v.versionTime = strings.TrimSpace(version), time.Now()
+	}
+	return v.version
+}
+
+/*
+ * Removes the X-Clammit headers sent by clients, but X-Clammit-Backend: only
+ * clammit tells the application what it found
+ */
+func stripClammitHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "X-Clammit-") && name != "X-Clammit-Backend" {
+			delete(header, name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"clammit/client"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verdictKey = []byte("0123456789abcdef")
+
+func TestScanInterceptor_Verdict(t *testing.T) {
+	setup()
+	var verdict *client.Verdict
+	var verdictErr error
+	var backendHeader http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verdict, verdictErr = client.VerifyVerdict(r, verdictKey, time.Minute)
+		backendHeader = r.Header
+	}))
+	defer backend.Close()
+	scanner := &recordingScanner{}
+	interceptor := &ScanInterceptor{
+		VirusStatusCode: virusCode,
+		Scanner:         scanner,
+		Verdict:         &VerdictSigner{Key: verdictKey, Scanner: scanner},
+	}
+	forward := func(req *http.Request) {
+		verdict, verdictErr, backendHeader = nil, nil, nil
+		rr := httptest.NewRecorder()
+		forwarderFor(t, backend.URL, interceptor).HandleRequest(rr, req)
+		require.Equal(t, 200, rr.Code)
+	}
+	hash := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// The verdict is signed, with the hashes of the files scanned
+	contentType, body := makeFilesBody(t, "hello", "world")
+	req := newHTTPRequest("POST", contentType, bytes.NewReader(body))
+	req.URL.RawQuery = "id=1"
+	req.Header.Set(client.ResultHeader, "FOUND")
+	req.Header.Set(client.HMACHeader, "sha256=forged")
+	forward(req)
+	require.NoError(t, verdictErr)
+	assert.Equal(t, client.RES_CLEAN, verdict.Result)
+	assert.Equal(t, "ClamAV 1.0.0/27000/Mon Jan  1 00:00:00 2024", verdict.Scanner)
+	assert.Equal(t, []client.PartHash{{Name: "file1.txt", SHA256: hash("hello")}, {Name: "file2.txt", SHA256: hash("world")}}, verdict.Parts)
+	assert.WithinDuration(t, time.Now(), verdict.Time, 2*time.Second)
+	assert.Empty(t, backendHeader.Values(client.SignatureHeader))
+
+	// Requests not scanned are signed too
+	forward(newHTTPRequest("GET", "", strings.NewReader("")))
+	require.NoError(t, verdictErr)
+	assert.Equal(t, client.RES_SKIPPED, verdict.Result)
+	assert.Empty(t, verdict.Parts)
+
+	// As are the detections of monitor mode
+	interceptor.Monitor = true
+	forward(newHTTPRequest("POST", "text/plain", strings.NewReader("VIRUS")))
+	require.NoError(t, verdictErr)
+	assert.Equal(t, client.RES_FOUND, verdict.Result)
+	assert.Equal(t, []string{"Test-Signature"}, verdict.Signatures)
+	assert.Equal(t, []client.PartHash{{Name: "untitled", SHA256: hash("VIRUS")}}, verdict.Parts)
+}
+
+func TestStripClammitHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Clammit-Backend", "http://app")
+	header.Set("X-Clammit-Result", "CLEAN")
+	header.Set("X-Clammit-Hmac", "sha256=forged")
+	header.Set("X-Forwarded-For", "kermit")
+	stripClammitHeaders(header)
+	assert.Equal(t, http.Header{"X-Clammit-Backend": {"http://app"}, "X-Forwarded-For": {"kermit"}}, header)
+}
+
+func TestBuildVerdictSigner(t *testing.T) {
+	signer, err := buildVerdictSigner(&ApplicationConfig{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, signer)
+
+	_, err = buildVerdictSigner(&ApplicationConfig{VerdictHMACKey: "short"}, nil)
+	assert.Error(t, err)
+
+	signer, err = buildVerdictSigner(&ApplicationConfig{VerdictHMACKey: string(verdictKey)}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, verdictKey, signer.Key)
+}